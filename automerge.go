@@ -0,0 +1,79 @@
+package fairy_kvdb
+
+import (
+	"errors"
+	"fairy-kvdb/utils"
+	"sync/atomic"
+	"time"
+)
+
+// 启动后台自动 merge 协程
+func (db *DB) startAutoMerge() {
+	if db.options.AutoMergeInterval <= 0 {
+		return
+	}
+	db.autoMergeStopCh = make(chan struct{})
+	db.autoMergeDoneCh = make(chan struct{})
+	go db.autoMergeLoop()
+}
+
+// 停止后台自动 merge 协程，并等待正在进行的 merge 退出
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeStopCh == nil {
+		return
+	}
+	close(db.autoMergeStopCh)
+	<-db.autoMergeDoneCh
+	db.autoMergeStopCh = nil
+}
+
+func (db *DB) autoMergeLoop() {
+	defer close(db.autoMergeDoneCh)
+	ticker := time.NewTicker(db.options.AutoMergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.autoMergeStopCh:
+			return
+		case now := <-ticker.C:
+			if !db.shouldAutoMerge(now) {
+				continue
+			}
+			err := db.Merge()
+			if err == nil {
+				atomic.AddUint64(&db.autoMergeCount, 1)
+			}
+			if err != nil && !errors.Is(err, ErrorMergeRatioUnreached) && !errors.Is(err, ErrorMergeIsProgress) {
+				db.lastAutoMergeErr.Store(err.Error())
+			}
+		}
+	}
+}
+
+// 判断当前是否需要触发一次自动 merge
+func (db *DB) shouldAutoMerge(now time.Time) bool {
+	if !db.inAutoMergeWindow(now) {
+		return false
+	}
+	reclaimSize := atomic.LoadUint64(&db.reclaimSize)
+	if reclaimSize == 0 || reclaimSize < db.options.AutoMergeMinReclaimSize {
+		return false
+	}
+	dirSize, err := utils.DirSize(db.options.DataDir)
+	if err != nil || dirSize == 0 {
+		return false
+	}
+	return float64(reclaimSize)/float64(dirSize) >= db.options.MergeRatio
+}
+
+func (db *DB) inAutoMergeWindow(now time.Time) bool {
+	if len(db.options.AutoMergeWindows) == 0 {
+		return true
+	}
+	for _, window := range db.options.AutoMergeWindows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package fairy_kvdb
+
+import "time"
+
+// 启动后台定期持久化协程，将异步写入的数据按照固定的间隔持久化到磁盘中
+func (db *DB) startAutoSync() {
+	if db.options.SyncInterval <= 0 {
+		return
+	}
+	db.autoSyncStopCh = make(chan struct{})
+	db.autoSyncDoneCh = make(chan struct{})
+	go db.autoSyncLoop()
+}
+
+// 停止后台定期持久化协程
+func (db *DB) stopAutoSync() {
+	if db.autoSyncStopCh == nil {
+		return
+	}
+	close(db.autoSyncStopCh)
+	<-db.autoSyncDoneCh
+	db.autoSyncStopCh = nil
+}
+
+func (db *DB) autoSyncLoop() {
+	defer close(db.autoSyncDoneCh)
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.autoSyncStopCh:
+			return
+		case <-ticker.C:
+			_ = db.syncUnflushed()
+		}
+	}
+}
+
+// 如果活跃文件中有还没有持久化的数据，则将其持久化
+func (db *DB) syncUnflushed() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.activeFile == nil || db.bytesWrite == 0 {
+		return nil
+	}
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	db.bytesWrite = 0
+	db.removeDeadBlobs()
+	return nil
+}
@@ -68,36 +68,57 @@ func (wb *WriteBatch) Delete(key []byte) error {
 
 // Commit 提交事务，将暂存的数据写道数据文件，并更新索引
 func (wb *WriteBatch) Commit() error {
+	_, err := wb.CommitOpt(WriteOptions{Sync: wb.options.SyncWrites || wb.db.options.SyncEveryWrite})
+	return err
+}
+
+// CommitOpt 按照指定的写入配置提交事务，返回事务的序列号，也就是它的 BTSN，没有任何写入时返回 0
+func (wb *WriteBatch) CommitOpt(opts WriteOptions) (uint64, error) {
 	// 为 WriteBatch 加锁
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 	// 校验 pendingWrites
 	if len(wb.pendingWrites) == 0 {
-		return nil
+		return 0, nil
 	}
 	if len(wb.pendingWrites) > wb.options.MaxBatchNum {
-		return ErrorExceedMaxWriteBatchNum
+		return 0, ErrorExceedMaxWriteBatchNum
+	}
+	if err := wb.db.checkWriteOptions(opts); err != nil {
+		return 0, err
+	}
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites))
+	for _, record := range wb.pendingWrites {
+		records = append(records, record)
 	}
-	// 为 db 加锁，保证 txn 提交的串行化
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
+	// 在 db 的锁保护下提交，保证 txn 提交的串行化
+	var btsn uint64
+	if err := wb.db.write(opts.Sync, func() error {
+		var err error
+		btsn, err = wb.db.commitBatch(records, !opts.DisableIndexUpdate)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+	return btsn, nil
+}
+
+// 将一批 LogRecord 作为一个 batch transaction 原子地写入数据文件，并更新索引，返回本次提交的 BTSN
+// 访问这个方法前必须加锁
+func (db *DB) commitBatch(records []*data.LogRecord, updateIndex bool) (uint64, error) {
 	// 获取当前最新 txn 的 BTSN
-	btsn := wb.db.FetchNextBTSN()
+	btsn := db.FetchNextBTSN()
 	// 写数据到数据文件中
-	positions := make(map[*data.LogRecord]*data.LogRecordPos)
-	for _, record := range wb.pendingWrites {
+	positions := make([]*data.LogRecordPos, len(records))
+	for i, record := range records {
 		record.Btsn = btsn
-		pos, err := wb.db.appendLogRecord(record)
+		pos, err := db.appendLogRecord(record)
 		if err != nil {
-			return err
-		}
-		positions[record] = pos
-		// 更新索引
-		if record.Type == data.LogRecordDelete {
-			wb.db.index.Delete(record.Key)
-		} else {
-			wb.db.index.Put(record.Key, pos)
+			return 0, err
 		}
+		positions[i] = pos
 	}
 	// 写一条标识事务完成的数据
 	endRecord := &data.LogRecord{
@@ -106,28 +127,18 @@ func (wb *WriteBatch) Commit() error {
 		Type:  data.LogRecordBatchEnd,
 		Btsn:  btsn,
 	}
-	if _, err := wb.db.appendLogRecord(endRecord); err != nil {
-		return err
-	}
-	// 根据配置决定是否持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
-		}
+	if _, err := db.appendLogRecord(endRecord); err != nil {
+		return 0, err
 	}
+	// 整个 batch 一起通知订阅者，保证它们看到的 batch 是完整的
+	db.notifyWatchers(records...)
 	// 更新内存索引
-	for record, pos := range positions {
-		var oldPos *data.LogRecordPos
-		if record.Type == data.LogRecordDelete {
-			oldPos, _ = wb.db.index.Delete(record.Key)
-		} else {
-			oldPos = wb.db.index.Put(record.Key, pos)
-		}
-		if oldPos != nil {
-			wb.db.increaseReclaimSize(oldPos.Sz)
-		}
+	if !updateIndex {
+		db.unindexedWrites = true
+		return btsn, nil
 	}
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
-	return nil
+	for i, record := range records {
+		db.updateIndex(record, positions[i], btsn)
+	}
+	return btsn, nil
 }
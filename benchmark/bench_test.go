@@ -7,6 +7,9 @@ import (
 	"fairy-kvdb/utils"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 )
 
@@ -71,3 +74,30 @@ func Benchmark_Delete(b *testing.B) {
 		}
 	}
 }
+
+func Benchmark_PutSyncParallel(b *testing.B) {
+	// 每次写入都需要持久化，并发的写入通过组提交共享同一次 sync
+	options := fairydb.DefaultOptions
+	options.DataDir = filepath.Join(os.TempDir(), "fairy-kvdb-bench-sync")
+	options.SyncEveryWrite = true
+	test.ClearDatabaseDir(options.DataDir)
+	defer test.ClearDatabaseDir(options.DataDir)
+	syncDb, err := fairydb.Open(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer syncDb.Close()
+
+	var counter int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("key-%d", atomic.AddInt64(&counter, 1))
+			if err := syncDb.Put([]byte(key), utils.RandomTestValue(128)); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// PutReader 从 r 中读取 size 字节作为 key 的值写入，用于存储无法一次性放入内存的大对象
+// 大对象的内容以流的方式写入单独的大对象文件，数据文件中只记录一条指向它的记录
+func (db *DB) PutReader(key []byte, r io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	if size < 0 {
+		return ErrorInvalidBlobSize
+	}
+	ref := &data.BlobRef{Id: atomic.AddUint64(&db.nextBlobId, 1), Size: size}
+	path := data.GetBlobFilePath(db.options.DataDir, ref.Id)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	// 开启加密时每个大对象文件使用单独的数据密钥加密，数据密钥随大对象记录一起加密存储
+	if db.cipher != nil {
+		ref.Key = data.NewBlobKey()
+	}
+	crc, err := writeBlobFile(path, r, size, ref.Key)
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	ref.Crc = crc
+	record := &data.LogRecord{Key: key, Value: data.EncodeBlobRef(ref), Type: data.LogRecordBlob}
+	if err := db.write(db.options.SyncEveryWrite, func() error {
+		return db.appendAndIndex(record)
+	}); err != nil {
+		// 记录可能已经写入了数据文件，此时大对象文件会在下次启动时作为无效文件被清理掉
+		return err
+	}
+	return nil
+}
+
+// GetReader 返回读取 key 对应的值的 io.ReadCloser，大对象的内容会在读取时逐步从文件中读出
+// 读取完毕之后必须调用 Close，在此之前大对象文件以及数据文件都不会被删除
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrorKeyEmpty
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired() {
+		return nil, ErrorKeyNotFound
+	}
+	if pos.Blob == 0 {
+		value, err := db.readValue(pos)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+	ref, err := db.readBlobRef(pos)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(data.GetBlobFilePath(db.options.DataDir, ref.Id))
+	if err != nil {
+		return nil, err
+	}
+	var reader io.Reader = io.LimitReader(file, ref.Size)
+	if ref.Key != nil {
+		reader = &cipher.StreamReader{S: data.NewBlobStream(ref.Key), R: reader}
+	}
+	readTs := atomic.LoadUint64(&db.nextBTSN)
+	epoch := db.versions.acquire(readTs)
+	return &blobReader{
+		db:     db,
+		file:   file,
+		reader: reader,
+		ref:    ref,
+		crc:    crc32.NewIEEE(),
+		readTs: readTs,
+		epoch:  epoch,
+	}, nil
+}
+
+// 大对象的读取器，读到末尾时校验内容的长度和 CRC
+type blobReader struct {
+	db     *DB
+	file   *os.File
+	reader io.Reader
+	ref    *data.BlobRef
+	crc    hash.Hash32
+	read   int64
+	readTs uint64 // 读取器作为读视图注册时的 BTSN，保证大对象文件在 Close 之前不会被删除
+	epoch  uint64 // 读取器作为读视图注册时所在的纪元
+	closed bool
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	n, err := br.reader.Read(p)
+	br.read += int64(n)
+	_, _ = br.crc.Write(p[:n])
+	if err == io.EOF && (br.read != br.ref.Size || br.crc.Sum32() != br.ref.Crc) {
+		return n, ErrorBlobCorrupt
+	}
+	return n, err
+}
+
+func (br *blobReader) Close() error {
+	if br.closed {
+		return nil
+	}
+	br.closed = true
+	err := br.file.Close()
+	br.db.versions.release(br.readTs, br.epoch)
+	return err
+}
+
+// 将 r 中的 size 字节写入大对象文件并持久化，返回内容的 CRC 校验码
+// key 不为空时使用它加密写入的内容，CRC 校验码依然根据原始内容计算
+func writeBlobFile(path string, r io.Reader, size int64, key []byte) (uint32, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFIlePerm)
+	if err != nil {
+		return 0, err
+	}
+	var writer io.Writer = file
+	if key != nil {
+		writer = &cipher.StreamWriter{S: data.NewBlobStream(key), W: file}
+	}
+	crc := crc32.NewIEEE()
+	n, err := io.CopyN(io.MultiWriter(writer, crc), r, size)
+	if err == io.EOF && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return crc.Sum32(), err
+}
+
+// 读取位置上的大对象记录
+// 访问这个方法前必须加锁
+func (db *DB) readBlobRef(pos *data.LogRecordPos) (*data.BlobRef, error) {
+	record, err := db.readLogRecord(pos)
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := data.DecodeBlobRef(record.Value)
+	if !ok || record.Type != data.LogRecordBlob {
+		return nil, ErrorBlobCorrupt
+	}
+	return ref, nil
+}
+
+// 一次性读出大对象的全部内容，用于 Get 等需要完整值的接口
+func (db *DB) readBlob(record *data.LogRecord) ([]byte, error) {
+	ref, ok := data.DecodeBlobRef(record.Value)
+	if !ok {
+		return nil, ErrorBlobCorrupt
+	}
+	value, err := os.ReadFile(data.GetBlobFilePath(db.options.DataDir, ref.Id))
+	if err != nil {
+		return nil, err
+	}
+	if ref.Key != nil {
+		data.NewBlobStream(ref.Key).XORKeyStream(value, value)
+	}
+	if int64(len(value)) != ref.Size || crc32.ChecksumIEEE(value) != ref.Crc {
+		return nil, ErrorBlobCorrupt
+	}
+	return value, nil
+}
+
+// 删除已经失效的大对象文件
+// 只有在覆盖或删除它们的记录持久化之后才能调用，否则崩溃之后重放数据文件时可能会重新引用这些文件
+// 访问这个方法前必须加锁
+func (db *DB) removeDeadBlobs() {
+	if len(db.deadBlobs) == 0 {
+		return
+	}
+	blobIds := db.deadBlobs
+	db.deadBlobs = nil
+	remove := func() {
+		for _, blobId := range blobIds {
+			_ = os.Remove(data.GetBlobFilePath(db.options.DataDir, blobId))
+		}
+	}
+	// 活跃的快照、事务或读取器可能还在引用这些文件
+	if !db.versions.deferUntilReleased(remove) {
+		remove()
+	}
+}
+
+// 加载大对象文件，删除没有被任何索引引用的文件，需要在加载索引之后调用
+// 这些文件来自写入记录之前发生的崩溃，或者是覆盖它们的记录已经持久化、但在删除之前发生了崩溃
+func (db *DB) loadBlobs() error {
+	dirEntries, err := os.ReadDir(filepath.Join(db.options.DataDir, data.BlobDirName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	referenced := make(map[uint64]struct{})
+	for _, idx := range db.familyIndexes() {
+		iter := idx.Iterator(false)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if blobId := iter.Value().Blob; blobId > 0 {
+				referenced[blobId] = struct{}{}
+				db.nextBlobId = max(db.nextBlobId, blobId)
+			}
+		}
+		iter.Close()
+	}
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, data.BlobNameSuffix) {
+			continue
+		}
+		blobId, err := strconv.ParseUint(strings.TrimSuffix(name, data.BlobNameSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		db.nextBlobId = max(db.nextBlobId, blobId)
+		if _, ok := referenced[blobId]; !ok {
+			if err := os.Remove(data.GetBlobFilePath(db.options.DataDir, blobId)); err != nil {
+				return err
+			}
+		}
+	}
+	db.deadBlobs = nil
+	return nil
+}
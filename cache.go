@@ -0,0 +1,127 @@
+package fairy_kvdb
+
+import (
+	"container/list"
+	"fairy-kvdb/data"
+	"sync"
+	"sync/atomic"
+)
+
+// 每条缓存的记录在 key 和 value 之外额外占用的内存
+const cacheEntryOverhead = 96
+
+// recordCache 读缓存，按照记录在磁盘上的位置缓存已经解码（解密、解压）的记录
+// 容量按照记录占用的字节数计算，超出时淘汰最久没有被访问的记录
+// 数据文件中的记录写入之后不会再被修改，文件 ID 也不会被复用，因此只需要在文件被淘汰时清理对应的缓存
+type recordCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List                         // 最近访问的记录在前面
+	entries  map[uint32]map[int64]*list.Element // 文件 ID -> 偏移 -> lru 中的元素
+	hits     uint64
+	misses   uint64
+}
+
+type cacheEntry struct {
+	fid    uint32
+	offset int64
+	record *data.LogRecord
+	size   int64
+}
+
+// 创建读缓存，capacity 不大于 0 时返回 nil，表示不开启缓存
+func newRecordCache(capacity int64) *recordCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &recordCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[uint32]map[int64]*list.Element),
+	}
+}
+
+// 查找位置上的记录，返回的记录是缓存内容的拷贝，调用方可以随意修改
+func (c *recordCache) get(pos *data.LogRecordPos) *data.LogRecord {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[pos.Fid][pos.Offset]
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	record := cloneLogRecord(elem.Value.(*cacheEntry).record)
+	c.mu.Unlock()
+	atomic.AddUint64(&c.hits, 1)
+	return record
+}
+
+// 缓存位置上的记录，超过整个缓存容量的记录不会被缓存
+func (c *recordCache) put(pos *data.LogRecordPos, record *data.LogRecord) {
+	if c == nil {
+		return
+	}
+	size := int64(len(record.Key)+len(record.Value)) + cacheEntryOverhead
+	if size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[pos.Fid][pos.Offset]; ok {
+		return
+	}
+	files := c.entries[pos.Fid]
+	if files == nil {
+		files = make(map[int64]*list.Element)
+		c.entries[pos.Fid] = files
+	}
+	entry := &cacheEntry{fid: pos.Fid, offset: pos.Offset, record: cloneLogRecord(record), size: size}
+	files[pos.Offset] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// 清理数据文件中所有被缓存的记录
+func (c *recordCache) removeFile(fid uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries[fid] {
+		c.remove(elem)
+	}
+}
+
+// 访问这个方法前必须加锁
+func (c *recordCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	c.size -= entry.size
+	files := c.entries[entry.fid]
+	delete(files, entry.offset)
+	if len(files) == 0 {
+		delete(c.entries, entry.fid)
+	}
+}
+
+// 返回缓存的命中和未命中次数
+func (c *recordCache) stats() (hits uint64, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func cloneLogRecord(record *data.LogRecord) *data.LogRecord {
+	cloned := *record
+	cloned.Key = append([]byte(nil), record.Key...)
+	cloned.Value = append([]byte(nil), record.Value...)
+	return &cloned
+}
@@ -0,0 +1,276 @@
+package fairy_kvdb
+
+import (
+	"encoding/binary"
+	"fairy-kvdb/data"
+	"fairy-kvdb/index"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	DefaultColumnFamilyName = "default" // 默认列族，也就是 DB 自身的键空间
+	familyRecordKey         = "column-families"
+	defaultFamilyId         = 0
+)
+
+// ColumnFamily 列族，数据库中一个独立命名的键空间
+// 每个列族都有自己的内存索引，所有列族共享数据文件和 BTSN
+type ColumnFamily struct {
+	db        *DB
+	id        uint32
+	name      string
+	indexType index.TypeEnum
+	index     index.Indexer
+	dropped   bool // 列族是否已经被删除，在 db.mu 的保护下访问
+}
+
+// ColumnFamilyOptions 列族的配置项
+type ColumnFamilyOptions struct {
+	IndexType index.TypeEnum // 列族的索引类型，只支持内存索引
+}
+
+var DefaultColumnFamilyOptions = ColumnFamilyOptions{
+	IndexType: index.BTreeIndexer,
+}
+
+// CreateColumnFamily 使用默认的配置项创建列族
+func (db *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	return db.CreateColumnFamilyWithOptions(name, DefaultColumnFamilyOptions)
+}
+
+// CreateColumnFamilyWithOptions 根据配置项创建列族
+// 列族的索引在启动时需要通过重放数据文件来构建，因此使用 B+ 树索引的数据库不支持列族
+func (db *DB) CreateColumnFamilyWithOptions(name string, options ColumnFamilyOptions) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, ErrorColumnFamilyNameEmpty
+	}
+	if db.options.IndexType == int8(index.BPlusTreeIndexer) || options.IndexType == index.BPlusTreeIndexer {
+		return nil, ErrorColumnFamilyUnsupported
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if name == DefaultColumnFamilyName || db.findColumnFamily(name) != nil {
+		return nil, ErrorColumnFamilyExists
+	}
+	cf := &ColumnFamily{
+		db:        db,
+		id:        db.nextFamilyId,
+		name:      name,
+		indexType: options.IndexType,
+		index:     index.NewIndexer(options.IndexType, nil),
+	}
+	db.families[cf.id] = cf
+	db.nextFamilyId++
+	if err := db.saveColumnFamilies(); err != nil {
+		delete(db.families, cf.id)
+		db.nextFamilyId--
+		return nil, err
+	}
+	return cf, nil
+}
+
+// ColumnFamily 根据名称获取列族
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if cf := db.findColumnFamily(name); cf != nil {
+		return cf, nil
+	}
+	return nil, ErrorColumnFamilyNotFound
+}
+
+// ListColumnFamilies 返回所有列族的名称（不包括默认列族）
+func (db *DB) ListColumnFamilies() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.families))
+	for _, cf := range db.families {
+		names = append(names, cf.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DropColumnFamily 删除列族以及其中所有的数据
+// 删除只会丢弃列族的索引，数据文件中属于这个列族的记录都会变成无效数据，在之后的 merge 中被清理掉
+func (db *DB) DropColumnFamily(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cf := db.findColumnFamily(name)
+	if cf == nil {
+		return ErrorColumnFamilyNotFound
+	}
+	delete(db.families, cf.id)
+	if err := db.saveColumnFamilies(); err != nil {
+		db.families[cf.id] = cf
+		return err
+	}
+	cf.dropped = true
+	iter := cf.index.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		db.markDead(iter.Value())
+	}
+	iter.Close()
+	return cf.index.Close()
+}
+
+// Name 返回列族的名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put 向列族中写入 key-value 数据
+func (cf *ColumnFamily) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	record := &data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal, Family: cf.id}
+	return cf.db.write(cf.db.options.SyncEveryWrite, func() error {
+		if cf.dropped {
+			return ErrorColumnFamilyNotFound
+		}
+		return cf.db.appendAndIndex(record)
+	})
+}
+
+// Get 读取列族中 key 对应的数据
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrorKeyEmpty
+	}
+	cf.db.mu.RLock()
+	defer cf.db.mu.RUnlock()
+	if cf.dropped {
+		return nil, ErrorColumnFamilyNotFound
+	}
+	pos := cf.index.Get(key)
+	if pos == nil || pos.IsExpired() {
+		return nil, ErrorKeyNotFound
+	}
+	return cf.db.readValue(pos)
+}
+
+// Delete 删除列族中 key 对应的数据
+func (cf *ColumnFamily) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	record := &data.LogRecord{Key: key, Type: data.LogRecordDelete, Family: cf.id}
+	return cf.db.write(cf.db.options.SyncEveryWrite, func() error {
+		if cf.dropped {
+			return ErrorColumnFamilyNotFound
+		}
+		if pos := cf.index.Get(key); pos == nil || pos.IsExpired() {
+			return ErrorKeyNotFound
+		}
+		return cf.db.appendAndIndex(record)
+	})
+}
+
+// NewIterator 返回遍历列族的迭代器
+func (cf *ColumnFamily) NewIterator(options *IteratorOptions) *Iterator {
+	return cf.db.newIterator(cf.index, options)
+}
+
+// 根据名称查找列族
+// 访问这个方法前必须加锁
+func (db *DB) findColumnFamily(name string) *ColumnFamily {
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// 获取列族的索引，列族不存在（比如已经被删除）时返回 nil
+// 访问这个方法前必须加锁
+func (db *DB) familyIndex(family uint32) index.Indexer {
+	if family == defaultFamilyId {
+		return db.index
+	}
+	if cf, ok := db.families[family]; ok {
+		return cf.index
+	}
+	return nil
+}
+
+// 获取所有列族（包括默认列族）的索引
+// 访问这个方法前必须加锁
+func (db *DB) familyIndexes() map[uint32]index.Indexer {
+	indexes := make(map[uint32]index.Indexer, len(db.families)+1)
+	indexes[defaultFamilyId] = db.index
+	for id, cf := range db.families {
+		indexes[id] = cf.index
+	}
+	return indexes
+}
+
+// 持久化列族信息
+// value: nextFamilyId (uvarint) | [id (uvarint) | indexType (1 byte) | nameSize (uvarint) | name] * n
+// 列族 ID 不会被复用，避免数据文件中已经删除的列族的记录在重启之后出现在新的列族中
+// 访问这个方法前必须加锁
+func (db *DB) saveColumnFamilies() error {
+	value := binary.AppendUvarint(nil, uint64(db.nextFamilyId))
+	for _, cf := range db.families {
+		value = binary.AppendUvarint(value, uint64(cf.id))
+		value = append(value, byte(cf.indexType))
+		value = binary.AppendUvarint(value, uint64(len(cf.name)))
+		value = append(value, cf.name...)
+	}
+	encRecord, _ := data.EncodeEncryptedLogRecord(&data.LogRecord{Key: []byte(familyRecordKey), Value: value}, data.CompressionNone, 0, db.cipher)
+	// 先写临时文件再重命名，保证列族信息文件总是完整的
+	path := filepath.Join(db.options.DataDir, data.FamilyFileName)
+	if err := writeFileSync(path+".tmp", encRecord); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 加载列族信息，需要在加载索引之前调用
+func (db *DB) loadColumnFamilies() error {
+	if _, err := os.Stat(filepath.Join(db.options.DataDir, data.FamilyFileName)); os.IsNotExist(err) {
+		return nil
+	}
+	familyFile, err := data.OpenFamilyFile(db.options.DataDir)
+	if err != nil {
+		return err
+	}
+	defer familyFile.Close()
+	familyFile.Cipher = db.cipher
+	record, _, err := familyFile.ReadLogRecord(0)
+	if err != nil {
+		return err
+	}
+	value := record.Value
+	nextId, n := binary.Uvarint(value)
+	if n <= 0 {
+		return ErrorDataFileCorrupt
+	}
+	value = value[n:]
+	for len(value) > 0 {
+		id, n := binary.Uvarint(value)
+		if n <= 0 || len(value) < n+1 {
+			return ErrorDataFileCorrupt
+		}
+		indexType := index.TypeEnum(value[n])
+		value = value[n+1:]
+		nameSize, n := binary.Uvarint(value)
+		if n <= 0 || uint64(len(value)-n) < nameSize {
+			return ErrorDataFileCorrupt
+		}
+		name := string(value[n : n+int(nameSize)])
+		value = value[n+int(nameSize):]
+		db.families[uint32(id)] = &ColumnFamily{
+			db:        db,
+			id:        uint32(id),
+			name:      name,
+			indexType: indexType,
+			index:     index.NewIndexer(indexType, nil),
+		}
+	}
+	db.nextFamilyId = uint32(nextId)
+	return nil
+}
@@ -0,0 +1,119 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"math"
+	"strconv"
+)
+
+// CompareAndSwap 当 key 当前的值等于 oldValue 时将其更新为 newValue，返回是否更新成功
+// oldValue 为 nil 表示要求 key 不存在
+func (db *DB) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrorKeyEmpty
+	}
+	swapped := false
+	err := db.write(db.options.SyncEveryWrite, func() error {
+		value, pos, err := db.currentValue(key)
+		if err != nil {
+			return err
+		}
+		if (oldValue == nil) != (pos == nil) || !bytes.Equal(value, oldValue) {
+			return nil
+		}
+		swapped = true
+		return db.appendAndIndex(&data.LogRecord{Key: key, Value: newValue, Type: data.LogRecordNormal})
+	})
+	return swapped, err
+}
+
+// PutIfAbsent 只有当 key 不存在时才写入，返回是否写入成功
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return db.CompareAndSwap(key, nil, value)
+}
+
+// DeleteIfValue 只有当 key 当前的值等于 value 时才删除，返回是否删除成功
+func (db *DB) DeleteIfValue(key []byte, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrorKeyEmpty
+	}
+	deleted := false
+	err := db.write(db.options.SyncEveryWrite, func() error {
+		current, pos, err := db.currentValue(key)
+		if err != nil {
+			return err
+		}
+		if pos == nil || !bytes.Equal(current, value) {
+			return nil
+		}
+		deleted = true
+		return db.appendAndIndex(&data.LogRecord{Key: key, Type: data.LogRecordDelete})
+	})
+	return deleted, err
+}
+
+// Increment 将 key 的值作为十进制整数加上 delta，返回相加之后的值
+// key 不存在时视为 0，原有的过期时间会被保留
+func (db *DB) Increment(key []byte, delta int64) (int64, error) {
+	if len(key) == 0 {
+		return 0, ErrorKeyEmpty
+	}
+	var result int64
+	err := db.write(db.options.SyncEveryWrite, func() error {
+		value, pos, err := db.currentValue(key)
+		if err != nil {
+			return err
+		}
+		var current int64
+		if pos != nil {
+			if current, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return ErrorValueNotInteger
+			}
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return ErrorIntegerOverflow
+		}
+		result = current + delta
+		record := &data.LogRecord{
+			Key:   key,
+			Value: []byte(strconv.FormatInt(result, 10)),
+			Type:  data.LogRecordNormal,
+		}
+		if pos != nil {
+			record.Expire = pos.Expire
+		}
+		return db.appendAndIndex(record)
+	})
+	return result, err
+}
+
+// 获取 key 当前的值以及位置，key 不存在或者已经过期时返回的位置为 nil
+// 访问这个方法前必须加锁
+func (db *DB) currentValue(key []byte) ([]byte, *data.LogRecordPos, error) {
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired() {
+		return nil, nil, nil
+	}
+	value, err := db.readValue(pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, pos, nil
+}
+
+// 写入一条非事务的记录，并更新索引
+// 访问这个方法前必须加锁
+func (db *DB) appendAndIndex(record *data.LogRecord) error {
+	record.Btsn = data.NoTxnBTSN
+	record.Seq = db.FetchNextBTSN()
+	pos, err := db.appendLogRecord(record)
+	if err != nil {
+		return err
+	}
+	db.notifyWatchers(record)
+	if ok := db.updateIndex(record, pos, record.Seq); !ok {
+		return ErrorIndexUpdateFailed
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	BlobDirName    = "blobs"
+	BlobNameSuffix = ".blob"
+)
+
+// BlobRef 大对象记录的 value，指向单独存放大对象内容的文件
+type BlobRef struct {
+	Id   uint64 // 大对象文件的 ID
+	Size int64  // 大对象的字节数
+	Crc  uint32 // 大对象内容的 CRC 校验码
+	Key  []byte // 加密大对象文件的数据密钥，为空表示大对象文件没有加密
+}
+
+// GetBlobFilePath 根据数据目录路径和大对象 ID 获取大对象文件路径
+func GetBlobFilePath(dirPath string, blobId uint64) string {
+	return filepath.Join(dirPath, BlobDirName, fmt.Sprintf("%09d", blobId)+BlobNameSuffix)
+}
+
+// EncodeBlobRef 对 BlobRef 进行序列化
+// +-----------------+-----------------+-----------+
+// |       Id        |      Size       |    Crc    |
+// +-----------------+-----------------+-----------+
+// | 变长，最大10bytes | 变长，最大10bytes | 4 bytes   |
+//
+// 大对象文件加密时，数据密钥追加在末尾
+func EncodeBlobRef(ref *BlobRef) []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+4+len(ref.Key))
+	idx := binary.PutUvarint(buf, ref.Id)
+	idx += binary.PutVarint(buf[idx:], ref.Size)
+	binary.LittleEndian.PutUint32(buf[idx:], ref.Crc)
+	idx += 4
+	idx += copy(buf[idx:], ref.Key)
+	return buf[:idx]
+}
+
+// DecodeBlobRef 对 BlobRef 进行反序列化
+func DecodeBlobRef(value []byte) (*BlobRef, bool) {
+	id, n := binary.Uvarint(value)
+	if n <= 0 || id == 0 {
+		return nil, false
+	}
+	idx := n
+	size, n := binary.Varint(value[idx:])
+	if n <= 0 || size < 0 || len(value) != idx+n+4 && len(value) != idx+n+4+BlobKeySize {
+		return nil, false
+	}
+	idx += n
+	ref := &BlobRef{Id: id, Size: size, Crc: binary.LittleEndian.Uint32(value[idx:])}
+	if key := value[idx+4:]; len(key) > 0 {
+		ref.Key = key
+	}
+	return ref, true
+}
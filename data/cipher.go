@@ -0,0 +1,111 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	cipherNonceSize = 12 // AES-GCM 的 nonce 长度
+	cipherTagSize   = 16 // AES-GCM 的认证标签长度
+
+	// CipherOverhead 加密之后记录的内容比原文多出的字节数
+	CipherOverhead = cipherNonceSize + cipherTagSize
+
+	// BlobKeySize 大对象文件的数据密钥长度
+	BlobKeySize = 32
+)
+
+// Cipher 使用 AES-GCM 加解密记录中的 key 和 value
+// 每条加密的记录在 header 中都带有密钥 ID，更换密钥之后依然可以通过旧密钥解密之前写入的记录
+type Cipher struct {
+	keyId    uint32
+	aead     cipher.AEAD
+	previous *Cipher // 只用于解密的旧密钥
+}
+
+// NewCipher 根据密钥创建 Cipher，密钥的长度必须是 16、24 或 32 字节，分别对应 AES-128、AES-192 和 AES-256
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrorInvalidEncryptionKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{keyId: KeyId(key), aead: aead}, nil
+}
+
+// KeyId 返回密钥的 ID，取密钥 SHA-256 摘要的前 4 个字节，用于识别记录是由哪个密钥加密的
+func KeyId(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// KeyId 返回用于加密的密钥的 ID
+func (c *Cipher) KeyId() uint32 {
+	return c.keyId
+}
+
+// Rotate 返回使用新密钥加密的 Cipher，它依然可以解密当前 Cipher 能够解密的记录
+func (c *Cipher) Rotate(key []byte) (*Cipher, error) {
+	rotated, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if rotated.keyId != c.keyId {
+		rotated.previous = c
+	}
+	return rotated, nil
+}
+
+// 加密 plaintext，additional 是需要认证但不需要加密的数据，返回 nonce + 密文 + 认证标签
+func (c *Cipher) seal(plaintext, additional []byte) []byte {
+	buf := make([]byte, cipherNonceSize, cipherNonceSize+len(plaintext)+cipherTagSize)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		panic(err) // 系统的随机数生成器不可用时无法安全地加密
+	}
+	return c.aead.Seal(buf, buf, plaintext, additional)
+}
+
+// 使用 keyId 对应的密钥解密 seal 的结果
+func (c *Cipher) open(keyId uint32, ciphertext, additional []byte) ([]byte, error) {
+	for ; c != nil; c = c.previous {
+		if c.keyId != keyId {
+			continue
+		}
+		if len(ciphertext) < CipherOverhead {
+			return nil, ErrorDecryptFailed
+		}
+		plaintext, err := c.aead.Open(nil, ciphertext[:cipherNonceSize], ciphertext[cipherNonceSize:], additional)
+		if err != nil {
+			return nil, ErrorDecryptFailed
+		}
+		return plaintext, nil
+	}
+	return nil, ErrorEncryptionKeyMismatch
+}
+
+// NewBlobKey 生成一个随机的大对象数据密钥
+// 大对象文件使用各自的数据密钥加密，数据密钥保存在加密的大对象记录中，因此更换密钥时不需要重写大对象文件
+func NewBlobKey() []byte {
+	key := make([]byte, BlobKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// NewBlobStream 返回使用数据密钥加解密大对象内容的流，每个数据密钥只用于一个大对象文件，因此使用固定的 IV
+func NewBlobStream(key []byte) cipher.Stream {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // 数据密钥的长度在解码 BlobRef 时已经校验过了
+	}
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// CompressionType value 的压缩算法
+type CompressionType = byte
+
+const (
+	CompressionNone  CompressionType = iota // 不压缩
+	CompressionFlate                        // 标准库的 flate（与 gzip 使用相同的算法），压缩率较高
+	CompressionLZ                           // 内置的 LZ 压缩，压缩率低于 flate，但是速度快很多
+)
+
+// CompressValue 使用指定的算法压缩 value，压缩之后没有变小时返回 false，此时应当直接存储原始的 value
+func CompressValue(compression CompressionType, value []byte) ([]byte, bool) {
+	var compressed []byte
+	switch compression {
+	case CompressionFlate:
+		var buf bytes.Buffer
+		writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		_, _ = writer.Write(value)
+		_ = writer.Close()
+		compressed = buf.Bytes()
+	case CompressionLZ:
+		compressed = lzCompress(value)
+	default:
+		return nil, false
+	}
+	if len(compressed) >= len(value) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+// DecompressValue 使用指定的算法解压 value
+func DecompressValue(compression CompressionType, value []byte) ([]byte, error) {
+	switch compression {
+	case CompressionFlate:
+		reader := flate.NewReader(bytes.NewReader(value))
+		defer reader.Close()
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, ErrorCorruptCompression
+		}
+		return decompressed, nil
+	case CompressionLZ:
+		return lzDecompress(value)
+	default:
+		return nil, ErrorUnknownCompression
+	}
+}
+
+const (
+	lzMinMatch  = 4  // 最短的匹配长度
+	lzHashBits  = 14 // 哈希表的大小
+	lzHashShift = 32 - lzHashBits
+)
+
+// 内置 LZ 压缩的格式
+// +-----------------+-----------------+-----------------+-----+
+// |  原始数据的长度    |     token 1     |     token 2     | ... |
+// +-----------------+-----------------+-----------------+-----+
+// | 变长，最大10bytes |                 |                 |     |
+//
+// token 以一个变长的 tag 开头，tag 的最低位为 0 时表示字面量，tag>>1 为字面量的长度，之后紧跟字面量本身；
+// 最低位为 1 时表示对之前数据的引用，tag>>1 为匹配长度减去 lzMinMatch，之后紧跟一个变长的回退距离
+func lzCompress(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+binary.MaxVarintLen64), uint64(len(src)))
+	table := make([]int, 1<<lzHashBits) // 4 字节前缀的哈希值 -> 上一次出现的位置 + 1
+	literalStart := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		word := binary.LittleEndian.Uint32(src[i:])
+		h := (word * 2654435761) >> lzHashShift
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != word {
+			i++
+			continue
+		}
+		length := lzMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendLZLiterals(dst, src[literalStart:i])
+		dst = binary.AppendUvarint(dst, uint64(length-lzMinMatch)<<1|1)
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		i += length
+		literalStart = i
+	}
+	return appendLZLiterals(dst, src[literalStart:])
+}
+
+func appendLZLiterals(dst, literals []byte) []byte {
+	if len(literals) == 0 {
+		return dst
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(literals))<<1)
+	return append(dst, literals...)
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > math.MaxUint32 {
+		return nil, ErrorCorruptCompression
+	}
+	src = src[n:]
+	dst := make([]byte, 0, size)
+	for len(src) > 0 {
+		tag, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, ErrorCorruptCompression
+		}
+		src = src[n:]
+		length := tag >> 1
+		if tag&1 == 0 {
+			if length > uint64(len(src)) || length > size-uint64(len(dst)) {
+				return nil, ErrorCorruptCompression
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		}
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, ErrorCorruptCompression
+		}
+		src = src[n:]
+		length += lzMinMatch
+		if length > size-uint64(len(dst)) {
+			return nil, ErrorCorruptCompression
+		}
+		// 引用的数据可能与正在写入的数据重叠，因此需要逐字节拷贝
+		start := len(dst) - int(offset)
+		for i := 0; i < int(length); i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, ErrorCorruptCompression
+	}
+	return dst, nil
+}
@@ -5,15 +5,19 @@ import (
 	"fairy-kvdb/fio"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 )
 
 const (
 	NameSuffix            = ".data"
+	HintSuffix            = ".hint"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	BtsnFileName          = "btsn"
 	BtsnFileKey           = "btsn"
+	FamilyFileName        = "column-families"
+	IndexSnapshotFileName = "index-snapshot"
 )
 
 // DataFile 数据文件
@@ -21,6 +25,7 @@ type DataFile struct {
 	FileId      uint32        // 文件 ID
 	WriteOffset int64         // 写入位置
 	IoManger    fio.IOManager // IO 管理器
+	Cipher      *Cipher       // 加解密记录的 Cipher，为空表示不加密，此时无法读取加密的记录
 }
 
 // GetDataFilePath 根据数据目录路径和 file ID 获取数据文件路径
@@ -28,6 +33,11 @@ func GetDataFilePath(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+NameSuffix)
 }
 
+// GetFileHintPath 根据数据目录路径和 file ID 获取数据文件对应的 hint 文件路径
+func GetFileHintPath(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintSuffix)
+}
+
 // OpenDataFile 打开一个新的数据文件
 func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	path := GetDataFilePath(dirPath, fileId)
@@ -47,6 +57,8 @@ func newDataFile(filePath string, fileId uint32, ioType fio.FileIOType) (*DataFi
 }
 
 // ReadLogRecord 从指定位置读取 LogRecord
+// 如果记录超出了文件末尾，说明它没有被完整写入，返回 ErrorIncompleteRecord
+// CRC 校验失败时依然会返回从 header 中解析出的记录长度，便于调用方判断损坏的位置
 func (df *DataFile) ReadLogRecord(offset int64) (record *LogRecord, recordSize int64, err error) {
 	// 获取文件大小
 	fileSize, err := df.IoManger.Size()
@@ -66,6 +78,9 @@ func (df *DataFile) ReadLogRecord(offset int64) (record *LogRecord, recordSize i
 	// 解码 LogRecordHeader
 	header, headerSize := DecodeLogRecordHeader(headerBuf)
 	if header == nil {
+		if headerReadSize > 0 {
+			return nil, 0, ErrorIncompleteRecord // 文件末尾只剩下了一部分 header
+		}
 		return nil, 0, io.EOF // 表示已经读取完了，所以返回 EOF
 	}
 	if header.Crc == 0 && header.KeySize == 0 && header.ValueSize == 0 {
@@ -73,26 +88,57 @@ func (df *DataFile) ReadLogRecord(offset int64) (record *LogRecord, recordSize i
 	}
 	// 取出 key 和 value 的长度
 	keySize, valueSize := int64(header.KeySize), int64(header.ValueSize)
-	recordSize = headerSize + keySize + valueSize
+	payloadSize := keySize + valueSize
+	if header.Flags&FlagEncrypted != 0 {
+		payloadSize += CipherOverhead
+	}
+	recordSize = headerSize + payloadSize
+	if offset+recordSize > fileSize {
+		return nil, recordSize, ErrorIncompleteRecord
+	}
 	// 初始化 LogRecord，并根据 header 填充 record
 	record = &LogRecord{
-		Type: header.RecType,
-		Btsn: header.Btsn,
+		Type:   header.RecType,
+		Btsn:   header.Btsn,
+		Expire: header.Expire,
+		Family: header.Family,
+		Seq:    header.Seq,
 	}
 	// 读取用户实际存储的 kv
-	if keySize > 0 || valueSize > 0 {
-		recordBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+	if payloadSize > 0 {
+		recordBuf, err := df.readNBytes(payloadSize, offset+headerSize)
 		if err != nil {
 			return nil, 0, err
 		}
-		// 解码 LogRecord
-		record.Key = recordBuf[:keySize]
-		record.Value = recordBuf[keySize:]
+		// 解码 LogRecord，加密记录的内容在校验 CRC 之后才能解密，这里暂时整体放在 value 中
+		if header.Flags&FlagEncrypted != 0 {
+			record.Value = recordBuf
+		} else {
+			record.Key = recordBuf[:keySize]
+			record.Value = recordBuf[keySize:]
+		}
 	}
 	// 校验 CRC
 	crc := ComputeCRC(record, headerBuf[4:headerSize])
 	if crc != header.Crc {
-		return nil, 0, ErrorInvalidCRC
+		return nil, recordSize, ErrorInvalidCRC
+	}
+	// 解密 key 和 value
+	if header.Flags&FlagEncrypted != 0 {
+		if df.Cipher == nil {
+			return nil, recordSize, ErrorEncryptionKeyRequired
+		}
+		plaintext, err := df.Cipher.open(header.KeyId, record.Value, headerBuf[4:headerSize])
+		if err != nil {
+			return nil, recordSize, err
+		}
+		record.Key, record.Value = plaintext[:keySize], plaintext[keySize:]
+	}
+	// 解压 value，CRC 校验的是压缩之后的数据
+	if header.Flags&FlagCompressed != 0 {
+		if record.Value, err = DecompressValue(header.Compression, record.Value); err != nil {
+			return nil, recordSize, err
+		}
 	}
 	return record, recordSize, nil
 }
@@ -133,6 +179,23 @@ func (df *DataFile) SetIOManager(dirPath string, ioType fio.FileIOType) error {
 	return nil
 }
 
+// Truncate 将数据文件截断到指定大小，丢弃之后的数据，截断之后使用标准文件 IO 重新打开
+func (df *DataFile) Truncate(dirPath string, size int64) error {
+	if err := df.IoManger.Close(); err != nil {
+		return err
+	}
+	if err := os.Truncate(GetDataFilePath(dirPath, df.FileId), size); err != nil {
+		return err
+	}
+	ioManager, err := fio.NewIOManager(GetDataFilePath(dirPath, df.FileId), fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	df.IoManger = ioManager
+	df.WriteOffset = size
+	return nil
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	buf := make([]byte, n)
 	_, err := df.IoManger.Read(buf, offset)
@@ -145,22 +208,40 @@ func OpenHintFile(dirPath string) (*DataFile, error) {
 	return newDataFile(filePath, 0, fio.StandardFIO)
 }
 
+// OpenFileHintFile 打开数据文件对应的 hint 文件，其中按顺序记录了数据文件中每一条记录的位置
+func OpenFileHintFile(dirPath string, fileId uint32) (*DataFile, error) {
+	return newDataFile(GetFileHintPath(dirPath, fileId), fileId, fio.StandardFIO)
+}
+
 // OpenMergeFinishedFile 打开（或创建）一个新的 merge 完成标志文件
 func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
 	filePath := filepath.Join(dirPath, MergeFinishedFileName)
 	return newDataFile(filePath, 0, fio.StandardFIO)
 }
 
-// WriteHintRecord 写入 hint 索引记录
-func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+// OpenFamilyFile 存储列族信息的文件
+func OpenFamilyFile(dirPath string) (*DataFile, error) {
+	filePath := filepath.Join(dirPath, FamilyFileName)
+	return newDataFile(filePath, 0, fio.StandardFIO)
+}
+
+// WriteHintRecord 写入 hint 索引记录，family 为 key 所属的列族
+func (df *DataFile) WriteHintRecord(family uint32, key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{
-		Key:   key,
-		Value: EncodeLogRecordPos(pos),
+		Key:    key,
+		Value:  EncodeLogRecordPos(pos),
+		Family: family,
 	}
-	encRecord, _ := EncodeLogRecord(record)
+	encRecord, _ := EncodeEncryptedLogRecord(record, CompressionNone, 0, df.Cipher)
 	return df.Write(encRecord)
 }
 
+// OpenIndexSnapshotFile 打开内存索引的快照文件，快照文件只会被整体读取，因此使用 mmap 加快读取
+func OpenIndexSnapshotFile(dirPath string) (*DataFile, error) {
+	filePath := filepath.Join(dirPath, IndexSnapshotFileName)
+	return newDataFile(filePath, 0, fio.MemoryMapIO)
+}
+
 // OpenBtsnFile 存储 batch transaction 序列号的文件，用于启动数据库时，数据库能够知道当前的 batch transaction 序列号，从而继续分配
 // 对于 DB 启动时不需要遍历数据日志文件的索引类型，需要借用此文件来存储 batch transaction 序列号，比如 BPlusTreeIndex
 func OpenBtsnFile(dirPath string) (*DataFile, error) {
@@ -3,5 +3,12 @@ package data
 import "errors"
 
 var (
-	ErrorInvalidCRC = errors.New("invalid Crc")
+	ErrorInvalidCRC            = errors.New("invalid Crc")
+	ErrorIncompleteRecord      = errors.New("incomplete log record")
+	ErrorUnknownCompression    = errors.New("unknown compression type")
+	ErrorCorruptCompression    = errors.New("compressed value is corrupt")
+	ErrorInvalidEncryptionKey  = errors.New("encryption key must be 16, 24 or 32 bytes")
+	ErrorEncryptionKeyRequired = errors.New("record is encrypted but no encryption key is set")
+	ErrorEncryptionKeyMismatch = errors.New("record is encrypted with a different key")
+	ErrorDecryptFailed         = errors.New("failed to decrypt record")
 )
@@ -3,39 +3,114 @@ package data
 import (
 	"encoding/binary"
 	"hash/crc32"
+	"math"
+	"time"
 )
 
 // 文件中一个 LogRecordHeader 的长度
-// Crc  type  KeySize  ValueSize
+// Crc  type  flags  BTSN  Expire  Family  Seq  Compression  KeyId  KeySize  ValueSize
 //
-//	4 + 1 + 10 +  5      +  5      = 25
-const maxLogRecordHeaderSize = 4 + 1 + binary.MaxVarintLen64 + binary.MaxVarintLen32*2
+//	4 + 1 +   1  +  10 +  10   +  5     + 10 +  1          +  4   +  5      +  5      = 56
+const maxLogRecordHeaderSize = 4 + 1 + 1 + binary.MaxVarintLen64*3 + 1 + 4 + binary.MaxVarintLen32*3
+
+// RecType 字节的最高位用于标识 header 中是否紧跟着一个扩展标志字节
+// 不带任何扩展字段的 record 编码与旧格式保持一致，因此旧的数据文件依然可以正常读取
+const recordExtendedBit = 0x80
+
+// LogRecordFlag header 的扩展标志位，标识 header 中额外携带了哪些可选字段
+type LogRecordFlag = byte
+
+const (
+	FlagHasExpire  LogRecordFlag = 1 << iota // header 中携带了过期时间
+	FlagHasFamily                            // header 中携带了列族 ID
+	FlagHasSeq                               // header 中携带了提交序列号
+	FlagCompressed                           // value 经过了压缩，header 中携带了压缩算法
+	FlagEncrypted                            // key 和 value 经过了加密，header 中携带了密钥 ID
+)
 
 // LogRecordPos 数据内存索引，主要是描述数据再磁盘上的位置
 type LogRecordPos struct {
 	Fid    uint32 // file ID，表示将数据存储到了哪个文件中
 	Offset int64  // offset，表示将数据存放到了数据文件的哪个位置
 	Sz     uint64 // size，表示这个 log record 在磁盘中占据的大小
+	Expire int64  // 过期时间（UnixNano），0 表示永不过期
+	Chain  uint32 // 位置上的记录是合并操作数时，表示操作数链上操作数的个数，0 表示普通记录
+	Blob   uint64 // 位置上的记录是大对象时，表示大对象文件的 ID，0 表示普通记录
 }
 
+// IsExpired 判断该位置上的数据是否已经过期
+func (pos *LogRecordPos) IsExpired() bool {
+	return isExpired(pos.Expire)
+}
+
+// 位置编码的版本标记，写在编码的第一个字节
+// 旧格式的第一个字节是 Fid 的最高字节，只有文件 ID 不小于 0xff000000 时才会与它相同
+const logRecordPosVersion = 0xff
+
+// 旧格式的位置编码固定为 22 字节：Fid 占 4 字节，Offset 从第 4 字节开始，Sz 从第 12 字节开始，其余部分补 0
+const legacyLogRecordPosSize = 12 + binary.MaxVarintLen64
+
 // EncodeLogRecordPos 对 LogRecordPos 进行序列化
+// +-----------+-----------+-----------------+-----------------+-----------------+
+// |  Version  |    Fid    |     Offset      |       Sz        |     Expire      |
+// +-----------+-----------+-----------------+-----------------+-----------------+
+// | 1 byte    | 4 bytes   | 变长，最大10bytes | 变长，最大10bytes | 变长，最大10bytes |
+//
+// Chain 和 Blob 不为 0 时依次追加在末尾
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, 12+binary.MaxVarintLen64)
-	binary.BigEndian.PutUint32(buf[:4], pos.Fid)
-	binary.PutVarint(buf[4:], pos.Offset)
-	binary.PutUvarint(buf[12:], pos.Sz)
-	return buf
+	buf := make([]byte, 5+binary.MaxVarintLen64*4+binary.MaxVarintLen32)
+	buf[0] = logRecordPosVersion
+	binary.BigEndian.PutUint32(buf[1:5], pos.Fid)
+	var idx = 5
+	idx += binary.PutVarint(buf[idx:], pos.Offset)
+	idx += binary.PutUvarint(buf[idx:], pos.Sz)
+	idx += binary.PutVarint(buf[idx:], pos.Expire)
+	if pos.Chain > 0 || pos.Blob > 0 {
+		idx += binary.PutUvarint(buf[idx:], uint64(pos.Chain))
+	}
+	if pos.Blob > 0 {
+		idx += binary.PutUvarint(buf[idx:], pos.Blob)
+	}
+	return buf[:idx]
 }
 
-// DecodeLogRecordPos 对 LogRecordPos 进行反序列化
+// DecodeLogRecordPos 对 LogRecordPos 进行反序列化，同时兼容旧格式的编码（B+ 树索引和 merge 的 Hint 文件中可能还保存着旧格式）
 func DecodeLogRecordPos(buf []byte) *LogRecordPos {
-	if len(buf) <= 12 {
+	if len(buf) == legacyLogRecordPosSize && buf[0] != logRecordPosVersion {
+		return decodeLegacyLogRecordPos(buf)
+	}
+	if len(buf) <= 5 || buf[0] != logRecordPosVersion {
 		return nil
 	}
-	idx := 4
+	idx := 5
 	offset, n := binary.Varint(buf[idx:])
 	idx += n
-	sz, _ := binary.Uvarint(buf[idx:])
+	sz, n := binary.Uvarint(buf[idx:])
+	idx += n
+	expire, n := binary.Varint(buf[idx:])
+	idx += n
+	var chain, blob uint64
+	if n > 0 && idx < len(buf) {
+		chain, n = binary.Uvarint(buf[idx:])
+		idx += n
+	}
+	if n > 0 && idx < len(buf) {
+		blob, _ = binary.Uvarint(buf[idx:])
+	}
+	return &LogRecordPos{
+		Fid:    binary.BigEndian.Uint32(buf[1:5]),
+		Offset: offset,
+		Sz:     sz,
+		Expire: expire,
+		Chain:  uint32(chain),
+		Blob:   blob,
+	}
+}
+
+// 解码旧格式的位置编码，旧格式中只有 Fid、Offset 和 Sz
+func decodeLegacyLogRecordPos(buf []byte) *LogRecordPos {
+	offset, _ := binary.Varint(buf[4:])
+	sz, _ := binary.Uvarint(buf[12:])
 	return &LogRecordPos{
 		Fid:    binary.BigEndian.Uint32(buf[:4]),
 		Offset: offset,
@@ -43,58 +118,245 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	}
 }
 
+// EncodeMergeOperand 对合并操作数记录的 value 进行编码
+// +-----------------+-----------------+-----------------+
+// |   PrevPosSize   |     PrevPos     |     Operand     |
+// +-----------------+-----------------+-----------------+
+// | 变长，最大5bytes  | PrevPosSize     | 剩余的全部字节     |
+//
+// PrevPos 指向操作数链上的前一条记录，PrevPosSize 为 0 表示没有前一条记录
+func EncodeMergeOperand(prev *LogRecordPos, operand []byte) []byte {
+	var prevBuf []byte
+	if prev != nil {
+		prevBuf = EncodeLogRecordPos(prev)
+	}
+	buf := make([]byte, binary.MaxVarintLen32+len(prevBuf)+len(operand))
+	idx := binary.PutUvarint(buf, uint64(len(prevBuf)))
+	idx += copy(buf[idx:], prevBuf)
+	idx += copy(buf[idx:], operand)
+	return buf[:idx]
+}
+
+// DecodeMergeOperand 对合并操作数记录的 value 进行解码，返回前一条记录的位置以及操作数
+func DecodeMergeOperand(value []byte) (*LogRecordPos, []byte, bool) {
+	prevSize, n := binary.Uvarint(value)
+	if n <= 0 || uint64(len(value)-n) < prevSize {
+		return nil, nil, false
+	}
+	var prev *LogRecordPos
+	if prevSize > 0 {
+		if prev = DecodeLogRecordPos(value[n : n+int(prevSize)]); prev == nil {
+			return nil, nil, false
+		}
+	}
+	return prev, value[n+int(prevSize):], true
+}
+
+// EncodeFileHintRecord 根据数据文件中的一条记录生成它在 hint 文件中对应的记录
+// hint 记录保留了原记录的 key、类型、列族、序列号和过期时间，value 的编码如下
+// +-----------------+-----------------+-----------------+
+// |     PosSize     |       Pos       |   RedoValue     |
+// +-----------------+-----------------+-----------------+
+// | 变长，最大5bytes  | PosSize         | 剩余的全部字节     |
+//
+// RedoValue 只保留重放索引时需要用到的部分 value，普通记录和删除记录不需要 value，合并操作数只需要前一条记录的位置
+func EncodeFileHintRecord(record *LogRecord, pos *LogRecordPos) *LogRecord {
+	var redoValue []byte
+	switch record.Type {
+	case LogRecordNormal, LogRecordDelete:
+	case LogRecordMergeOperand:
+		prev, _, _ := DecodeMergeOperand(record.Value)
+		redoValue = EncodeMergeOperand(prev, nil)
+	default:
+		redoValue = record.Value
+	}
+	posBuf := EncodeLogRecordPos(pos)
+	buf := make([]byte, binary.MaxVarintLen32+len(posBuf)+len(redoValue))
+	idx := binary.PutUvarint(buf, uint64(len(posBuf)))
+	idx += copy(buf[idx:], posBuf)
+	idx += copy(buf[idx:], redoValue)
+	return &LogRecord{
+		Key:    record.Key,
+		Value:  buf[:idx],
+		Type:   record.Type,
+		Btsn:   record.Btsn,
+		Expire: record.Expire,
+		Family: record.Family,
+		Seq:    record.Seq,
+	}
+}
+
+// DecodeFileHintRecord 对 hint 文件中的记录进行解码，返回用于重放索引的记录以及它在数据文件中的位置
+func DecodeFileHintRecord(hint *LogRecord) (*LogRecord, *LogRecordPos, bool) {
+	posSize, n := binary.Uvarint(hint.Value)
+	if n <= 0 || uint64(len(hint.Value)-n) < posSize {
+		return nil, nil, false
+	}
+	pos := DecodeLogRecordPos(hint.Value[n : n+int(posSize)])
+	if pos == nil {
+		return nil, nil, false
+	}
+	record := &LogRecord{
+		Key:    hint.Key,
+		Type:   hint.Type,
+		Btsn:   hint.Btsn,
+		Expire: hint.Expire,
+		Family: hint.Family,
+		Seq:    hint.Seq,
+	}
+	if redoValue := hint.Value[n+int(posSize):]; len(redoValue) > 0 {
+		record.Value = redoValue
+	}
+	return record, pos, true
+}
+
 type LogRecordType byte
 
 const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDelete
 	LogRecordBatchEnd
+	LogRecordMergeOperand // 合并操作数，读取时需要与之前的值一起交给 MergeOperator 折叠
+	LogRecordRangeDelete  // 范围删除标记，key 为范围的起点，value 为范围的终点（不包含），终点为空表示没有上界
+	LogRecordBlob         // 大对象，value 为 BlobRef，内容单独存放在大对象文件中
 )
 
 // LogRecord 写入到数据文件的数据记录
 type LogRecord struct {
-	Key   []byte // key
-	Value []byte // value
-	Type  LogRecordType
-	Btsn  uint64 // BTSN，Batch Transaction Sequence Number，用于唯一标识一个 batch transaction
+	Key    []byte // key
+	Value  []byte // value
+	Type   LogRecordType
+	Btsn   uint64 // BTSN，Batch Transaction Sequence Number，用于唯一标识一个 batch transaction
+	Expire int64  // 过期时间（UnixNano），0 表示永不过期
+	Family uint32 // 列族 ID，0 表示默认列族
+	Seq    uint64 // 非 batch 写入的提交序列号，batch 中的记录使用 BTSN 作为序列号
+}
+
+// Sequence 返回记录提交时的序列号，0 表示没有记录序列号（旧版本写入的数据）
+func (lr *LogRecord) Sequence() uint64 {
+	if lr.Btsn != NoTxnBTSN {
+		return lr.Btsn
+	}
+	return lr.Seq
+}
+
+// IsExpired 判断该 LogRecord 是否已经过期
+func (lr *LogRecord) IsExpired() bool {
+	return isExpired(lr.Expire)
 }
 
 // LogRecordHeader LogRecord 的头部信息
 type LogRecordHeader struct {
-	Crc       uint32 // CRC 校验码
-	RecType   LogRecordType
-	Btsn      uint64
-	KeySize   uint32
-	ValueSize uint32
+	Crc         uint32 // CRC 校验码
+	RecType     LogRecordType
+	Flags       LogRecordFlag // 扩展标志位，标识 header 中带有哪些可选字段
+	Btsn        uint64
+	Expire      int64
+	Family      uint32
+	Seq         uint64
+	Compression CompressionType // value 的压缩算法，只有设置了 FlagCompressed 时才有意义
+	KeyId       uint32          // 加密记录的密钥 ID，只有设置了 FlagEncrypted 时才有意义
+	KeySize     uint32
+	ValueSize   uint32
 }
 
 // EncodeLogRecord 对 LogRecord 进行序列化
 // 返回字节数组以及长度
-// +-----------------+-----------------+---------------+-----------------+-----------------+------------------+-----------------+
-// |      Crc        |     RecType     |     BSTN      | KeySize         |    ValueSize    |     key          |  value		    |
-// +-----------------+-----------------+---------------+-  --------------+-----------------+------------------+-----------------+
-// | 4 bytes         | 1 byte          |变长，最长8bytes | 变长，最大5bytes | 变长，最大5bytes  | KeySize bytes    | ValueSize bytes |
+// +-----------+-----------+-----------------+----------------+-----------------+-----------------+-----------------+-----------------+-----------------+---------------+-----------------+
+// |   Crc     |  RecType  |      Flags      |      BSTN      |     Expire      |     Family      |       Seq       |     KeySize     |    ValueSize    |      key      |      value      |
+// +-----------+-----------+-----------------+----------------+-----------------+-----------------+-----------------+-----------------+-----------------+---------------+-----------------+
+// | 4 bytes   | 1 byte    | 1 byte，可选     |变长，最长10bytes | 变长，可选        | 变长，可选        | 变长，可选        | 变长，最大5bytes  | 变长，最大5bytes  | KeySize bytes | ValueSize bytes |
+//
+// 当 RecType 的最高位为 1 时，其后紧跟一个 Flags 字节，Flags 中的每一位标识了一个可选字段是否存在
+// value 被压缩时，Seq 之后还会有一个字节的压缩算法，ValueSize 为压缩之后的长度
+// 记录被加密时，之后还会有 4 个字节的密钥 ID，key 和 value 被整体加密，加密之后的内容比 KeySize + ValueSize 多出 CipherOverhead 个字节
 func EncodeLogRecord(record *LogRecord) ([]byte, int64) {
+	return EncodeCompressedLogRecord(record, CompressionNone, 0)
+}
+
+// EncodeCompressedLogRecord 对 LogRecord 进行序列化，value 的长度不小于 threshold 时使用 compression 压缩
+// 压缩之后没有变小的 value 依然按原样存储
+func EncodeCompressedLogRecord(record *LogRecord, compression CompressionType, threshold int) ([]byte, int64) {
+	return EncodeEncryptedLogRecord(record, compression, threshold, nil)
+}
+
+// EncodeEncryptedLogRecord 对 LogRecord 进行序列化，先按照 EncodeCompressedLogRecord 的规则压缩 value，
+// cipher 不为空时再对 key 和 value 进行加密，header 作为附加数据参与认证
+func EncodeEncryptedLogRecord(record *LogRecord, compression CompressionType, threshold int, cipher *Cipher) ([]byte, int64) {
+	value := record.Value
+	var compressed bool
+	if compression != CompressionNone && len(value) >= threshold {
+		if compressedValue, ok := CompressValue(compression, value); ok {
+			value, compressed = compressedValue, true
+		}
+	}
 	// 初始化一个 header 部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 	// 第 5 个字节存储 type
 	header[4] = byte(record.Type)
 	var offset = 5
-	// 5 字节后，存储 LSN
+	// 如果有可选字段，则需要额外写一个 flags 字节
+	var flags LogRecordFlag
+	if record.Expire != 0 {
+		flags |= FlagHasExpire
+	}
+	if record.Family != 0 {
+		flags |= FlagHasFamily
+	}
+	if record.Seq != 0 {
+		flags |= FlagHasSeq
+	}
+	if compressed {
+		flags |= FlagCompressed
+	}
+	if cipher != nil {
+		flags |= FlagEncrypted
+	}
+	if flags != 0 {
+		header[4] |= recordExtendedBit
+		header[offset] = flags
+		offset++
+	}
+	// 之后存储 BTSN
 	btsn := record.Btsn
 	offset += binary.PutUvarint(header[offset:], btsn)
+	// 存储可选字段
+	if flags&FlagHasExpire != 0 {
+		offset += binary.PutVarint(header[offset:], record.Expire)
+	}
+	if flags&FlagHasFamily != 0 {
+		offset += binary.PutUvarint(header[offset:], uint64(record.Family))
+	}
+	if flags&FlagHasSeq != 0 {
+		offset += binary.PutUvarint(header[offset:], record.Seq)
+	}
+	if compressed {
+		header[offset] = compression
+		offset++
+	}
+	if cipher != nil {
+		binary.BigEndian.PutUint32(header[offset:], cipher.keyId)
+		offset += 4
+	}
 	// 之后存储的是 key 和 value 的长度信息
 	keySize := int64(len(record.Key))
-	valueSize := int64(len(record.Value))
+	valueSize := int64(len(value))
 	offset += binary.PutVarint(header[offset:], keySize)
 	offset += binary.PutVarint(header[offset:], valueSize)
 	totalSize := int64(offset) + keySize + valueSize
+	if cipher != nil {
+		totalSize += CipherOverhead
+	}
 	encBytes := make([]byte, totalSize)
 	// 将 header 部分的内容拷贝到 encBytes 中
 	copy(encBytes, header)
 	// 将 key 和 value 拷贝到 encBytes 中
 	copy(encBytes[offset:], record.Key)
-	copy(encBytes[offset+len(record.Key):], record.Value)
+	copy(encBytes[offset+len(record.Key):], value)
+	if cipher != nil {
+		sealed := cipher.seal(encBytes[offset:offset+int(keySize+valueSize)], encBytes[4:offset])
+		copy(encBytes[offset:], sealed)
+	}
 	crc := crc32.ChecksumIEEE(encBytes[4:])
 	binary.LittleEndian.PutUint32(encBytes, crc)
 	return encBytes, totalSize
@@ -107,16 +369,70 @@ func DecodeLogRecordHeader(buf []byte) (record *LogRecordHeader, length int64) {
 	}
 	header := &LogRecordHeader{
 		Crc:     binary.LittleEndian.Uint32(buf[:4]),
-		RecType: LogRecordType(buf[4]),
+		RecType: LogRecordType(buf[4] &^ recordExtendedBit),
 	}
 	var offset = 5
-	// 读取 BTSN
+	// 读取扩展标志位
+	if buf[4]&recordExtendedBit != 0 {
+		if len(buf) <= offset {
+			return nil, 0
+		}
+		header.Flags = buf[offset]
+		offset++
+	}
+	// 读取 BTSN，变长编码不完整或者溢出时说明 header 已经损坏
 	btsn, n := binary.Uvarint(buf[offset:])
+	if n <= 0 {
+		return nil, 0
+	}
 	offset += n
+	// 读取可选字段
+	if header.Flags&FlagHasExpire != 0 {
+		header.Expire, n = binary.Varint(buf[offset:])
+		if n <= 0 {
+			return nil, 0
+		}
+		offset += n
+	}
+	if header.Flags&FlagHasFamily != 0 {
+		family, n := binary.Uvarint(buf[offset:])
+		if n <= 0 || family > math.MaxUint32 {
+			return nil, 0
+		}
+		header.Family = uint32(family)
+		offset += n
+	}
+	if header.Flags&FlagHasSeq != 0 {
+		header.Seq, n = binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, 0
+		}
+		offset += n
+	}
+	if header.Flags&FlagCompressed != 0 {
+		if len(buf) <= offset {
+			return nil, 0
+		}
+		header.Compression = buf[offset]
+		offset++
+	}
+	if header.Flags&FlagEncrypted != 0 {
+		if len(buf) < offset+4 {
+			return nil, 0
+		}
+		header.KeyId = binary.BigEndian.Uint32(buf[offset:])
+		offset += 4
+	}
 	// 读取 key 和 value 的长度
 	keySize, n := binary.Varint(buf[offset:])
+	if n <= 0 || keySize < 0 {
+		return nil, 0
+	}
 	offset += n
 	valueSize, n := binary.Varint(buf[offset:])
+	if n <= 0 || valueSize < 0 {
+		return nil, 0
+	}
 	offset += n
 	header.Btsn = btsn
 	header.KeySize = uint32(keySize)
@@ -138,6 +454,11 @@ func ComputeCRC(record *LogRecord, header []byte) uint32 {
 
 const NoTxnBTSN = 0
 
+// 判断过期时间是否已经到达，0 表示永不过期
+func isExpired(expire int64) bool {
+	return expire != 0 && expire <= time.Now().UnixNano()
+}
+
 type BatchTxnRecord struct {
 	Record *LogRecord
 	Pos    *LogRecordPos
@@ -9,31 +9,70 @@ import (
 	"fmt"
 	"github.com/gofrs/flock"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const fileLockName = "fairy-kvdb.lock"
 
 // DB 存储引擎实例
 type DB struct {
-	options        Options
-	mu             *sync.RWMutex
-	activeFile     *data.DataFile            // 当前活跃的数据文件，可以用于写入
-	olderFiles     map[uint32]*data.DataFile // 旧的数据文件，只能用于读取
-	index          index.Indexer
-	nextBTSN       uint64       // 下一个 Batch Transaction Sequence Number，全局递增
-	isMerging      int32        // 是否正在执行 merge 操作（0 表示 false，1 表示 true）
-	btsnFileExists bool         // 标识 btsn file 是否存在
-	isPureBoot     bool         // 是否是纯净启动，也就是启动时数据目录下没有任何数据
-	fileLock       *flock.Flock // 文件锁，保证多进程之间的互斥
-	bytesWrite     uint64       // 在数据文件中累计写了多少字节（用于决定什么时候同步）
-	reclaimSize    uint64       // 表示有多少数据是无效的，可以用于决定什么时候进行 merge
+	options         Options
+	mu              *sync.RWMutex
+	activeFile      *data.DataFile            // 当前活跃的数据文件，可以用于写入
+	olderFiles      map[uint32]*data.DataFile // 旧的数据文件，只能用于读取
+	retiredFiles    map[uint32]*data.DataFile // 已经被 merge 淘汰、但仍可能被快照引用的数据文件
+	fileLiveSizes   map[uint32]uint64         // 每个数据文件中仍然有效的数据量，文件大小减去它就是无效的数据量
+	fileMaxSeqs     map[uint32]uint64         // 每个数据文件中记录的序列号上限，重放变更事件时可以跳过整个文件，没有记录的文件需要完整读取
+	index           index.Indexer
+	nextBTSN        uint64          // 最近一次分配的 Batch Transaction Sequence Number，全局递增
+	isMerging       int32           // 是否正在执行 merge 操作（0 表示 false，1 表示 true）
+	btsnFileExists  bool            // 标识 btsn file 是否存在
+	isPureBoot      bool            // 是否是纯净启动，也就是启动时数据目录下没有任何数据
+	fileLock        *flock.Flock    // 文件锁，保证多进程之间的互斥
+	bytesWrite      uint64          // 在数据文件中累计写了多少字节（用于决定什么时候同步）
+	reclaimSize     uint64          // 表示有多少数据是无效的，可以用于决定什么时候进行 merge
+	versions        *versionTracker // 多版本控制，为活跃的事务保留被覆盖的旧版本
+	commitQueue     commitQueue     // 等待组提交的同步写入请求
+	groupCommitting bool            // 是否正在执行组提交，组内的写入不单独持久化
+	writeSyncs      uint64          // 写入时持久化数据文件的次数
+	closing         int32           // 是否正在关闭（0 表示 false，1 表示 true），正在进行的 merge 会因此中止
+	cipher          *data.Cipher    // 加解密记录的 Cipher，没有设置加密密钥时为空
+	cache           *recordCache    // 读缓存，没有开启时为空
+
+	mergeOperandKeys map[string]struct{}      // merge 期间追加过合并操作数的 key
+	families         map[uint32]*ColumnFamily // 除默认列族之外的所有列族
+	nextFamilyId     uint32                   // 下一个列族 ID，列族 ID 不会被复用
+	nextBlobId       uint64                   // 最近一次分配的大对象文件 ID
+	deadBlobs        []uint64                 // 已经失效、等待覆盖它们的记录持久化之后删除的大对象文件
+	activeHints      []byte                   // 活跃文件中每一条记录对应的 hint 记录，活跃文件写满之后写入它的 hint 文件
+	noFileHints      bool                     // 不为数据文件生成 hint 文件
+	noIndexSnapshot  bool                     // 关闭时不保存内存索引的快照
+	unindexedWrites  bool                     // 有写入跳过了索引更新，重新打开数据库之前内存索引与数据文件不一致
+
+	watchMu      sync.Mutex            // 保护 watchers
+	watchers     map[*watcher]struct{} // 变更事件的订阅者
+	watchCloseCh chan struct{}         // 数据库关闭时通知订阅者的协程退出
+	heldEvents   *[][]Event            // 组提交期间暂存变更事件，sync 成功之后才通知订阅者，由 db.mu 保护
+
+	autoMergeStopCh  chan struct{} // 通知后台自动 merge 协程退出
+	autoMergeDoneCh  chan struct{} // 后台自动 merge 协程已经退出
+	mergeCount       uint64        // 完成的 merge 次数
+	autoMergeCount   uint64        // 其中由后台自动触发的 merge 次数
+	lastMergeTime    int64         // 最近一次 merge 完成的时间（UnixNano）
+	lastAutoMergeErr atomic.Value  // 最近一次自动 merge 失败的原因
+	mergeFidShift    uint32        // merge 预留文件 ID 的余量翻倍的次数，预留不足导致 merge 失败时加一，只在 merge 中访问
+
+	autoSyncStopCh chan struct{} // 通知后台定期持久化协程退出
+	autoSyncDoneCh chan struct{} // 后台定期持久化协程已经退出
 }
 
 type Stat struct {
@@ -41,6 +80,18 @@ type Stat struct {
 	DataFileNum     uint   `json:"dataFileNum"`     // 数据文件的数量
 	ReclaimableSize uint64 `json:"reclaimableSize"` // 可以进行 merge 回收的数据量，以字节为单位
 	DiskSize        int64  `json:"diskSize"`        // 数据目录所占磁盘空间的大小
+
+	MergeCount         uint64 `json:"mergeCount"`         // 完成的 merge 次数
+	AutoMergeCount     uint64 `json:"autoMergeCount"`     // 其中由后台自动触发的 merge 次数
+	LastMergeTime      int64  `json:"lastMergeTime"`      // 最近一次 merge 完成的时间（UnixNano），0 表示还没有 merge 过
+	LastAutoMergeError string `json:"lastAutoMergeError"` // 最近一次自动 merge 失败的原因
+
+	CacheHits   uint64 `json:"cacheHits"`   // 读缓存的命中次数
+	CacheMisses uint64 `json:"cacheMisses"` // 读缓存的未命中次数
+
+	WriteSyncs uint64 `json:"writeSyncs"` // 写入时持久化数据文件的次数，组提交的一组写入只计一次
+
+	ActiveReaders int `json:"activeReaders"` // 还没有释放的迭代器、快照、事务和大对象读取器的数量，它们会阻止旧版本和被淘汰的数据文件被清理
 }
 
 // Open 打开存储引擎实例
@@ -49,6 +100,11 @@ func Open(options Options) (*DB, error) {
 	if err := checkOptions(&options); err != nil {
 		return nil, err
 	}
+	// 初始化加密记录的 Cipher
+	recordCipher, err := newRecordCipher(options)
+	if err != nil {
+		return nil, err
+	}
 	// 判断数据目录是否存在，如果不存在则创建这个目录
 	if _, err := os.Stat(options.DataDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(options.DataDir, os.ModePerm); err != nil {
@@ -77,15 +133,35 @@ func Open(options Options) (*DB, error) {
 	idx := index.NewIndexer(index.TypeEnum(options.IndexType), options.BPlusTreeIndexOpts)
 	// 初始化数据库实例
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      idx,
-		nextBTSN:   1,
-		isPureBoot: isPureBoot,
-		fileLock:   fileLock,
-		bytesWrite: 0,
-	}
+		options:          options,
+		mu:               new(sync.RWMutex),
+		olderFiles:       make(map[uint32]*data.DataFile),
+		retiredFiles:     make(map[uint32]*data.DataFile),
+		fileLiveSizes:    make(map[uint32]uint64),
+		fileMaxSeqs:      make(map[uint32]uint64),
+		index:            idx,
+		nextBTSN:         0,
+		isPureBoot:       isPureBoot,
+		fileLock:         fileLock,
+		bytesWrite:       0,
+		versions:         newVersionTracker(),
+		mergeOperandKeys: make(map[string]struct{}),
+		families:         make(map[uint32]*ColumnFamily),
+		nextFamilyId:     defaultFamilyId + 1,
+		watchers:         make(map[*watcher]struct{}),
+		watchCloseCh:     make(chan struct{}),
+		cipher:           recordCipher,
+		cache:            newRecordCache(options.CacheSize),
+		noFileHints:      options.IndexType == int8(index.BPlusTreeIndexer), // B+树索引启动时不需要重放数据文件
+		noIndexSnapshot:  options.IndexType == int8(index.BPlusTreeIndexer),
+	}
+	// 加载失败时需要释放已经获取的资源，保证数据目录可以被再次打开
+	opened := false
+	defer func() {
+		if !opened {
+			db.releaseOpenResources()
+		}
+	}()
 	// 在加载数据文件之前，先加载 merge 目录的文件，将 merge 的结果先合并到数据文件目录中
 	if err := db.loadMergeFiles(); err != nil {
 		return nil, err
@@ -95,14 +171,21 @@ func Open(options Options) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// 加载列族信息，之后才能将记录加载到对应列族的索引中
+	if err := db.loadColumnFamilies(); err != nil {
+		return nil, err
+	}
 
 	if options.IndexType != int8(index.BPlusTreeIndexer) { // B+树不需要从数据文件加载索引
-		// 先从 Hint 文件中加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, err
+		// 优先从上次关闭时保存的索引快照中加载索引，快照不可用时先从 Hint 文件中加载索引
+		snapshot := db.loadIndexSnapshot(fileIds)
+		if snapshot == nil {
+			if err := db.loadIndexFromHintFile(); err != nil {
+				return nil, err
+			}
 		}
 		// 从数据文件中加载索引
-		if err := db.loadIndexFromDataFiles(fileIds); err != nil {
+		if err := db.loadIndexFromDataFiles(fileIds, snapshot); err != nil {
 			return nil, err
 		}
 		// 如果采用 mmap 加载数据文件，那么需要在完成加载后将所加载的文件变为 StandardIO
@@ -116,25 +199,66 @@ func Open(options Options) (*DB, error) {
 		if err := db.loadNextBSTN(); err != nil {
 			return nil, err
 		}
-		// 恢复 activeFile 的 WriteOffset
-		if db.activeFile != nil {
-			if sz, err := db.activeFile.IoManger.Size(); err != nil {
-				return nil, err
-			} else {
-				db.activeFile.WriteOffset = sz
-			}
-
+		// 从持久化的索引中统计每个数据文件的有效数据量
+		db.loadFileLiveSizes()
+		// 恢复 activeFile 的 WriteOffset，并处理末尾没有写完的记录
+		if err := db.recoverActiveFile(); err != nil {
+			return nil, err
 		}
 	}
+	// 清理没有被引用的大对象文件
+	if err := db.loadBlobs(); err != nil {
+		return nil, err
+	}
+	// 启动后台自动 merge 和定期持久化
+	db.startAutoMerge()
+	db.startAutoSync()
 
+	opened = true
 	return db, nil
 }
 
+// 释放打开数据库过程中获取的文件、索引和文件锁
+func (db *DB) releaseOpenResources() {
+	for _, dataFile := range db.olderFiles {
+		_ = dataFile.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	_ = db.index.Close()
+	for _, cf := range db.families {
+		_ = cf.index.Close()
+	}
+	_ = db.fileLock.Unlock()
+}
+
 // Put 写入 key-value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutWithTTL(key, value, 0)
+}
+
+// PutOpt 按照指定的写入配置写入 key-value 数据，返回这次写入的序列号
+func (db *DB) PutOpt(key []byte, value []byte, opts WriteOptions) (uint64, error) {
+	return db.put(key, value, 0, opts)
+}
+
+// PutWithTTL 写入 key-value 数据，并为其设置过期时间，ttl 为 0 表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	_, err := db.put(key, value, ttl, db.defaultWriteOptions())
+	return err
+}
+
+func (db *DB) put(key []byte, value []byte, ttl time.Duration, opts WriteOptions) (uint64, error) {
 	// 判断 key 是否为空
 	if len(key) == 0 {
-		return ErrorKeyEmpty
+		return 0, ErrorKeyEmpty
+	}
+	if ttl < 0 {
+		return 0, ErrorInvalidTTL
+	}
+	if err := db.checkWriteOptions(opts); err != nil {
+		return 0, err
 	}
 	// 构造 LogRecord 结构体
 	record := &data.LogRecord{
@@ -143,30 +267,45 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Type:  data.LogRecordNormal,
 		Btsn:  data.NoTxnBTSN,
 	}
-	// 将 LogRecord 写入到数据文件中
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	pos, err := db.appendLogRecord(record)
-	if err != nil {
-		return err
+	if ttl > 0 {
+		record.Expire = time.Now().Add(ttl).UnixNano()
 	}
-	// 将 LogRecordPos 更新到内存索引中
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.increaseReclaimSize(oldPos.Sz)
+	err := db.write(opts.Sync, func() error {
+		// 将 LogRecord 写入到数据文件中
+		record.Seq = db.FetchNextBTSN()
+		pos, err := db.appendLogRecord(record)
+		if err != nil {
+			return err
+		}
+		db.notifyWatchers(record)
+		// 将 LogRecordPos 更新到内存索引中
+		if opts.DisableIndexUpdate {
+			db.unindexedWrites = true
+			return nil
+		}
+		db.updateIndex(record, pos, record.Seq)
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-
-	return nil
+	return record.Seq, nil
 }
 
 // Delete 根据 key 删除对应的数据
 func (db *DB) Delete(key []byte) error {
+	_, err := db.DeleteOpt(key, db.defaultWriteOptions())
+	return err
+}
+
+// DeleteOpt 按照指定的写入配置删除 key 对应的数据，返回这次删除的序列号
+func (db *DB) DeleteOpt(key []byte, opts WriteOptions) (uint64, error) {
 	// 判断 key 的有效性
 	if len(key) == 0 {
-		return ErrorKeyEmpty
+		return 0, ErrorKeyEmpty
 	}
-	// 检查 key 是否存在，不存在则直接返回
-	if pos := db.index.Get(key); pos == nil {
-		return ErrorKeyNotFound
+	if err := db.checkWriteOptions(opts); err != nil {
+		return 0, err
 	}
 	// 构造 LogRecord 结构体
 	record := &data.LogRecord{
@@ -174,52 +313,126 @@ func (db *DB) Delete(key []byte) error {
 		Type: data.LogRecordDelete,
 		Btsn: data.NoTxnBTSN,
 	}
-	// 将 LogRecord 写入到数据文件中
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	_, err := db.appendLogRecord(record)
+	err := db.write(opts.Sync, func() error {
+		// 检查 key 是否存在，不存在则直接返回
+		if pos := db.index.Get(key); pos == nil || pos.IsExpired() {
+			return ErrorKeyNotFound
+		}
+		// 将 LogRecord 写入到数据文件中
+		record.Seq = db.FetchNextBTSN()
+		pos, err := db.appendLogRecord(record)
+		if err != nil {
+			return err
+		}
+		db.notifyWatchers(record)
+		// 将 key 从内存索引中删除
+		if opts.DisableIndexUpdate {
+			db.unindexedWrites = true
+			return nil
+		}
+		if ok := db.updateIndex(record, pos, record.Seq); !ok {
+			return ErrorIndexUpdateFailed
+		}
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-	// 将 key 从内存索引中删除
-	oldPos, ok := db.index.Delete(key)
-	if !ok {
-		return ErrorIndexUpdateFailed
+		return 0, err
 	}
-	if oldPos != nil {
-		db.increaseReclaimSize(oldPos.Sz)
+	return record.Seq, nil
+}
+
+// 检查写入配置
+// B+ 树索引在启动时不会重放数据文件，跳过索引更新的写入将永远不可见
+func (db *DB) checkWriteOptions(opts WriteOptions) error {
+	if opts.DisableIndexUpdate && db.options.IndexType == int8(index.BPlusTreeIndexer) {
+		return ErrorIndexUpdateRequired
 	}
 	return nil
 }
 
+// 不指定写入配置时，按照数据库的配置决定是否需要持久化
+func (db *DB) defaultWriteOptions() WriteOptions {
+	return WriteOptions{Sync: db.options.SyncEveryWrite}
+}
+
 func (db *DB) Get(key []byte) ([]byte, error) {
 	// 判断 key 的有效性
 	if len(key) == 0 {
 		return nil, ErrorKeyEmpty
 	}
 
+	// merge 可能会在线替换数据文件，因此需要在读锁的保护下获取位置并读取
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	// 从内存索引中获取 LogRecordPos
 	pos := db.index.Get(key)
-	if pos == nil {
+	if pos == nil || pos.IsExpired() {
 		return nil, ErrorKeyNotFound
 	}
 
-	record, err := db.readLogRecord(pos)
-	if err != nil {
-		return nil, err
+	return db.readValue(pos)
+}
+
+// TTL 获取 key 剩余的存活时间，key 没有设置过期时间时返回 0
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrorKeyEmpty
+	}
+	// 与 Get 一样在读锁的保护下获取位置，避免读到写入或 merge 更新到一半的索引
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired() {
+		return 0, ErrorKeyNotFound
+	}
+	if pos.Expire == 0 {
+		return 0, nil
 	}
-	return record.Value, nil
+	return time.Until(time.Unix(0, pos.Expire)), nil
 }
 
-// ListKeys 返回所有的 key
+// Persist 移除 key 的过期时间，使其永不过期
+func (db *DB) Persist(key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	return db.write(db.options.SyncEveryWrite, func() error {
+		pos := db.index.Get(key)
+		if pos == nil || pos.IsExpired() {
+			return ErrorKeyNotFound
+		}
+		// 本身就没有过期时间，则无需处理
+		if pos.Expire == 0 {
+			return nil
+		}
+		// 大对象只需要重新写入指向它的记录，不需要读出内容
+		if pos.Blob > 0 {
+			ref, err := db.readBlobRef(pos)
+			if err != nil {
+				return err
+			}
+			return db.appendAndIndex(&data.LogRecord{Key: key, Value: data.EncodeBlobRef(ref), Type: data.LogRecordBlob})
+		}
+		// 读出原来的 value，去掉过期时间后重新写入
+		value, err := db.readValue(pos)
+		if err != nil {
+			return err
+		}
+		return db.appendAndIndex(&data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal})
+	})
+}
+
+// ListKeys 返回所有的 key（已过期的 key 不会返回）
 func (db *DB) ListKeys() [][]byte {
 	iter := db.index.Iterator(false)
 	defer iter.Close()
-	keys := make([][]byte, db.index.Size())
-	idx := 0
+	keys := make([][]byte, 0, db.index.Size())
 	for iter.Rewind(); iter.Valid(); iter.Next() {
-		keys[idx] = iter.Key()
-		idx++
+		if iter.Value().IsExpired() {
+			continue
+		}
+		keys = append(keys, iter.Key())
 	}
 	return keys
 }
@@ -233,11 +446,14 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		pos := iter.Value()
-		record, err := db.readLogRecord(pos)
+		if pos.IsExpired() {
+			continue
+		}
+		value, err := db.readValue(pos)
 		if err != nil {
 			return err
 		}
-		if !fn(record.Key, record.Value) {
+		if !fn(iter.Key(), value) {
 			break
 		}
 	}
@@ -246,9 +462,25 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // Close 关闭存储引擎实例
 func (db *DB) Close() error {
+	// 重复关闭时直接返回
+	if !atomic.CompareAndSwapInt32(&db.closing, 0, 1) {
+		return nil
+	}
+	// 先停止后台的 merge 和定期持久化，它们需要获取 db.mu
+	db.stopAutoMerge()
+	db.stopAutoSync()
+	close(db.watchCloseCh)
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// 持久化之后才能删除已经失效的大对象文件
+	if len(db.deadBlobs) > 0 && db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+		db.removeDeadBlobs()
+	}
 	// 保存当前事务的序列号
 	btsnFile, err := data.OpenBtsnFile(db.options.DataDir)
 	if err != nil {
@@ -266,6 +498,8 @@ func (db *DB) Close() error {
 	if err != nil {
 		return err
 	}
+	// 保存内存索引的快照，快照只用于加快下次启动，保存失败时下次启动会完整地重放数据文件
+	_ = db.saveIndexSnapshot()
 	// 关闭所有的数据文件
 	for _, dataFile := range db.olderFiles {
 		if err := dataFile.Close(); err != nil {
@@ -277,10 +511,21 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
+	// 已经被淘汰的数据文件可以直接删除
+	retiredFiles := make([]*data.DataFile, 0, len(db.retiredFiles))
+	for _, dataFile := range db.retiredFiles {
+		retiredFiles = append(retiredFiles, dataFile)
+	}
+	db.removeRetiredFiles(retiredFiles)
 	// 关闭 index
 	if err = db.index.Close(); err != nil {
 		return err
 	}
+	for _, cf := range db.families {
+		if err = cf.index.Close(); err != nil {
+			return err
+		}
+	}
 	// 关闭 fileLock
 	if err = db.fileLock.Unlock(); err != nil {
 		panic(fmt.Sprintf("failed to unlock the directory, %v", err))
@@ -290,12 +535,16 @@ func (db *DB) Close() error {
 
 // Sync 将数据持久化到磁盘中
 func (db *DB) Sync() error {
-	if db.activeFile != nil {
+	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.activeFile.Sync()
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	db.removeDeadBlobs()
+	return nil
 }
 
 // Stat 计算数据库统计信息
@@ -312,11 +561,21 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get the size of the directory, %v", err))
 	}
+	lastAutoMergeErr, _ := db.lastAutoMergeErr.Load().(string)
+	cacheHits, cacheMisses := db.cache.stats()
 	return &Stat{
-		KeyNum:          uint(db.index.Size()),
-		DataFileNum:     dataFileNum,
-		ReclaimableSize: db.reclaimSize,
-		DiskSize:        dirSize,
+		KeyNum:             uint(db.index.Size()),
+		DataFileNum:        dataFileNum,
+		ReclaimableSize:    db.reclaimSize,
+		DiskSize:           dirSize,
+		MergeCount:         atomic.LoadUint64(&db.mergeCount),
+		AutoMergeCount:     atomic.LoadUint64(&db.autoMergeCount),
+		LastMergeTime:      atomic.LoadInt64(&db.lastMergeTime),
+		LastAutoMergeError: lastAutoMergeErr,
+		CacheHits:          cacheHits,
+		CacheMisses:        cacheMisses,
+		WriteSyncs:         atomic.LoadUint64(&db.writeSyncs),
+		ActiveReaders:      db.versions.activeReaders(),
 	}
 }
 
@@ -337,20 +596,30 @@ func (db *DB) FetchNextBTSN() uint64 {
 // readLogRecord 根据 LogRecordPos 读取 LogRecord
 func (db *DB) readLogRecord(pos *data.LogRecordPos) (*data.LogRecord, error) {
 	var dataFile *data.DataFile
+	retired := false
 	if db.activeFile.FileId == pos.Fid {
 		dataFile = db.activeFile
+	} else if olderFile, ok := db.olderFiles[pos.Fid]; ok {
+		dataFile = olderFile
 	} else {
-		dataFile = db.olderFiles[pos.Fid]
+		dataFile, retired = db.retiredFiles[pos.Fid], true
 	}
 	// 如果数据文件不存在，则直接返回错误
 	if dataFile == nil {
 		return nil, ErrorDataFileNotFound
 	}
+	if record := db.cache.get(pos); record != nil {
+		return record, nil
+	}
 	// 根据 offset 读取数据
 	record, _, err := dataFile.ReadLogRecord(pos.Offset)
 	if err != nil {
 		return nil, err
 	}
+	// 已经被 merge 淘汰的文件只会被快照读取，不需要缓存
+	if !retired {
+		db.cache.put(pos, record)
+	}
 	return record, nil
 }
 
@@ -364,7 +633,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 
 	// 对 LogRecord 进行序列化
-	encoded, length := data.EncodeLogRecord(logRecord)
+	encoded, length := data.EncodeEncryptedLogRecord(logRecord, db.options.Compression, db.options.CompressionThreshold, db.cipher)
 	// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
 	if db.activeFile.WriteOffset+length > db.options.MaxFileSize {
 		// 先持久化数据文件，保证已有的数据持久化到磁盘中
@@ -372,7 +641,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 			return nil, err
 		}
 		// 将当前的活跃文件加入到旧文件中
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		db.sealActiveFile()
 		// 打开一个新的数据文件
 		if err := db.setActiveFile(); err != nil {
 			return nil, err
@@ -386,23 +655,72 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	}
 	db.bytesWrite += uint64(length)
 
-	// 根据用户配置的持久化策略，将 LogRecordPos 持久化到磁盘中
+	// 根据用户配置的持久化策略，将 LogRecordPos 持久化到磁盘中，组提交中的写入由组提交统一持久化
 	needSync := db.options.SyncEveryWrite || db.bytesWrite > db.options.BytesPerSync
-	if needSync {
+	if needSync && !db.groupCommitting {
 		db.bytesWrite = 0 // 清空累计值
 		if err := db.activeFile.Sync(); err != nil {
 			return nil, err
 		}
+		atomic.AddUint64(&db.writeSyncs, 1)
 	}
 	// 返回 LogRecordPos
 	pos := &data.LogRecordPos{
 		Fid:    db.activeFile.FileId,
 		Offset: writeOffset,
 		Sz:     uint64(length),
+		Expire: logRecord.Expire,
+	}
+	if logRecord.Type == data.LogRecordBlob {
+		if ref, ok := data.DecodeBlobRef(logRecord.Value); ok {
+			pos.Blob = ref.Id
+		}
 	}
+	db.appendFileHint(logRecord, pos)
+	db.trackFileSeq(pos.Fid, logRecord.Sequence())
 	return pos, nil
 }
 
+// 将一条已经写入数据文件的 LogRecord 应用到内存索引中，commitTs 为这次写入的序列号
+// 被覆盖的旧位置会计入可回收的空间，并为活跃的事务保留下来
+// 访问这个方法前必须加锁
+func (db *DB) updateIndex(record *data.LogRecord, pos *data.LogRecordPos, commitTs uint64) bool {
+	idx := db.familyIndex(record.Family)
+	if idx == nil {
+		return false
+	}
+	if record.Type == data.LogRecordRangeDelete {
+		db.deleteIndexRange(idx, record, commitTs)
+		return true
+	}
+	var oldPos *data.LogRecordPos
+	var ok = true
+	if record.Type == data.LogRecordDelete {
+		oldPos, ok = idx.Delete(record.Key)
+	} else {
+		oldPos = idx.Put(record.Key, pos)
+	}
+	if record.Type != data.LogRecordDelete {
+		db.markLive(pos)
+	}
+	// 合并操作数不会使旧的记录失效，它仍然是操作数链上的一环
+	if record.Type != data.LogRecordMergeOperand {
+		// 新的记录沿用了旧记录的大对象文件（例如 Persist），失效的只有旧记录本身
+		dead := oldPos
+		if oldPos != nil && oldPos.Blob > 0 && oldPos.Blob == pos.Blob {
+			stale := *oldPos
+			stale.Blob = 0
+			dead = &stale
+		}
+		db.markDead(dead)
+	}
+	// 事务和快照只作用于默认列族
+	if record.Family == defaultFamilyId {
+		db.versions.record(record.Key, commitTs, oldPos)
+	}
+	return ok
+}
+
 // 设置当前的活跃文件
 // 访问这个方法前必须加锁
 func (db *DB) setActiveFile() error {
@@ -410,11 +728,17 @@ func (db *DB) setActiveFile() error {
 	if db.activeFile != nil {
 		initialFid = db.activeFile.FileId + 1
 	}
-	// 打开一个新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DataDir, initialFid, fio.StandardFIO)
+	return db.openActiveFile(initialFid)
+}
+
+// 打开一个指定 ID 的新数据文件作为活跃文件
+// 访问这个方法前必须加锁
+func (db *DB) openActiveFile(fileId uint32) error {
+	dataFile, err := data.OpenDataFile(db.options.DataDir, fileId, fio.StandardFIO)
 	if err != nil {
 		return err
 	}
+	dataFile.Cipher = db.cipher
 	db.activeFile = dataFile
 	return nil
 }
@@ -453,6 +777,7 @@ func (db *DB) loadDataFiles() (fileIds []uint32, err error) {
 		if err != nil {
 			return fileIds, err
 		}
+		dataFile.Cipher = db.cipher
 		if i == len(fileIds)-1 {
 			db.activeFile = dataFile
 		} else {
@@ -470,75 +795,207 @@ type dbOpenLoadingContext struct {
 }
 
 // 从数据文件中加载索引
-// 遍历所有的数据文件，将 LogRecordPos 加载到内存索引中
-func (db *DB) loadIndexFromDataFiles(fileIds []uint32) error {
+// 多个数据文件并行解码，之后按照文件 ID 的顺序依次应用到索引中，保证覆盖写入和 batch 的语义与顺序重放一致
+// snapshot 不为空时说明索引已经从快照中加载，只需要重放快照之后写入的记录
+func (db *DB) loadIndexFromDataFiles(fileIds []uint32, snapshot *indexSnapshot) error {
 	// 如果没有数据文件，则直接返回
 	if len(fileIds) == 0 {
 		return nil
 	}
-	// 先查看是否发生过 merge
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinFileName := filepath.Join(db.options.DataDir, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
-		hasMerge = true
-		nonMergeFileId, err = db.getNonMergeFileId(db.options.DataDir)
-		if err != nil {
-			return err
-		}
-	}
 	loadContext := dbOpenLoadingContext{
 		batchTxns: make(map[uint64][]data.BatchTxnRecord),
 		maxBtsn:   0,
 	}
-	// 遍历所有的数据文件
-	for _, fid := range fileIds {
-		// 首先与 nonMergeFileId 进行比较，如果当前文件 ID 小于 nonMergeFileId，则直接跳过，因为已经通过 Hint 文件加载过了
-		if hasMerge && fid < nonMergeFileId {
-			continue
+	// 找出需要重放的数据文件
+	var replayFiles []replayFile
+	if snapshot != nil {
+		loadContext.maxBtsn = snapshot.nextBTSN
+		for _, fid := range fileIds {
+			if fid == snapshot.activeFid {
+				replayFiles = append(replayFiles, replayFile{dataFile: db.dataFileById(fid), offset: snapshot.writeOffset})
+			} else if fid > snapshot.activeFid {
+				replayFiles = append(replayFiles, replayFile{dataFile: db.dataFileById(fid)})
+			}
 		}
-		var dataFile *data.DataFile
-		// fid -> dataFile
-		if fid == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fid]
+	} else {
+		// 先查看是否发生过 merge
+		hasMerge, nonMergeFileId := false, uint32(0)
+		mergeFinFileName := filepath.Join(db.options.DataDir, data.MergeFinishedFileName)
+		if _, err := os.Stat(mergeFinFileName); err == nil {
+			info, err := readMergeFinishedFile(db.options.DataDir)
+			if err != nil {
+				return err
+			}
+			hasMerge, nonMergeFileId = true, info.nonMergeFid
+			loadContext.maxBtsn = info.maxSeq
 		}
-		// load index from one data file
-		offset, err := db.loadIndexFromOneDataFile(dataFile, &loadContext)
-		if err != nil {
+		for _, fid := range fileIds {
+			// 首先与 nonMergeFileId 进行比较，如果当前文件 ID 小于 nonMergeFileId，则直接跳过，因为已经通过 Hint 文件加载过了
+			if hasMerge && fid < nonMergeFileId {
+				// 这些文件都是在 merge 开始之前写入的，其中记录的序列号都不会超过 merge 开始时的序列号
+				db.trackFileSeq(fid, loadContext.maxBtsn)
+				// 这些文件不会被重放，它们的无效数据量由文件大小减去 Hint 文件中记录的有效数据量得到
+				if dataFile, ok := db.olderFiles[fid]; ok {
+					if size, err := dataFile.IoManger.Size(); err == nil && uint64(size) > db.fileLiveSizes[fid] {
+						db.increaseReclaimSize(uint64(size) - db.fileLiveSizes[fid])
+					}
+				}
+				continue
+			}
+			replayFiles = append(replayFiles, replayFile{dataFile: db.dataFileById(fid)})
+		}
+	}
+	err := db.decodeDataFiles(replayFiles, func(dataFile *data.DataFile, records []loadedRecord, offset int64) error {
+		if err := db.applyLoadedRecords(records, &loadContext); err != nil {
 			return err
 		}
-		// 如果当前是活跃文件，则更新 WriteOffset
-		if fid == db.activeFile.FileId {
+		// 如果当前是活跃文件，则更新 WriteOffset，并保留它的 hint 记录，在它写满之后写入 hint 文件
+		if dataFile == db.activeFile {
 			db.activeFile.WriteOffset = offset
+			db.activeHints = append(db.activeHints, db.encodeFileHints(records)...)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 	// 更新 db 的 btsn
-	db.nextBTSN = loadContext.maxBtsn + 1
+	db.nextBTSN = loadContext.maxBtsn
 	return nil
 }
 
-func (db *DB) loadIndexFromOneDataFile(dataFile *data.DataFile, loadContext *dbOpenLoadingContext) (int64, error) {
-	var offset int64 = 0
+// 根据文件 ID 获取数据文件
+// 访问这个方法前必须加锁
+func (db *DB) dataFileById(fid uint32) *data.DataFile {
+	if db.activeFile != nil && fid == db.activeFile.FileId {
+		return db.activeFile
+	}
+	return db.olderFiles[fid]
+}
+
+// 启动时需要重放的数据文件，offset 为开始重放的位置
+type replayFile struct {
+	dataFile *data.DataFile
+	offset   int64
+}
+
+// 启动时从数据文件中解码出来的一条记录
+type loadedRecord struct {
+	record *data.LogRecord
+	pos    data.LogRecordPos
+}
+
+// 解码后的数据文件，offset 为最后一条完整记录的结束位置
+type decodedDataFile struct {
+	records []loadedRecord
+	offset  int64
+	err     error
+}
+
+// 使用多个协程并行解码数据文件，并按照 files 的顺序依次调用 apply
+// 为了限制内存占用，已经解码但还没有被 apply 的文件最多只有 GOMAXPROCS 个
+func (db *DB) decodeDataFiles(files []replayFile, apply func(dataFile *data.DataFile, records []loadedRecord, offset int64) error) error {
+	results := make([]chan *decodedDataFile, len(files))
+	for i := range results {
+		results[i] = make(chan *decodedDataFile, 1)
+	}
+	window := make(chan struct{}, runtime.GOMAXPROCS(0))
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, file := range files {
+			select {
+			case window <- struct{}{}:
+			case <-stopCh:
+				return
+			}
+			wg.Add(1)
+			go func(i int, file replayFile) {
+				defer wg.Done()
+				records, offset, err := db.decodeDataFile(file.dataFile, file.offset)
+				results[i] <- &decodedDataFile{records: records, offset: offset, err: err}
+			}(i, file)
+		}
+	}()
+	// 返回之前等待所有的协程退出，之后才能安全地关闭数据文件
+	defer wg.Wait()
+	defer close(stopCh)
+	for i, file := range files {
+		result := <-results[i]
+		<-window
+		if result.err != nil {
+			return result.err
+		}
+		if err := apply(file.dataFile, result.records, result.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解码一个数据文件中从 start 开始的所有记录，活跃文件末尾没有写完的记录会被截断
+// 旧文件优先从它的 hint 文件中解码，hint 文件不存在或者损坏时才扫描数据文件，并重新生成 hint 文件
+// 只保留应用到索引时需要用到的 value，普通记录和删除记录的 value 会被丢弃以减少内存占用
+func (db *DB) decodeDataFile(dataFile *data.DataFile, start int64) ([]loadedRecord, int64, error) {
+	isActive := dataFile == db.activeFile
+	if !isActive {
+		if records, offset, ok := db.decodeFileHint(dataFile); ok {
+			for len(records) > 0 && records[0].pos.Offset < start {
+				records = records[1:]
+			}
+			return records, offset, nil
+		}
+	}
+	var records []loadedRecord
+	var offset = start
 	for {
 		record, length, err := dataFile.ReadLogRecord(offset)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return offset, err
+			// 活跃文件末尾可能残留着崩溃时没有写完的记录
+			if isActive && db.isTornTail(dataFile, offset, err) {
+				if err := db.truncateTornTail(dataFile, offset, err); err != nil {
+					return nil, offset, err
+				}
+				break
+			}
+			return nil, offset, err
+		}
+		if record.Type == data.LogRecordNormal || record.Type == data.LogRecordDelete {
+			record.Value = nil
 		}
-		// 先更新 BTSN
+		records = append(records, loadedRecord{
+			record: record,
+			pos:    data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Sz: uint64(length), Expire: record.Expire},
+		})
+		// 移动 offset
+		offset += length
+	}
+	if !isActive && start == 0 {
+		db.writeFileHint(dataFile.FileId, db.encodeFileHints(records))
+	}
+	return records, offset, nil
+}
+
+// 按照顺序将解码出来的记录应用到索引中
+func (db *DB) applyLoadedRecords(records []loadedRecord, loadContext *dbOpenLoadingContext) error {
+	for i := range records {
+		record, pos := records[i].record, &records[i].pos
+		// 先更新 BTSN，非 batch 写入的序列号也来自同一个序列
 		btsn := record.Btsn
-		if btsn > loadContext.maxBtsn {
-			loadContext.maxBtsn = btsn
+		if seq := record.Sequence(); seq > loadContext.maxBtsn {
+			loadContext.maxBtsn = seq
 		}
+		db.trackFileSeq(pos.Fid, record.Sequence())
 
 		if record.Btsn == data.NoTxnBTSN { // 对于非 batch txn 操作，则直接更新索引
-			pos := data.LogRecordPos{Fid: dataFile.FileId, Offset: offset}
-			ok := db.redoLogRecord(record, &pos)
+			ok := db.redoLogRecord(record, pos)
 			if !ok {
-				return offset, ErrorIndexUpdateFailed
+				return ErrorIndexUpdateFailed
 			}
 		} else { // 对于 batch txn 操作，则根据是否为 End 来决定 redo 还是暂存
 			batchTxns := loadContext.batchTxns
@@ -549,30 +1006,107 @@ func (db *DB) loadIndexFromOneDataFile(dataFile *data.DataFile, loadContext *dbO
 				}
 				delete(batchTxns, btsn)
 			} else {
-				batchTxns[btsn] = append(batchTxns[btsn], data.BatchTxnRecord{
-					Record: record,
-					Pos:    &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset},
-				})
+				batchTxns[btsn] = append(batchTxns[btsn], data.BatchTxnRecord{Record: record, Pos: pos})
 			}
 		}
-		// 移动 offset
+	}
+	return nil
+}
+
+// 判断读取 offset 处的记录时遇到的错误是否是由文件末尾没有写完的记录导致的
+// 只有损坏的区域之后再也没有完整的记录时才认为是写入中断，文件中间的损坏需要通过修复工具来处理
+func (db *DB) isTornTail(dataFile *data.DataFile, offset int64, err error) bool {
+	if err != data.ErrorInvalidCRC && err != data.ErrorIncompleteRecord {
+		return false
+	}
+	fileSize, sizeErr := dataFile.IoManger.Size()
+	if sizeErr != nil {
+		return false
+	}
+	next, findErr := findNextRecord(dataFile, offset+1)
+	return findErr == nil && next >= fileSize
+}
+
+// 将活跃文件截断到最后一条完整的记录，严格模式下则直接返回错误
+func (db *DB) truncateTornTail(dataFile *data.DataFile, offset int64, cause error) error {
+	if db.options.StrictRecovery {
+		return cause
+	}
+	fileSize, err := dataFile.IoManger.Size()
+	if err != nil {
+		return err
+	}
+	log.Printf("fairy-kvdb: truncate torn tail of data file %d at offset %d, %d bytes discarded: %v",
+		dataFile.FileId, offset, fileSize-offset, cause)
+	return dataFile.Truncate(db.options.DataDir, offset)
+}
+
+// 找到活跃文件中最后一条完整记录的结束位置，用于启动时不会重放数据文件的索引类型
+func (db *DB) recoverActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	var offset int64 = 0
+	for {
+		_, length, err := db.activeFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if db.isTornTail(db.activeFile, offset, err) {
+				return db.truncateTornTail(db.activeFile, offset, err)
+			}
+			return err
+		}
 		offset += length
 	}
-	return offset, nil
+	db.activeFile.WriteOffset = offset
+	return nil
 }
 
 func (db *DB) redoLogRecord(record *data.LogRecord, pos *data.LogRecordPos) bool {
-	if record.Type == data.LogRecordNormal {
-		oldPos := db.index.Put(record.Key, pos)
-		if oldPos != nil {
-			db.increaseReclaimSize(oldPos.Sz)
+	// 已经被删除的列族中的记录都是无效数据
+	idx := db.familyIndex(record.Family)
+	if idx == nil {
+		db.increaseReclaimSize(pos.Sz)
+		return true
+	}
+	// 已经过期的数据等同于被删除，它本身也是可以被回收的无效数据
+	if (record.Type == data.LogRecordNormal || record.Type == data.LogRecordMergeOperand) && record.IsExpired() {
+		oldPos, _ := idx.Delete(record.Key)
+		db.markDead(oldPos)
+		db.increaseReclaimSize(pos.Sz)
+		return true
+	}
+	if record.Type == data.LogRecordNormal || record.Type == data.LogRecordBlob {
+		if record.Type == data.LogRecordBlob {
+			ref, ok := data.DecodeBlobRef(record.Value)
+			if !ok {
+				return false
+			}
+			pos.Blob = ref.Id
 		}
+		oldPos := idx.Put(record.Key, pos)
+		db.markLive(pos)
+		db.markDead(oldPos)
 		return true
-	} else if record.Type == data.LogRecordDelete {
-		oldPos, _ := db.index.Delete(record.Key)
-		if oldPos != nil {
-			db.increaseReclaimSize(oldPos.Sz)
+	} else if record.Type == data.LogRecordMergeOperand {
+		// 操作数链的长度根据链上前一条记录推算，前一条记录已经不存在时从头开始计数
+		pos.Chain = 1
+		if prev, _, ok := data.DecodeMergeOperand(record.Value); ok && prev != nil {
+			if oldPos := idx.Get(record.Key); oldPos != nil {
+				pos.Chain = oldPos.Chain + 1
+			}
 		}
+		idx.Put(record.Key, pos)
+		db.markLive(pos)
+		return true
+	} else if record.Type == data.LogRecordDelete {
+		oldPos, _ := idx.Delete(record.Key)
+		db.markDead(oldPos)
+		return true
+	} else if record.Type == data.LogRecordRangeDelete {
+		db.deleteIndexRange(idx, record, record.Sequence())
 		return true
 	}
 	return false
@@ -589,9 +1123,34 @@ func checkOptions(options *Options) error {
 	if options.MergeRatio < 0 || options.MergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.AutoMergeInterval < 0 {
+		return errors.New("invalid auto merge interval")
+	}
+	if options.SyncInterval < 0 {
+		return errors.New("invalid sync interval")
+	}
+	if options.Compression > data.CompressionLZ {
+		return errors.New("unknown compression type")
+	}
+	if len(options.EncryptionKey) > 0 && options.IndexType == int8(index.BPlusTreeIndexer) {
+		return errors.New("encryption is not supported with the B+ tree index, it stores keys in plaintext")
+	}
+	for _, window := range options.AutoMergeWindows {
+		if window.Start < 0 || window.Start > 24*time.Hour || window.End < 0 || window.End > 24*time.Hour {
+			return errors.New("invalid auto merge window, must within one day")
+		}
+	}
 	return nil
 }
 
+// 根据配置项中的加密密钥创建 Cipher，没有设置密钥时返回 nil
+func newRecordCipher(options Options) (*data.Cipher, error) {
+	if len(options.EncryptionKey) == 0 {
+		return nil, nil
+	}
+	return data.NewCipher(options.EncryptionKey)
+}
+
 // 从 BTSN file 中加载 NextBTSN 值
 func (db *DB) loadNextBSTN() error {
 	path := filepath.Join(db.options.DataDir, data.BtsnFileName)
@@ -637,3 +1196,89 @@ func (db *DB) resetIOType() error {
 func (db *DB) increaseReclaimSize(sz uint64) {
 	atomic.AddUint64(&db.reclaimSize, sz)
 }
+
+// 记录 pos 位置上的数据成为了有效数据，用于统计每个数据文件中的有效数据量
+// 访问这个方法前必须加锁
+func (db *DB) markLive(pos *data.LogRecordPos) {
+	if pos == nil {
+		return
+	}
+	db.fileLiveSizes[pos.Fid] += pos.Sz
+}
+
+// 记录数据文件中写入了序列号为 seq 的记录
+// 访问这个方法前必须加锁
+func (db *DB) trackFileSeq(fid uint32, seq uint64) {
+	if seq > db.fileMaxSeqs[fid] {
+		db.fileMaxSeqs[fid] = seq
+	}
+}
+
+// 记录 pos 位置上的数据变成了无效数据，它所占据的空间可以被 merge 回收
+// 访问这个方法前必须加锁
+func (db *DB) markDead(pos *data.LogRecordPos) {
+	if pos == nil {
+		return
+	}
+	if live := db.fileLiveSizes[pos.Fid]; live > pos.Sz {
+		db.fileLiveSizes[pos.Fid] = live - pos.Sz
+	} else {
+		delete(db.fileLiveSizes, pos.Fid)
+	}
+	db.increaseReclaimSize(pos.Sz)
+	if pos.Blob > 0 {
+		db.deadBlobs = append(db.deadBlobs, pos.Blob)
+	}
+}
+
+// 从索引中统计每个数据文件中的有效数据量，用于启动时不会重放数据文件的索引类型
+func (db *DB) loadFileLiveSizes() {
+	iter := db.index.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		db.markLive(iter.Value())
+	}
+}
+
+// FileStat 数据文件的统计信息
+type FileStat struct {
+	FileId       uint32  `json:"fileId"`
+	Size         int64   `json:"size"`         // 文件大小
+	LiveSize     uint64  `json:"liveSize"`     // 仍然有效的数据量
+	GarbageRatio float64 `json:"garbageRatio"` // 无效数据所占的比例
+}
+
+// FileStats 返回每个数据文件的有效数据与无效数据统计，按照文件 ID 升序排列
+func (db *DB) FileStats() []FileStat {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var files []*data.DataFile
+	for _, dataFile := range db.olderFiles {
+		files = append(files, dataFile)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	stats := make([]FileStat, 0, len(files))
+	for _, dataFile := range files {
+		size, err := dataFile.IoManger.Size()
+		if err != nil {
+			continue
+		}
+		stats = append(stats, db.fileStat(dataFile.FileId, size))
+	}
+	return stats
+}
+
+// 访问这个方法前必须加锁
+func (db *DB) fileStat(fileId uint32, size int64) FileStat {
+	live := db.fileLiveSizes[fileId]
+	stat := FileStat{FileId: fileId, Size: size, LiveSize: live}
+	if size > 0 && uint64(size) > live {
+		stat.GarbageRatio = float64(uint64(size)-live) / float64(size)
+	}
+	return stat
+}
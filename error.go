@@ -3,13 +3,33 @@ package fairy_kvdb
 import "errors"
 
 var (
-	ErrorKeyEmpty               = errors.New("key is empty")
-	ErrorIndexUpdateFailed      = errors.New("index update failed")
-	ErrorKeyNotFound            = errors.New("key not found")
-	ErrorDataFileNotFound       = errors.New("data file not found")
-	ErrorDataFileCorrupt        = errors.New("data file corrupt")
-	ErrorExceedMaxWriteBatchNum = errors.New("exceed max write batch num")
-	ErrorMergeIsProgress        = errors.New("merge is in progress, try again later")
-	ErrorDatabaseIsUsing        = errors.New("the database directory is using by another process")
-	ErrorMergeRatioUnreached    = errors.New("merge ratio unreached")
+	ErrorKeyEmpty                = errors.New("key is empty")
+	ErrorIndexUpdateFailed       = errors.New("index update failed")
+	ErrorKeyNotFound             = errors.New("key not found")
+	ErrorDataFileNotFound        = errors.New("data file not found")
+	ErrorDataFileCorrupt         = errors.New("data file corrupt")
+	ErrorExceedMaxWriteBatchNum  = errors.New("exceed max write batch num")
+	ErrorMergeIsProgress         = errors.New("merge is in progress, try again later")
+	ErrorDatabaseIsUsing         = errors.New("the database directory is using by another process")
+	ErrorMergeRatioUnreached     = errors.New("merge ratio unreached")
+	ErrorMergeFileIdExhausted    = errors.New("merge produced more files than the reserved file ids")
+	ErrorDatabaseClosing         = errors.New("the database is closing")
+	ErrorInvalidTTL              = errors.New("ttl must not be negative")
+	ErrorTxnConflict             = errors.New("transaction conflict, the keys it read were modified by others")
+	ErrorTxnReadOnly             = errors.New("transaction is read-only")
+	ErrorTxnFinished             = errors.New("transaction has been committed or rolled back")
+	ErrorSnapshotReleased        = errors.New("snapshot has been released")
+	ErrorValueNotInteger         = errors.New("value is not an integer")
+	ErrorIntegerOverflow         = errors.New("increment or decrement would overflow")
+	ErrorMergeOperatorMissing    = errors.New("merge operator is not configured")
+	ErrorMergeOperandCorrupt     = errors.New("merge operand record is corrupt")
+	ErrorColumnFamilyNameEmpty   = errors.New("column family name is empty")
+	ErrorColumnFamilyExists      = errors.New("column family already exists")
+	ErrorColumnFamilyNotFound    = errors.New("column family not found")
+	ErrorColumnFamilyUnsupported = errors.New("column families only support in-memory indexes")
+	ErrorInvalidRange            = errors.New("range start must be less than range end")
+	ErrorInvalidBlobSize         = errors.New("blob size must not be negative")
+	ErrorBlobCorrupt             = errors.New("blob file is corrupt")
+	ErrorIndexUpdateRequired     = errors.New("the B+ tree index does not replay data files, writes must update the index")
+	ErrorMergeUnindexedWrites    = errors.New("some writes skipped the index update, reopen the database before merging")
 )
@@ -0,0 +1,99 @@
+package fairy_kvdb
+
+import (
+	"fairy-kvdb/data"
+	"io"
+	"os"
+)
+
+// 将活跃文件转为旧文件，并将它的 hint 记录写入 hint 文件，之后启动时不需要再扫描整个数据文件
+// 调用之前活跃文件需要已经持久化，保证 hint 文件中不会出现数据文件中没有的记录
+// 访问这个方法前必须加锁
+func (db *DB) sealActiveFile() {
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	db.writeFileHint(db.activeFile.FileId, db.activeHints)
+	db.activeHints = nil
+}
+
+// 记录活跃文件中新写入的记录对应的 hint 记录
+// 访问这个方法前必须加锁
+func (db *DB) appendFileHint(record *data.LogRecord, pos *data.LogRecordPos) {
+	if db.noFileHints {
+		return
+	}
+	encHint, _ := data.EncodeEncryptedLogRecord(data.EncodeFileHintRecord(record, pos), data.CompressionNone, 0, db.cipher)
+	db.activeHints = append(db.activeHints, encHint...)
+}
+
+// 将启动时解码出来的记录编码为 hint 记录
+func (db *DB) encodeFileHints(records []loadedRecord) []byte {
+	if db.noFileHints {
+		return nil
+	}
+	var hints []byte
+	for i := range records {
+		encHint, _ := data.EncodeEncryptedLogRecord(data.EncodeFileHintRecord(records[i].record, &records[i].pos), data.CompressionNone, 0, db.cipher)
+		hints = append(hints, encHint...)
+	}
+	return hints
+}
+
+// 写入数据文件的 hint 文件
+// hint 文件只用于加快启动，写入失败时不影响数据文件本身，启动时会回退到扫描数据文件
+func (db *DB) writeFileHint(fileId uint32, hints []byte) {
+	if db.noFileHints {
+		return
+	}
+	// 先写临时文件再重命名，hint 文件要么不存在，要么是完整的
+	path := data.GetFileHintPath(db.options.DataDir, fileId)
+	if err := writeFileSync(path+".tmp", hints); err != nil {
+		_ = os.Remove(path + ".tmp")
+		return
+	}
+	_ = os.Rename(path+".tmp", path)
+}
+
+// 从 hint 文件中解码数据文件中的所有记录，返回数据文件的结束位置
+// hint 文件中的记录必须首尾相接地覆盖整个数据文件，否则认为 hint 文件已经失效，返回 false
+func (db *DB) decodeFileHint(dataFile *data.DataFile) ([]loadedRecord, int64, bool) {
+	path := data.GetFileHintPath(db.options.DataDir, dataFile.FileId)
+	if _, err := os.Stat(path); err != nil {
+		return nil, 0, false
+	}
+	fileSize, err := dataFile.IoManger.Size()
+	if err != nil {
+		return nil, 0, false
+	}
+	hintFile, err := data.OpenFileHintFile(db.options.DataDir, dataFile.FileId)
+	if err != nil {
+		return nil, 0, false
+	}
+	defer hintFile.Close()
+	hintFile.Cipher = db.cipher
+
+	var records []loadedRecord
+	var offset, dataOffset int64 = 0, 0
+	for {
+		hint, length, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, false
+		}
+		record, pos, ok := data.DecodeFileHintRecord(hint)
+		if !ok || pos.Fid != dataFile.FileId || pos.Offset != dataOffset {
+			return nil, 0, false
+		}
+		records = append(records, loadedRecord{
+			record: record,
+			pos:    data.LogRecordPos{Fid: pos.Fid, Offset: pos.Offset, Sz: pos.Sz, Expire: record.Expire},
+		})
+		dataOffset += int64(pos.Sz)
+		offset += length
+	}
+	if dataOffset != fileSize {
+		return nil, 0, false
+	}
+	return records, dataOffset, true
+}
@@ -0,0 +1,106 @@
+package fairy_kvdb
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// 组提交：需要 sync 的并发写入请求先排队，由队首的请求作为 leader 依次写入整组请求，
+// 然后只执行一次 sync 就可以确认整组请求，避免每次写入都要单独等待一次 sync
+type commitRequest struct {
+	write  func() error // 在持有 db.mu 时执行，写入数据文件并更新索引
+	err    error
+	events [][]Event // 写入产生的变更事件，整组 sync 成功之后才通知订阅者
+	ready  chan bool // true 表示成为了新的 leader，false 表示已经被其他 leader 处理完成
+}
+
+// 等待组提交的请求队列
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*commitRequest
+	leading bool // 是否已经有 leader 在处理请求
+}
+
+// 在持有 db.mu 的情况下执行一次写入，sync 为 true 时等待写入的数据持久化之后才返回
+func (db *DB) write(sync bool, write func() error) error {
+	if !sync {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return write()
+	}
+	return db.groupCommit(write)
+}
+
+func (db *DB) groupCommit(write func() error) error {
+	req := &commitRequest{write: write, ready: make(chan bool, 1)}
+	queue := &db.commitQueue
+	queue.mu.Lock()
+	queue.pending = append(queue.pending, req)
+	if queue.leading {
+		queue.mu.Unlock()
+		if lead := <-req.ready; !lead {
+			return req.err
+		}
+	} else {
+		queue.leading = true
+		queue.mu.Unlock()
+	}
+	// 成为 leader 之后取出当前排队的所有请求，其中也包含自己
+	queue.mu.Lock()
+	group := queue.pending
+	queue.pending = nil
+	queue.mu.Unlock()
+	db.commitGroup(group)
+	for _, other := range group {
+		if other != req {
+			other.ready <- false
+		}
+	}
+	// 在处理这一组请求期间新到达的请求，由它们当中的第一个成为新的 leader
+	queue.mu.Lock()
+	if len(queue.pending) > 0 {
+		queue.pending[0].ready <- true
+	} else {
+		queue.leading = false
+	}
+	queue.mu.Unlock()
+	return req.err
+}
+
+// 依次执行一组写入请求，然后执行一次 sync
+// 每个请求写入之后立即更新索引，保证组内后面的请求能够看到前面请求的结果，比如事务的冲突检测
+// 订阅者只会收到已经持久化的变更，因此变更事件要等到 sync 成功之后才发送
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	written := false
+	db.groupCommitting = true
+	for _, req := range group {
+		db.heldEvents = &req.events
+		req.err = req.write()
+		db.heldEvents = nil
+		written = written || req.err == nil
+	}
+	db.groupCommitting = false
+	if !written || db.activeFile == nil {
+		return
+	}
+	db.bytesWrite = 0
+	if err := db.activeFile.Sync(); err != nil {
+		for _, req := range group {
+			if req.err == nil {
+				req.err = err
+			}
+		}
+		return
+	}
+	atomic.AddUint64(&db.writeSyncs, 1)
+	db.removeDeadBlobs()
+	for _, req := range group {
+		if req.err == nil {
+			for _, events := range req.events {
+				db.publishEvents(events)
+			}
+		}
+	}
+}
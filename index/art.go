@@ -52,6 +52,37 @@ func (art *AdaptiveRadixTreeIndex) Delete(key []byte) (*data.LogRecordPos, bool)
 	return ov.(*data.LogRecordPos), ok
 }
 
+func (art *AdaptiveRadixTreeIndex) DeleteRange(start, end []byte, fn func(key []byte, pos *data.LogRecordPos)) {
+	// 范围内的 key 都以 start 和 end 的公共前缀开头，只需要遍历这个前缀下的子树
+	prefix := commonPrefix(start, end)
+	var items []*IndexItem
+	art.mu.Lock()
+	collect := func(node gart.Node) bool {
+		// 遍历前缀时也会访问到内部节点，只需要处理叶子节点
+		if node.Kind() != gart.Leaf {
+			return true
+		}
+		key := node.Key()
+		if bytes.Compare(key, start) < 0 || len(end) > 0 && bytes.Compare(key, end) >= 0 {
+			return true
+		}
+		items = append(items, &IndexItem{key: key, pos: node.Value().(*data.LogRecordPos)})
+		return true
+	}
+	if len(prefix) > 0 {
+		art.tree.ForEachPrefix(prefix, collect)
+	} else {
+		art.tree.ForEach(collect)
+	}
+	for _, itm := range items {
+		art.tree.Delete(itm.key)
+	}
+	art.mu.Unlock()
+	for _, itm := range items {
+		fn(itm.key, itm.pos)
+	}
+}
+
 func (art *AdaptiveRadixTreeIndex) Size() int {
 	art.mu.RLock()
 	size := art.tree.Size()
@@ -60,51 +91,66 @@ func (art *AdaptiveRadixTreeIndex) Size() int {
 }
 
 func (art *AdaptiveRadixTreeIndex) Iterator(reverse bool) Iterator {
-	art.mu.RLock()
-	iter := newArtIterator(art.tree, reverse)
-	art.mu.RUnlock()
-	return iter
+	return art.RangeIterator(nil, nil, reverse)
+}
+
+func (art *AdaptiveRadixTreeIndex) RangeIterator(lower, upper []byte, reverse bool) Iterator {
+	return newArtIterator(art, lower, upper, reverse)
 }
 
 func (art *AdaptiveRadixTreeIndex) Close() error {
 	return nil
 }
 
+// 迭代器第一批从树中取出的数据量，之后每批翻倍，直到 artIteratorMaxBatchSize
+const (
+	artIteratorBatchSize    = 64
+	artIteratorMaxBatchSize = 4096
+)
+
 // ArtIterator ART 索引迭代器
+// 正序遍历时每次持有读锁按批从树中取出数据，因此创建的开销与索引中的数据量无关。从头开始遍历时使用树自身的迭代器逐个向后取，
+// 树的结构发生变化或者需要从某个 key 开始时，ART 不支持直接定位，需要按照前缀重新定位（见 artWalk），批次逐渐增大以摊薄定位的开销
+// ART 不支持写时复制，创建之后对索引的写入可能会出现在之后的批次中
+// ART 也不支持逆序遍历，逆序时需要在创建时取出范围内的所有数据，时间和内存开销与范围内的数据量成正比
 type ArtIterator struct {
-	currIndex int
-	reverse   bool
-	values    []*IndexItem
+	art       *AdaptiveRadixTreeIndex
+	reverse   bool          // 是否是逆序遍历
+	lower     []byte        // 遍历范围的下界（包含），nil 表示没有下界
+	upper     []byte        // 遍历范围的上界（不包含），nil 表示没有上界
+	values    []*IndexItem  // 当前批次的 key + 位置索引信息，逆序遍历时为范围内的所有数据
+	currIndex int           // 当前遍历的下标位置
+	hasMore   bool          // 当前批次之后是否还有数据
+	cursor    gart.Iterator // 从头开始正序遍历时树自身的迭代器，树的结构发生变化之后失效
+	batchSize int           // 下一批取出的数据量
 }
 
-func newArtIterator(tree gart.Tree, reverse bool) *ArtIterator {
-	values := make([]*IndexItem, tree.Size())
-	idx := 0
-	if reverse {
-		idx = tree.Size() - 1
+func newArtIterator(art *AdaptiveRadixTreeIndex, lower, upper []byte, reverse bool) *ArtIterator {
+	iter := &ArtIterator{
+		art:     art,
+		reverse: reverse,
+		lower:   lower,
+		upper:   upper,
 	}
-	// 将所有数据存放到 values 中
-	tree.ForEach(func(node gart.Node) bool {
-		values[idx] = &IndexItem{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		if reverse {
-			idx--
-		} else {
-			idx++
-		}
-		return true
-	})
-	return &ArtIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	if reverse {
+		iter.collect()
 	}
+	iter.Rewind()
+	return iter
 }
 
 func (iter *ArtIterator) Rewind() {
-	iter.currIndex = 0
+	if iter.reverse {
+		iter.currIndex = 0
+		return
+	}
+	iter.cursor, iter.batchSize = nil, artIteratorBatchSize
+	if iter.lower == nil && iter.art != nil {
+		iter.art.mu.RLock()
+		iter.cursor = iter.art.tree.Iterator()
+		iter.art.mu.RUnlock()
+	}
+	iter.load(iter.lower, true)
 }
 
 func (iter *ArtIterator) Seek(key []byte) {
@@ -112,15 +158,24 @@ func (iter *ArtIterator) Seek(key []byte) {
 		iter.currIndex = sort.Search(len(iter.values), func(i int) bool {
 			return bytes.Compare(iter.values[i].key, key) <= 0
 		})
-	} else {
-		iter.currIndex = sort.Search(len(iter.values), func(i int) bool {
-			return bytes.Compare(iter.values[i].key, key) >= 0
-		})
+		return
+	}
+	if key == nil {
+		key = []byte{} // nil 在 load 中表示从头开始
 	}
+	if iter.lower != nil && bytes.Compare(key, iter.lower) < 0 {
+		key = iter.lower
+	}
+	iter.cursor, iter.batchSize = nil, artIteratorBatchSize
+	iter.load(key, true)
 }
 
 func (iter *ArtIterator) Next() {
 	iter.currIndex++
+	if iter.currIndex == len(iter.values) && iter.hasMore {
+		iter.batchSize = min(iter.batchSize*2, artIteratorMaxBatchSize)
+		iter.load(iter.values[len(iter.values)-1].key, false)
+	}
 }
 
 func (iter *ArtIterator) Valid() bool {
@@ -136,5 +191,130 @@ func (iter *ArtIterator) Value() *data.LogRecordPos {
 }
 
 func (iter *ArtIterator) Close() {
+	iter.currIndex = 0
 	iter.values = nil
+	iter.hasMore = false
+	iter.cursor = nil
+	iter.art = nil
+}
+
+// 从 pivot 开始正序取出下一批数据，pivot 为 nil 表示从头开始，inclusive 表示是否包含 pivot 本身
+func (iter *ArtIterator) load(pivot []byte, inclusive bool) {
+	values := make([]*IndexItem, 0, iter.batchSize)
+	iter.currIndex, iter.hasMore = 0, false
+	if iter.art == nil {
+		iter.values = values
+		return
+	}
+	iter.art.mu.RLock()
+	defer iter.art.mu.RUnlock()
+	reachUpper := false
+	add := func(key []byte, pos *data.LogRecordPos) bool {
+		if iter.upper != nil && bytes.Compare(key, iter.upper) >= 0 {
+			reachUpper = true
+			return false
+		}
+		if len(values) == iter.batchSize {
+			iter.hasMore = true
+			return false
+		}
+		values = append(values, &IndexItem{key: key, pos: pos})
+		return true
+	}
+	if iter.cursor != nil {
+		for len(values) < iter.batchSize && iter.cursor.HasNext() {
+			node, err := iter.cursor.Next()
+			if err != nil {
+				// 树的结构发生了变化，之后改为按照前缀重新定位
+				iter.cursor = nil
+				break
+			}
+			if !add(node.Key(), node.Value().(*data.LogRecordPos)) {
+				break
+			}
+		}
+		if reachUpper {
+			iter.cursor = nil
+		}
+		if iter.cursor != nil || reachUpper {
+			// 不能提前查看下一个节点，批次取满时认为之后还有数据
+			iter.hasMore = len(values) == iter.batchSize
+			iter.values = values
+			return
+		}
+		// 从已经取出的最后一个 key 之后继续
+		if len(values) > 0 {
+			pivot, inclusive = values[len(values)-1].key, false
+		}
+	}
+	// 大于 pivot 的最小的 key 是在 pivot 之后追加一个 0
+	start := pivot
+	if !inclusive {
+		start = append(pivot[:len(pivot):len(pivot)], 0)
+	}
+	artWalk(iter.art.tree, start, iter.upper, add)
+	iter.values = values
+}
+
+// 取出范围内的所有数据，并按照 key 降序排列
+func (iter *ArtIterator) collect() {
+	iter.art.mu.RLock()
+	artWalk(iter.art.tree, iter.lower, iter.upper, func(key []byte, pos *data.LogRecordPos) bool {
+		iter.values = append(iter.values, &IndexItem{key: key, pos: pos})
+		return true
+	})
+	iter.art.mu.RUnlock()
+	for i, j := 0, len(iter.values)-1; i < j; i, j = i+1, j-1 {
+		iter.values[i], iter.values[j] = iter.values[j], iter.values[i]
+	}
+}
+
+// 按照字典序遍历 [start, upper) 范围内的叶子节点，fn 返回 false 时停止，调用方需要持有读锁
+// ART 不支持直接定位到某个 key，因此把不小于 start 的 key 按照前缀拆开依次遍历：先是以 start 为前缀的 key，
+// 然后从后往前对 start 的每个位置 i，依次是以 start[:i] 加上一个大于 start[i] 的字节为前缀的 key，
+// 这样每个前缀只需要从根节点向下查找一次，不需要访问小于 start 的 key
+func artWalk(tree gart.Tree, start, upper []byte, fn func(key []byte, pos *data.LogRecordPos) bool) {
+	cont := true
+	visit := func(node gart.Node) bool {
+		// 遍历前缀时也会访问到内部节点，只需要处理叶子节点
+		if node.Kind() != gart.Leaf {
+			return true
+		}
+		key := node.Key()
+		// ART 按照 key 的字典序遍历，超过上界之后就可以停止了
+		if upper != nil && bytes.Compare(key, upper) >= 0 {
+			cont = false
+		} else {
+			cont = fn(key, node.Value().(*data.LogRecordPos))
+		}
+		return cont
+	}
+	if len(start) == 0 {
+		tree.ForEach(visit)
+		return
+	}
+	tree.ForEachPrefix(start, visit)
+	prefix := append([]byte(nil), start...)
+	for i := len(start) - 1; cont && i >= 0; i-- {
+		for c := int(start[i]) + 1; cont && c <= 0xff; c++ {
+			prefix[i] = byte(c)
+			// 之后的前缀都不小于上界，其中不会再有范围内的 key
+			if upper != nil && bytes.Compare(prefix[:i+1], upper) >= 0 {
+				return
+			}
+			tree.ForEachPrefix(prefix[:i+1], visit)
+		}
+	}
+}
+
+// 返回 a 和 b 的公共前缀，任意一个为 nil 时返回 nil
+func commonPrefix(a, b []byte) []byte {
+	if a == nil || b == nil {
+		return nil
+	}
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
 }
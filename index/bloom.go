@@ -0,0 +1,122 @@
+package index
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter 布隆过滤器，用于快速判断一个 key 一定不存在
+// 布隆过滤器不支持删除，被删除的 key 依然会被判断为可能存在，只会增加误判率
+type BloomFilter struct {
+	bits     []uint64
+	k        uint32 // 哈希函数的个数
+	capacity int    // 设计容量，加入的 key 超过这个数量之后误判率会明显上升
+	added    int    // 加入过的 key 的数量，包括之后被删除的 key
+}
+
+// NewBloomFilter 根据设计容量和每个 key 占用的位数创建布隆过滤器
+func NewBloomFilter(capacity int, bitsPerKey int) *BloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+	// 最优的哈希函数个数为 bitsPerKey * ln2
+	k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	k = max(1, min(k, 30))
+	words := (capacity*bitsPerKey + 63) / 64
+	return &BloomFilter{bits: make([]uint64, words), k: k, capacity: capacity}
+}
+
+// Add 将 key 加入布隆过滤器
+func (bf *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(bf.bits) * 64)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % n
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+	bf.added++
+}
+
+// MayContain 判断 key 是否可能存在，返回 false 时 key 一定不存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(bf.bits) * 64)
+	for i := uint32(0); i < bf.k; i++ {
+		bit := (h1 + i*h2) % n
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Capacity 返回布隆过滤器的设计容量
+func (bf *BloomFilter) Capacity() int {
+	return bf.capacity
+}
+
+// Added 返回加入过的 key 的数量
+func (bf *BloomFilter) Added() int {
+	return bf.added
+}
+
+// 使用双重哈希从一个 64 位的哈希值中得到 k 个哈希值
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// EncodeBloomFilter 对布隆过滤器进行序列化
+// +-----------+-----------------+-----------------+-----------------+-----------------+-----------+
+// |     K     |    Capacity     |      Added      |      Words      |      Bits       |    Crc    |
+// +-----------+-----------------+-----------------+-----------------+-----------------+-----------+
+// | 1 byte    | 变长，最大10bytes | 变长，最大10bytes | 变长，最大10bytes | Words * 8 bytes | 4 bytes   |
+func EncodeBloomFilter(bf *BloomFilter) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64*3, 1+binary.MaxVarintLen64*3+len(bf.bits)*8+4)
+	buf[0] = byte(bf.k)
+	idx := 1
+	idx += binary.PutUvarint(buf[idx:], uint64(bf.capacity))
+	idx += binary.PutUvarint(buf[idx:], uint64(bf.added))
+	idx += binary.PutUvarint(buf[idx:], uint64(len(bf.bits)))
+	buf = buf[:idx]
+	for _, word := range bf.bits {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// DecodeBloomFilter 对布隆过滤器进行反序列化，数据不完整或者校验失败时返回 false
+func DecodeBloomFilter(buf []byte) (*BloomFilter, bool) {
+	if len(buf) < 5 || crc32.ChecksumIEEE(buf[:len(buf)-4]) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, false
+	}
+	buf = buf[:len(buf)-4]
+	bf := &BloomFilter{k: uint32(buf[0])}
+	idx := 1
+	var fields [3]uint64
+	for i := range fields {
+		value, n := binary.Uvarint(buf[idx:])
+		if n <= 0 {
+			return nil, false
+		}
+		fields[i] = value
+		idx += n
+	}
+	words := fields[2]
+	if bf.k == 0 || words == 0 || uint64(len(buf)-idx) != words*8 {
+		return nil, false
+	}
+	bf.capacity, bf.added = int(fields[0]), int(fields[1])
+	bf.bits = make([]uint64, words)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(buf[idx+i*8:])
+	}
+	return bf, true
+}
@@ -1,24 +1,41 @@
 package index
 
 import (
+	"bytes"
 	"fairy-kvdb/data"
 	"go.etcd.io/bbolt"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 const bboltEngineFilename = "bbolt.db"
 const indexBucketName = "fairydb-index"
+const bloomFilterFilename = "bloom-filter"
+
+// 布隆过滤器的最小设计容量
+const minBloomFilterCapacity = 1024
 
 // BPlusTreeIndex B+ Tree 索引
 type BPlusTreeIndex struct {
 	tree *bbolt.DB // 封装了 bbolt 数据库引擎来实现，是并发安全的，因此不需要再加锁
+
+	writeMu    sync.Mutex   // 开启布隆过滤器时串行化写入，保证重新构建布隆过滤器期间不会遗漏新写入的 key
+	bloomMu    sync.RWMutex // 保护布隆过滤器
+	bloom      *BloomFilter // 布隆过滤器，为空表示没有开启
+	bloomPath  string       // 布隆过滤器持久化的文件
+	bitsPerKey int          // 布隆过滤器中每个 key 占用的位数
 }
 
 // BPlusTreeIndexOptions B+ Tree 索引配置项
 type BPlusTreeIndexOptions struct {
 	BboltOptions *bbolt.Options
 	DataDir      string
+
+	// 布隆过滤器中每个 key 占用的位数，0 表示不使用布隆过滤器，10 位时误判率约为 1%
+	// 布隆过滤器在 Close 时持久化到 bbolt.db 所在的目录中，启动时加载之后会删除这个文件，
+	// 因此没有正常关闭时文件不存在，下次启动时根据索引中的数据重新构建
+	BloomFilterBitsPerKey int
 }
 
 // NewBPlusTreeIndex 初始化 B+ Tree 索引
@@ -37,12 +54,73 @@ func NewBPlusTreeIndex(options *BPlusTreeIndexOptions) *BPlusTreeIndex {
 	}); err != nil {
 		panic("failed to create bucket in bpTree")
 	}
-	return &BPlusTreeIndex{
-		tree: bpTree,
+	bpt := &BPlusTreeIndex{
+		tree:       bpTree,
+		bloomPath:  filepath.Join(options.DataDir, bloomFilterFilename),
+		bitsPerKey: options.BloomFilterBitsPerKey,
+	}
+	if bpt.bitsPerKey > 0 {
+		bpt.loadBloomFilter()
+	} else if err := os.Remove(bpt.bloomPath); err != nil && !os.IsNotExist(err) {
+		// 没有开启布隆过滤器时的写入不会更新它，之前持久化的布隆过滤器已经不再可信
+		panic("failed to remove bloom filter file")
+	}
+	return bpt
+}
+
+// 加载持久化的布隆过滤器，文件不存在、已经损坏或者容量不足时根据索引中的数据重新构建
+func (bpt *BPlusTreeIndex) loadBloomFilter() {
+	size := bpt.Size()
+	if buf, err := os.ReadFile(bpt.bloomPath); err == nil {
+		// 加载之后立即删除文件，之后的写入只会更新内存中的布隆过滤器，没有正常关闭时文件中的数据是不完整的
+		if err := os.Remove(bpt.bloomPath); err != nil {
+			panic("failed to remove bloom filter file")
+		}
+		bf, ok := DecodeBloomFilter(buf)
+		// 被删除的 key 过多时误判率也会上升，同样需要重新构建
+		if ok && bf.Capacity() >= size && bf.Added() <= 2*max(size, minBloomFilterCapacity) {
+			bpt.bloom = bf
+			return
+		}
+	}
+	bpt.rebuildBloomFilter(size)
+}
+
+// 按照 size 个 key 的两倍容量重新构建布隆过滤器
+// 访问这个方法前必须持有 writeMu，或者还没有开始并发访问
+func (bpt *BPlusTreeIndex) rebuildBloomFilter(size int) {
+	bf := NewBloomFilter(max(2*size, minBloomFilterCapacity), bpt.bitsPerKey)
+	err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(indexBucketName)).ForEach(func(k, _ []byte) error {
+			bf.Add(k)
+			return nil
+		})
+	})
+	if err != nil {
+		panic("failed to rebuild bloom filter from bpTree")
 	}
+	bpt.bloomMu.Lock()
+	bpt.bloom = bf
+	bpt.bloomMu.Unlock()
 }
 
 func (bpt *BPlusTreeIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	if bpt.bitsPerKey > 0 {
+		bpt.writeMu.Lock()
+		defer bpt.writeMu.Unlock()
+		// 在写入 tree 之前加入布隆过滤器，保证读取时不会漏掉已经写入的 key
+		// 已经可能存在的 key 不需要重复加入，避免覆盖写入也被计入加入过的 key 的数量
+		bpt.bloomMu.Lock()
+		if !bpt.bloom.MayContain(key) {
+			bpt.bloom.Add(key)
+		}
+		grow := bpt.bloom.Added() > bpt.bloom.Capacity()
+		bpt.bloomMu.Unlock()
+		// 加入的 key 超过设计容量之后扩容
+		if grow {
+			defer func() { bpt.rebuildBloomFilter(bpt.Size()) }()
+		}
+	}
 	var ov []byte // old value
 	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(indexBucketName))
@@ -59,6 +137,15 @@ func (bpt *BPlusTreeIndex) Put(key []byte, pos *data.LogRecordPos) *data.LogReco
 }
 
 func (bpt *BPlusTreeIndex) Get(key []byte) *data.LogRecordPos {
+	// 布隆过滤器判断 key 不存在时不需要开启 bbolt 的读事务
+	if bpt.bitsPerKey > 0 {
+		bpt.bloomMu.RLock()
+		mayContain := bpt.bloom.MayContain(key)
+		bpt.bloomMu.RUnlock()
+		if !mayContain {
+			return nil
+		}
+	}
 	var pos *data.LogRecordPos
 	err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(indexBucketName))
@@ -93,6 +180,34 @@ func (bpt *BPlusTreeIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
 	return data.DecodeLogRecordPos(ov), true
 }
 
+func (bpt *BPlusTreeIndex) DeleteRange(start, end []byte, fn func(key []byte, pos *data.LogRecordPos)) {
+	type deletedItem struct {
+		key []byte
+		pos *data.LogRecordPos
+	}
+	var items []deletedItem
+	err := bpt.tree.Update(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket([]byte(indexBucketName)).Cursor()
+		for k, v := cursor.Seek(start); k != nil; k, v = cursor.Seek(start) {
+			if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+				break
+			}
+			// cursor 返回的数据只在事务内有效，因此需要拷贝出来
+			items = append(items, deletedItem{key: append([]byte(nil), k...), pos: data.DecodeLogRecordPos(v)})
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic("failed to delete range from bpTree")
+	}
+	for _, itm := range items {
+		fn(itm.key, itm.pos)
+	}
+}
+
 func (bpt *BPlusTreeIndex) Size() int {
 	size := 0
 	err := bpt.tree.View(func(tx *bbolt.Tx) error {
@@ -107,23 +222,56 @@ func (bpt *BPlusTreeIndex) Size() int {
 }
 
 func (bpt *BPlusTreeIndex) Iterator(reverse bool) Iterator {
-	return NewBPlusTreeIterator(bpt, reverse)
+	return bpt.RangeIterator(nil, nil, reverse)
+}
+
+func (bpt *BPlusTreeIndex) RangeIterator(lower, upper []byte, reverse bool) Iterator {
+	return NewBPlusTreeIterator(bpt, lower, upper, reverse)
 }
 
 func (bpt *BPlusTreeIndex) Close() error {
+	if bpt.bitsPerKey > 0 {
+		bpt.bloomMu.Lock()
+		err := saveBloomFilter(bpt.bloomPath, bpt.bloom)
+		bpt.bloomMu.Unlock()
+		if err != nil {
+			_ = bpt.tree.Close()
+			return err
+		}
+	}
 	return bpt.tree.Close()
 }
 
+// 持久化布隆过滤器，先写临时文件再重命名，保证文件总是完整的
+func saveBloomFilter(path string, bf *BloomFilter) error {
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(EncodeBloomFilter(bf)); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
 // BPlusTreeIterator B+Tree 索引迭代器
 type BPlusTreeIterator struct {
 	tx        *bbolt.Tx
 	cursor    *bbolt.Cursor
 	reverse   bool
+	lower     []byte // 遍历范围的下界（包含），nil 表示没有下界
+	upper     []byte // 遍历范围的上界（不包含），nil 表示没有上界
 	currKey   []byte
 	currValue []byte
 }
 
-func NewBPlusTreeIterator(bpt *BPlusTreeIndex, reverse bool) *BPlusTreeIterator {
+func NewBPlusTreeIterator(bpt *BPlusTreeIndex, lower, upper []byte, reverse bool) *BPlusTreeIterator {
 	tx, err := bpt.tree.Begin(false) // 手动开启一个事务
 	if err != nil {
 		panic("failed to begin transaction in bpTree")
@@ -133,6 +281,8 @@ func NewBPlusTreeIterator(bpt *BPlusTreeIndex, reverse bool) *BPlusTreeIterator
 		tx:      tx,
 		cursor:  cursor,
 		reverse: reverse,
+		lower:   lower,
+		upper:   upper,
 	}
 	iter.Rewind()
 	return iter
@@ -140,16 +290,46 @@ func NewBPlusTreeIterator(bpt *BPlusTreeIndex, reverse bool) *BPlusTreeIterator
 
 func (iter *BPlusTreeIterator) Rewind() {
 	if iter.reverse {
-		iter.currKey, iter.currValue = iter.cursor.Last()
+		if iter.upper != nil {
+			iter.seekBefore(iter.upper, false)
+		} else {
+			iter.currKey, iter.currValue = iter.cursor.Last()
+		}
 	} else {
-		iter.currKey, iter.currValue = iter.cursor.First()
+		if iter.lower != nil {
+			iter.currKey, iter.currValue = iter.cursor.Seek(iter.lower)
+		} else {
+			iter.currKey, iter.currValue = iter.cursor.First()
+		}
 	}
 }
 
 func (iter *BPlusTreeIterator) Seek(key []byte) {
+	if iter.reverse {
+		if iter.upper != nil && bytes.Compare(key, iter.upper) >= 0 {
+			iter.seekBefore(iter.upper, false)
+		} else {
+			iter.seekBefore(key, true)
+		}
+		return
+	}
+	if iter.lower != nil && bytes.Compare(key, iter.lower) < 0 {
+		key = iter.lower
+	}
 	iter.currKey, iter.currValue = iter.cursor.Seek(key)
 }
 
+// 逆序遍历时定位到最后一个小于（inclusive 时小于等于）key 的位置
+func (iter *BPlusTreeIterator) seekBefore(key []byte, inclusive bool) {
+	k, v := iter.cursor.Seek(key)
+	if k == nil {
+		k, v = iter.cursor.Last()
+	} else if c := bytes.Compare(k, key); c > 0 || c == 0 && !inclusive {
+		k, v = iter.cursor.Prev()
+	}
+	iter.currKey, iter.currValue = k, v
+}
+
 func (iter *BPlusTreeIterator) Next() {
 	if iter.reverse {
 		iter.currKey, iter.currValue = iter.cursor.Prev()
@@ -159,7 +339,13 @@ func (iter *BPlusTreeIterator) Next() {
 }
 
 func (iter *BPlusTreeIterator) Valid() bool {
-	return len(iter.currKey) != 0
+	if len(iter.currKey) == 0 {
+		return false
+	}
+	if iter.reverse {
+		return iter.lower == nil || bytes.Compare(iter.currKey, iter.lower) >= 0
+	}
+	return iter.upper == nil || bytes.Compare(iter.currKey, iter.upper) < 0
 }
 
 func (iter *BPlusTreeIterator) Key() []byte {
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fairy-kvdb/data"
 	"github.com/google/btree"
-	"sort"
 	"sync"
 )
 
@@ -60,6 +59,27 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	return oldItem.(*IndexItem).pos, true
 }
 
+func (bt *BTree) DeleteRange(start, end []byte, fn func(key []byte, pos *data.LogRecordPos)) {
+	var items []*IndexItem
+	bt.mu.Lock()
+	// 树中的元素按照 key 降序排列，因此从 start 开始降序遍历得到的是升序的 key
+	bt.tree.DescendLessOrEqual(&IndexItem{key: start}, func(item btree.Item) bool {
+		itm := item.(*IndexItem)
+		if len(end) > 0 && bytes.Compare(itm.key, end) >= 0 {
+			return false
+		}
+		items = append(items, itm)
+		return true
+	})
+	for _, itm := range items {
+		bt.tree.Delete(itm)
+	}
+	bt.mu.Unlock()
+	for _, itm := range items {
+		fn(itm.key, itm.pos)
+	}
+}
+
 func (bt *BTree) Size() int {
 	bt.mu.RLock()
 	defer bt.mu.RUnlock()
@@ -67,68 +87,81 @@ func (bt *BTree) Size() int {
 }
 
 func (bt *BTree) Iterator(reverse bool) Iterator {
+	return bt.RangeIterator(nil, nil, reverse)
+}
+
+func (bt *BTree) RangeIterator(lower, upper []byte, reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.mu.RLock()
-	defer bt.mu.RUnlock()
-	return NewBTreeIterator(bt, reverse)
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	return NewBTreeIterator(bt, lower, upper, reverse)
 }
 
 func (bt *BTree) Close() error {
 	return nil
 }
 
+// 迭代器每次从树中取出的数据量
+const btreeIteratorBatchSize = 64
+
 // BTreeIterator BTree 索引迭代器
+// 创建时只会对树做一次写时复制的拷贝，之后每次按批从拷贝中取出数据，因此创建的开销与索引中的数据量无关，
+// 之后对索引的写入也不会影响它的遍历结果
 type BTreeIterator struct {
-	currIndex int          // 当前遍历的下标位置
+	tree      *btree.BTree // 索引的只读拷贝
 	reverse   bool         // 是否是逆序遍历
-	values    []*IndexItem // key + 位置索引信息
+	lower     []byte       // 遍历范围的下界（包含），nil 表示没有下界
+	upper     []byte       // 遍历范围的上界（不包含），nil 表示没有上界
+	values    []*IndexItem // 当前批次的 key + 位置索引信息
+	currIndex int          // 当前遍历的下标位置
+	hasMore   bool         // 当前批次之后是否还有数据
 }
 
-// NewBTreeIterator 初始化 BTree 索引迭代器
-func NewBTreeIterator(bt *BTree, reverse bool) *BTreeIterator {
-	var idx int
-	values := make([]*IndexItem, bt.tree.Len())
-
-	// 将 btree 索引中的数据都取出来
-	saveValuesHandler := func(item btree.Item) bool {
-		values[idx] = item.(*IndexItem)
-		idx++
-		return true
-	}
-	if !reverse {
-		bt.tree.Descend(saveValuesHandler)
-	} else {
-		bt.tree.Ascend(saveValuesHandler)
-	}
-
-	return &BTreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+// NewBTreeIterator 初始化 BTree 索引迭代器，调用方需要持有 bt 的写锁
+func NewBTreeIterator(bt *BTree, lower, upper []byte, reverse bool) *BTreeIterator {
+	iter := &BTreeIterator{
+		tree:    bt.tree.Clone(),
+		reverse: reverse,
+		lower:   lower,
+		upper:   upper,
 	}
+	iter.Rewind()
+	return iter
 }
 
 func (iter *BTreeIterator) Rewind() {
-	iter.currIndex = 0
+	if iter.reverse {
+		iter.load(iter.upper, iter.upper == nil)
+	} else {
+		iter.load(iter.lower, true)
+	}
 }
 
 func (iter *BTreeIterator) Seek(key []byte) {
-	// 二分查找（因为从 B+ Tree 中取出来的数据已经是有序的了）
-	comparator := func(i int) bool {
-		return bytes.Compare(iter.values[i].key, key) >= 0
+	if key == nil {
+		key = []byte{} // nil 在 load 中表示从头开始
 	}
 	if iter.reverse {
-		comparator = func(i int) bool {
-			return bytes.Compare(iter.values[i].key, key) <= 0
+		if iter.upper != nil && bytes.Compare(key, iter.upper) >= 0 {
+			iter.load(iter.upper, false)
+		} else {
+			iter.load(key, true)
 		}
+	} else {
+		if iter.lower != nil && bytes.Compare(key, iter.lower) < 0 {
+			key = iter.lower
+		}
+		iter.load(key, true)
 	}
-	iter.currIndex = sort.Search(len(iter.values), comparator)
 }
 
 func (iter *BTreeIterator) Next() {
 	iter.currIndex++
+	if iter.currIndex == len(iter.values) && iter.hasMore {
+		iter.load(iter.values[len(iter.values)-1].key, false)
+	}
 }
 
 func (iter *BTreeIterator) Valid() bool {
@@ -146,4 +179,41 @@ func (iter *BTreeIterator) Value() *data.LogRecordPos {
 func (iter *BTreeIterator) Close() {
 	iter.currIndex = 0
 	iter.values = nil
+	iter.tree = nil
+}
+
+// 从 pivot 开始按照遍历方向取出下一批数据，pivot 为 nil 表示从头开始，inclusive 表示是否包含 pivot 本身
+func (iter *BTreeIterator) load(pivot []byte, inclusive bool) {
+	values := make([]*IndexItem, 0, btreeIteratorBatchSize)
+	iter.currIndex, iter.hasMore = 0, false
+	handler := func(item btree.Item) bool {
+		itm := item.(*IndexItem)
+		if !inclusive && bytes.Equal(itm.key, pivot) {
+			return true
+		}
+		if iter.reverse && iter.lower != nil && bytes.Compare(itm.key, iter.lower) < 0 ||
+			!iter.reverse && iter.upper != nil && bytes.Compare(itm.key, iter.upper) >= 0 {
+			return false
+		}
+		if len(values) == btreeIteratorBatchSize {
+			iter.hasMore = true
+			return false
+		}
+		values = append(values, itm)
+		return true
+	}
+	// 树中的元素按照 key 降序排列，因此正向遍历 key 需要降序遍历树，反之亦然
+	if iter.tree != nil {
+		switch {
+		case iter.reverse && pivot == nil:
+			iter.tree.Ascend(handler)
+		case iter.reverse:
+			iter.tree.AscendGreaterOrEqual(&IndexItem{key: pivot}, handler)
+		case pivot == nil:
+			iter.tree.Descend(handler)
+		default:
+			iter.tree.DescendLessOrEqual(&IndexItem{key: pivot}, handler)
+		}
+	}
+	iter.values = values
 }
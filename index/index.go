@@ -15,12 +15,19 @@ type Indexer interface {
 	// Delete 删除 key
 	Delete(key []byte) (*data.LogRecordPos, bool)
 
+	// DeleteRange 删除 [start, end) 范围内的所有 key，end 为空表示没有上界
+	// 每删除一个 key 都会调用一次 fn，调用时不持有索引的锁
+	DeleteRange(start, end []byte, fn func(key []byte, pos *data.LogRecordPos))
+
 	// Size 返回索引中的数据量
 	Size() int
 
 	// Iterator 返回一个迭代器
 	Iterator(reverse bool) Iterator
 
+	// RangeIterator 返回只遍历 [lower, upper) 范围内的 key 的迭代器，nil 表示没有对应的边界
+	RangeIterator(lower, upper []byte, reverse bool) Iterator
+
 	// Close 关闭索引
 	Close() error
 }
@@ -0,0 +1,317 @@
+package fairy_kvdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"fairy-kvdb/index"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+const indexSnapshotKey = "index-snapshot"
+
+// 内存索引快照的元信息
+// 快照文件的第一条记录保存元信息，之后的每一条记录保存索引中的一个 key 以及它的位置，格式与 Hint 文件相同
+type indexSnapshot struct {
+	activeFid   uint32         // 保存快照时的活跃文件 ID
+	writeOffset int64          // 保存快照时活跃文件的写入位置，启动时从这里开始重放
+	reclaimSize uint64         // 保存快照时可以回收的无效数据量
+	nextBTSN    uint64         // 保存快照时最近一次分配的序列号
+	mergeFid    uint64         // 保存快照时 merge 完成标志文件中的 nonMergeFid 加 1，0 表示没有发生过 merge
+	entryCount  uint64         // 快照中索引记录的数量
+	files       []snapshotFile // 保存快照时所有的数据文件，按照文件 ID 从小到大排列
+	activeHints []byte         // 活跃文件中已有记录对应的 hint 记录
+}
+
+// 保存快照时的一个数据文件
+type snapshotFile struct {
+	fid      uint32
+	size     uint64
+	liveSize uint64
+	maxSeq   uint64
+}
+
+// 对快照的元信息进行编码
+// activeFid | writeOffset | reclaimSize | nextBTSN | mergeFid | entryCount | fileCount | [fid | size | liveSize | maxSeq] * n | activeHints
+func encodeIndexSnapshot(snapshot *indexSnapshot) []byte {
+	buf := binary.AppendUvarint(nil, uint64(snapshot.activeFid))
+	buf = binary.AppendVarint(buf, snapshot.writeOffset)
+	buf = binary.AppendUvarint(buf, snapshot.reclaimSize)
+	buf = binary.AppendUvarint(buf, snapshot.nextBTSN)
+	buf = binary.AppendUvarint(buf, snapshot.mergeFid)
+	buf = binary.AppendUvarint(buf, snapshot.entryCount)
+	buf = binary.AppendUvarint(buf, uint64(len(snapshot.files)))
+	for _, file := range snapshot.files {
+		buf = binary.AppendUvarint(buf, uint64(file.fid))
+		buf = binary.AppendUvarint(buf, file.size)
+		buf = binary.AppendUvarint(buf, file.liveSize)
+		buf = binary.AppendUvarint(buf, file.maxSeq)
+	}
+	return append(buf, snapshot.activeHints...)
+}
+
+// 对快照的元信息进行解码
+func decodeIndexSnapshot(buf []byte) (*indexSnapshot, bool) {
+	var fields [7]uint64
+	for i := range fields {
+		var n int
+		if i == 1 {
+			var offset int64
+			offset, n = binary.Varint(buf)
+			fields[i] = uint64(offset)
+		} else {
+			fields[i], n = binary.Uvarint(buf)
+		}
+		if n <= 0 {
+			return nil, false
+		}
+		buf = buf[n:]
+	}
+	snapshot := &indexSnapshot{
+		activeFid:   uint32(fields[0]),
+		writeOffset: int64(fields[1]),
+		reclaimSize: fields[2],
+		nextBTSN:    fields[3],
+		mergeFid:    fields[4],
+		entryCount:  fields[5],
+	}
+	for i := uint64(0); i < fields[6]; i++ {
+		var file [4]uint64
+		for j := range file {
+			var n int
+			if file[j], n = binary.Uvarint(buf); n <= 0 {
+				return nil, false
+			}
+			buf = buf[n:]
+		}
+		snapshot.files = append(snapshot.files, snapshotFile{fid: uint32(file[0]), size: file[1], liveSize: file[2], maxSeq: file[3]})
+	}
+	snapshot.activeHints = buf
+	return snapshot, true
+}
+
+// 将内存索引保存为快照，下次启动时加载快照之后只需要重放快照之后写入的记录
+// 快照只用于加快启动，保存失败时下次启动会回退到完整地重放数据文件
+// 访问这个方法前必须加锁
+func (db *DB) saveIndexSnapshot() error {
+	// 跳过了索引更新的写入需要在下次启动时重放，因此不能保存快照
+	if db.noIndexSnapshot || db.unindexedWrites || db.activeFile == nil {
+		return nil
+	}
+	// 快照中的位置必须都已经持久化到了数据文件中
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	mergeFid, err := db.mergeFinishedFid()
+	if err != nil {
+		return err
+	}
+	snapshot := &indexSnapshot{
+		activeFid:   db.activeFile.FileId,
+		writeOffset: db.activeFile.WriteOffset,
+		reclaimSize: atomic.LoadUint64(&db.reclaimSize),
+		nextBTSN:    db.nextBTSN,
+		mergeFid:    mergeFid,
+		activeHints: db.activeHints,
+	}
+	dataFiles := []*data.DataFile{db.activeFile}
+	for _, dataFile := range db.olderFiles {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	for _, dataFile := range dataFiles {
+		size, err := dataFile.IoManger.Size()
+		if err != nil {
+			return err
+		}
+		// 不知道序列号上限的文件使用当前的序列号作为上限
+		maxSeq, ok := db.fileMaxSeqs[dataFile.FileId]
+		if !ok {
+			maxSeq = db.nextBTSN
+		}
+		snapshot.files = append(snapshot.files, snapshotFile{fid: dataFile.FileId, size: uint64(size), liveSize: db.fileLiveSizes[dataFile.FileId], maxSeq: maxSeq})
+	}
+	sort.Slice(snapshot.files, func(i, j int) bool {
+		return snapshot.files[i].fid < snapshot.files[j].fid
+	})
+	indexes := db.familyIndexes()
+	for _, idx := range indexes {
+		snapshot.entryCount += uint64(idx.Size())
+	}
+
+	// 先写临时文件再重命名，保证快照文件总是完整的
+	path := filepath.Join(db.options.DataDir, data.IndexSnapshotFileName)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFIlePerm)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encRecord, _ := data.EncodeEncryptedLogRecord(&data.LogRecord{Key: []byte(indexSnapshotKey), Value: encodeIndexSnapshot(snapshot)}, data.CompressionNone, 0, db.cipher)
+	_, err = writer.Write(encRecord)
+	for family, idx := range indexes {
+		if err != nil {
+			break
+		}
+		err = writeIndexSnapshotEntries(writer, family, idx, db.cipher)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 将一个列族索引中的所有 key 以及它们的位置写入快照
+func writeIndexSnapshotEntries(writer io.Writer, family uint32, idx index.Indexer, cipher *data.Cipher) error {
+	iter := idx.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		record := &data.LogRecord{Key: iter.Key(), Value: data.EncodeLogRecordPos(iter.Value()), Family: family}
+		encRecord, _ := data.EncodeEncryptedLogRecord(record, data.CompressionNone, 0, cipher)
+		if _, err := writer.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 加载索引快照，返回 nil 表示快照不存在或者已经失效，需要完整地重放数据文件
+// 快照保存之后数据目录可能被没有保存快照的进程修改过，因此只有快照中的数据文件都没有发生变化时才可以使用：
+// 旧文件的大小不变，活跃文件只会在末尾追加，并且之后没有发生过 merge
+func (db *DB) loadIndexSnapshot(fileIds []uint32) *indexSnapshot {
+	if db.noIndexSnapshot || db.activeFile == nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(db.options.DataDir, data.IndexSnapshotFileName)); err != nil {
+		return nil
+	}
+	snapshotFile, err := data.OpenIndexSnapshotFile(db.options.DataDir)
+	if err != nil {
+		return nil
+	}
+	defer snapshotFile.Close()
+	snapshotFile.Cipher = db.cipher
+	record, offset, err := snapshotFile.ReadLogRecord(0)
+	if err != nil || string(record.Key) != indexSnapshotKey {
+		return nil
+	}
+	snapshot, ok := decodeIndexSnapshot(record.Value)
+	if !ok || !db.matchIndexSnapshot(snapshot, fileIds) {
+		return nil
+	}
+
+	atomic.StoreUint64(&db.reclaimSize, snapshot.reclaimSize)
+	for _, file := range snapshot.files {
+		if file.liveSize > 0 {
+			db.fileLiveSizes[file.fid] = file.liveSize
+		}
+		db.trackFileSeq(file.fid, file.maxSeq)
+	}
+	for i := uint64(0); i < snapshot.entryCount; i++ {
+		record, size, err := snapshotFile.ReadLogRecord(offset)
+		if err != nil {
+			db.resetIndexes()
+			return nil
+		}
+		idx := db.familyIndex(record.Family)
+		pos := data.DecodeLogRecordPos(record.Value)
+		// 快照之后列族被删除了
+		if idx == nil || pos == nil {
+			db.resetIndexes()
+			return nil
+		}
+		// 加载快照时已经过期的数据等同于被删除
+		if pos.IsExpired() {
+			db.markDead(pos)
+		} else {
+			idx.Put(record.Key, pos)
+		}
+		offset += size
+	}
+	if _, _, err := snapshotFile.ReadLogRecord(offset); err != io.EOF {
+		db.resetIndexes()
+		return nil
+	}
+	if snapshot.activeFid == db.activeFile.FileId {
+		db.activeHints = snapshot.activeHints
+	}
+	return snapshot
+}
+
+// 检查快照保存之后数据文件是否发生过变化
+func (db *DB) matchIndexSnapshot(snapshot *indexSnapshot, fileIds []uint32) bool {
+	mergeFid, err := db.mergeFinishedFid()
+	if err != nil || mergeFid != snapshot.mergeFid {
+		return false
+	}
+	// 快照之后新增的数据文件只会排在快照的活跃文件之后
+	var snapshotFids []uint32
+	for _, fid := range fileIds {
+		if fid <= snapshot.activeFid {
+			snapshotFids = append(snapshotFids, fid)
+		}
+	}
+	if len(snapshotFids) != len(snapshot.files) {
+		return false
+	}
+	for i, file := range snapshot.files {
+		if snapshotFids[i] != file.fid {
+			return false
+		}
+		dataFile := db.olderFiles[file.fid]
+		if file.fid == db.activeFile.FileId {
+			dataFile = db.activeFile
+		}
+		size, err := dataFile.IoManger.Size()
+		if err != nil {
+			return false
+		}
+		if file.fid == snapshot.activeFid {
+			if uint64(size) < file.size || file.size != uint64(snapshot.writeOffset) {
+				return false
+			}
+		} else if uint64(size) != file.size {
+			return false
+		}
+	}
+	return true
+}
+
+// 获取 merge 完成标志文件中记录的 nonMergeFid 加 1，没有发生过 merge 时返回 0
+func (db *DB) mergeFinishedFid() (uint64, error) {
+	if _, err := os.Stat(filepath.Join(db.options.DataDir, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	info, err := readMergeFinishedFile(db.options.DataDir)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.nonMergeFid) + 1, nil
+}
+
+// 丢弃加载了一半的快照，恢复到还没有加载任何索引的状态
+func (db *DB) resetIndexes() {
+	_ = db.index.Close()
+	db.index = index.NewIndexer(index.TypeEnum(db.options.IndexType), db.options.BPlusTreeIndexOpts)
+	for _, cf := range db.families {
+		_ = cf.index.Close()
+		cf.index = index.NewIndexer(cf.indexType, nil)
+	}
+	db.fileLiveSizes = make(map[uint32]uint64)
+	db.fileMaxSeqs = make(map[uint32]uint64)
+	db.deadBlobs = nil
+	atomic.StoreUint64(&db.reclaimSize, 0)
+}
@@ -3,6 +3,8 @@ package fairy_kvdb
 import (
 	"bytes"
 	"fairy-kvdb/index"
+	"sort"
+	"sync/atomic"
 )
 
 // Iterator 数据库层面的迭代器
@@ -10,34 +12,61 @@ type Iterator struct {
 	indexIterator index.Iterator // 索引迭代器
 	db            *DB
 	options       IteratorOptions // 迭代器选项
+	readTs        uint64          // 迭代器作为读视图注册时的 BTSN，保证它引用的数据文件在 Close 之前不会被 merge 删除
+	epoch         uint64          // 迭代器作为读视图注册时所在的纪元
+	count         int             // 已经遍历过的 key 的数量，用于限制遍历的数量
+	closed        bool
 }
 
+// NewIterator 创建一个迭代器，使用完之后必须调用 Close
+// 迭代器在 Close 之前会作为读视图保留被覆盖的旧版本以及被 merge 淘汰的数据文件，没有关闭的迭代器会让它们一直无法释放，
+// 可以通过 Stat 中的 ActiveReaders 发现没有关闭的迭代器
 func (db *DB) NewIterator(options *IteratorOptions) *Iterator {
-	return &Iterator{
-		indexIterator: db.index.Iterator(options.Reverse),
+	return db.newIterator(db.index, options)
+}
+
+func (db *DB) newIterator(idx index.Indexer, options *IteratorOptions) *Iterator {
+	db.mu.RLock()
+	readTs := atomic.LoadUint64(&db.nextBTSN)
+	epoch := db.versions.acquire(readTs)
+	lower, upper := options.keyRange()
+	iter := &Iterator{
+		indexIterator: idx.RangeIterator(lower, upper, options.Reverse),
 		db:            db,
 		options:       *options,
+		readTs:        readTs,
+		epoch:         epoch,
 	}
+	db.mu.RUnlock()
+	iter.skipToNext() // 跳过起始位置上已经过期的 key
+	return iter
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (iter *Iterator) Rewind() {
+	iter.count = 0
 	iter.indexIterator.Rewind()
-	iter.skipToNext() // 跳过 prefix 不满足条件的 key
+	iter.skipToNext() // 跳过已经过期的 key
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+// 遍历数量的限制从 Seek 到的位置重新开始计算
 func (iter *Iterator) Seek(key []byte) {
+	iter.count = 0
 	iter.indexIterator.Seek(key)
-	iter.skipToNext() // 跳过 prefix 不满足条件的 key
+	iter.skipToNext() // 跳过已经过期的 key
 }
 
 func (iter *Iterator) Next() {
+	iter.count++
 	iter.indexIterator.Next()
-	iter.skipToNext() // 跳过 prefix 不满足条件的 key
+	iter.skipToNext() // 跳过已经过期的 key
 }
 
 func (iter *Iterator) Valid() bool {
+	if iter.options.Limit > 0 && iter.count >= iter.options.Limit {
+		return false
+	}
 	return iter.indexIterator.Valid()
 }
 
@@ -49,26 +78,130 @@ func (iter *Iterator) Value() []byte {
 	recordPos := iter.indexIterator.Value()
 	iter.db.mu.RLock()
 	defer iter.db.mu.RUnlock()
-	record, err := iter.db.readLogRecord(recordPos)
+	value, err := iter.db.readValue(recordPos)
 	if err != nil {
 		return nil
 	}
-	return record.Value
+	return value
 }
 
+// Close 关闭迭代器，释放它持有的读视图
 func (iter *Iterator) Close() {
 	iter.indexIterator.Close()
+	if !iter.closed {
+		iter.closed = true
+		iter.db.versions.release(iter.readTs, iter.epoch)
+	}
 }
 
+// 跳过已经过期的 key，范围之外的 key 已经由索引迭代器过滤掉了
 func (iter *Iterator) skipToNext() {
-	prefixLen := len(iter.options.Prefix)
-	if prefixLen == 0 {
-		return
+	for iter.indexIterator.Valid() && iter.indexIterator.Value().IsExpired() {
+		iter.indexIterator.Next()
+	}
+}
+
+// 根据前缀以及上下界计算出需要遍历的范围 [lower, upper)，nil 表示没有对应的边界
+func (options *IteratorOptions) keyRange() (lower, upper []byte) {
+	lower, upper = options.LowerBound, options.UpperBound
+	if len(lower) == 0 {
+		lower = nil
+	}
+	if len(upper) == 0 {
+		upper = nil
+	}
+	if len(options.Prefix) == 0 {
+		return lower, upper
+	}
+	if lower == nil || bytes.Compare(options.Prefix, lower) > 0 {
+		lower = options.Prefix
+	}
+	if end := prefixEnd(options.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+		upper = end
 	}
+	return lower, upper
+}
+
+// 判断 key 是否在 [lower, upper) 范围内
+func inKeyRange(key, lower, upper []byte) bool {
+	return (lower == nil || bytes.Compare(key, lower) >= 0) && (upper == nil || bytes.Compare(key, upper) < 0)
+}
 
-	for ; iter.indexIterator.Valid(); iter.indexIterator.Next() {
-		if bytes.HasPrefix(iter.indexIterator.Key(), iter.options.Prefix) {
-			break
+// SnapshotIterator 基于某个时间点快照的迭代器
+// 创建时会取出快照中所有满足条件的 key 以及位置信息，因此之后的写入不会影响它的遍历结果
+type SnapshotIterator struct {
+	currIndex int
+	startIdx  int // Rewind 或者 Seek 到的位置，用于限制遍历的数量
+	items     []*snapshotItem
+	db        *DB
+	options   IteratorOptions
+}
+
+// items 需要按照 key 升序排列
+func newSnapshotIterator(db *DB, items []*snapshotItem, options IteratorOptions) *SnapshotIterator {
+	if options.Reverse {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
 		}
 	}
+	return &SnapshotIterator{
+		currIndex: 0,
+		items:     items,
+		db:        db,
+		options:   options,
+	}
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (iter *SnapshotIterator) Rewind() {
+	iter.currIndex = 0
+	iter.startIdx = 0
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (iter *SnapshotIterator) Seek(key []byte) {
+	comparator := func(i int) bool {
+		return bytes.Compare(iter.items[i].key, key) >= 0
+	}
+	if iter.options.Reverse {
+		comparator = func(i int) bool {
+			return bytes.Compare(iter.items[i].key, key) <= 0
+		}
+	}
+	iter.currIndex = sort.Search(len(iter.items), comparator)
+	iter.startIdx = iter.currIndex
+}
+
+func (iter *SnapshotIterator) Next() {
+	iter.currIndex++
+}
+
+func (iter *SnapshotIterator) Valid() bool {
+	if iter.options.Limit > 0 && iter.currIndex-iter.startIdx >= iter.options.Limit {
+		return false
+	}
+	return iter.currIndex < len(iter.items)
+}
+
+func (iter *SnapshotIterator) Key() []byte {
+	return iter.items[iter.currIndex].key
+}
+
+func (iter *SnapshotIterator) Value() []byte {
+	item := iter.items[iter.currIndex]
+	if item.pos == nil {
+		return item.value
+	}
+	iter.db.mu.RLock()
+	defer iter.db.mu.RUnlock()
+	value, err := iter.db.readValue(item.pos)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func (iter *SnapshotIterator) Close() {
+	iter.currIndex = 0
+	iter.items = nil
 }
@@ -3,65 +3,110 @@ package fairy_kvdb
 import (
 	"encoding/binary"
 	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"fairy-kvdb/index"
 	"fairy-kvdb/utils"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	mergeDirName      = "-merge"
 	mergeFinRecordKey = "merge-finished"
+	maxMergeFidShift  = 8 // merge 预留文件 ID 的余量最多翻倍的次数
 )
 
+// merge 完成标志文件中记录的信息
+type mergeFinishedInfo struct {
+	nonMergeFid  uint32   // 最近没有参与 merge 的文件 ID，小于它的文件的索引都记录在 Hint 文件中
+	mergeBaseFid uint32   // merge 生成的文件的起始 ID
+	mergedFids   []uint32 // 参与了 merge、需要被删除的旧文件 ID，为空时表示所有小于 mergeBaseFid 的文件
+	maxSeq       uint64   // merge 生成的文件中记录的序列号都不会超过它，这些文件在启动时不会被重放，需要借助它恢复序列号
+}
+
 // Merge 清理无效数据，生成 Hint 文件
 func (db *DB) Merge() error {
-	// 如果数据库为空，则直接返回
-	if db.activeFile == nil {
-		return nil
-	}
+	return db.MergeWithOptions(DefaultMergeOptions)
+}
 
+// MergeWithOptions 根据配置项清理无效数据，生成 Hint 文件
+// 增量 merge 只会重写无效数据比例最高的部分文件，其余文件保持不变
+func (db *DB) MergeWithOptions(options MergeOptions) error {
 	// 检查是否有其他进程正在 merge
 	if ok := atomic.CompareAndSwapInt32(&db.isMerging, 0, 1); !ok {
 		return ErrorMergeIsProgress
 	}
 	defer atomic.StoreInt32(&db.isMerging, 0)
 	db.mu.Lock()
-	// 先检查一下是否需要 merge，也就是是否达到了 merge ratio
-	dirSize, err := utils.DirSize(db.options.DataDir)
+	// 如果数据库为空，则直接返回
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	// merge 只保留索引指向的记录，跳过了索引更新的写入会被当作无效数据清理掉，因此需要先重新打开数据库重放这些写入
+	if db.unindexedWrites {
+		db.mu.Unlock()
+		return ErrorMergeUnindexedWrites
+	}
+	// 全量 merge 先检查一下是否需要 merge，也就是是否达到了 merge ratio
+	if !options.Incremental {
+		dirSize, err := utils.DirSize(db.options.DataDir)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if float64(db.reclaimSize)/float64(dirSize) < db.options.MergeRatio {
+			db.mu.Unlock()
+			return ErrorMergeRatioUnreached
+		}
+	}
+	// 持久化当前活跃文件，它也会作为旧文件参与 merge
+	if err := db.activeFile.Sync(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	// 取出所有需要 merge 的文件
+	mergeFiles, err := db.pickMergeFiles(options)
 	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	if float64(db.reclaimSize)/float64(dirSize) < db.options.MergeRatio {
+	if len(mergeFiles) == 0 {
 		db.mu.Unlock()
 		return ErrorMergeRatioUnreached
 	}
-	// 持久化当前活跃文件，并新建一个活跃文件
-	if err := db.activeFile.Sync(); err != nil {
+	fullMerge := len(mergeFiles) == len(db.olderFiles)+1
+	db.mergeOperandKeys = make(map[string]struct{})
+	indexes := db.familyIndexes()
+	// 新建一个活跃文件
+	// 在新的活跃文件之前为 merge 生成的文件预留出文件 ID，这样 merge 生成的文件不会与旧文件重名，旧文件在被快照引用时可以继续保留
+	reserved, err := db.mergeFileIdReserve(mergeFiles)
+	if err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	if err := db.setActiveFile(); err != nil {
+	db.sealActiveFile()
+	mergeBaseFid := db.activeFile.FileId + 1
+	if err := db.openActiveFile(mergeBaseFid + reserved); err != nil {
 		db.mu.Unlock()
 		return err
 	}
 	// 记录一下最近没有参与 merge 的文件 ID
 	nonMergedFid := db.activeFile.FileId
-	// 取出所有需要 merge 的文件
-	var mergeFiles []*data.DataFile
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
-	}
+	maxSeq := atomic.LoadUint64(&db.nextBTSN)
 	db.mu.Unlock() // 之后的操作对需要进行 merge 的文件不产生影响，所以可以把锁释放掉
 
-	// 待 merge 的文件从小到大进行排序，依次 merge
-	sort.Slice(mergeFiles, func(i, j int) bool {
-		return mergeFiles[i].FileId < mergeFiles[j].FileId
-	})
+	mergedFids := make(map[uint32]struct{}, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		mergedFids[dataFile.FileId] = struct{}{}
+	}
 
 	mergeDir := db.getMergeDir()
 	// 如果目录已经存在，说明发生过 merge，需要清理掉
@@ -74,23 +119,45 @@ func (db *DB) Merge() error {
 	if err := os.MkdirAll(mergeDir, os.ModePerm); err != nil {
 		return err
 	}
-	// 打开一个新的临时的 DB 实例
+	// 打开一个新的临时的 DB 实例，它只用于追加写入数据，因此使用内存索引即可
 	mergeOptions := db.options
 	mergeOptions.DataDir = mergeDir
 	mergeOptions.SyncEveryWrite = false
+	mergeOptions.IndexType = int8(index.BTreeIndexer)
+	mergeOptions.AutoMergeInterval = 0
+	mergeOptions.CacheSize = 0
 	mergeDb, err := Open(mergeOptions)
 	if err != nil {
 		return err
 	}
+	// merge 生成的文件通过 Hint 文件加载索引，临时的 DB 实例也不需要保存索引快照
+	mergeDb.noFileHints = true
+	mergeDb.noIndexSnapshot = true
+	mergeDbClosed := false
+	defer func() {
+		if !mergeDbClosed {
+			_ = mergeDb.Close()
+		}
+	}()
+	// 限制 merge 的读写速度，避免影响前台的读写
+	limiter := utils.NewRateLimiter(db.options.MergeBytesPerSecond)
 	// 打开 Hint 文件来存储索引
 	hintFile, err := data.OpenHintFile(mergeDir)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
+	hintFile.Cipher = mergeDb.cipher
+	// 记录已经过期的 key，merge 结果生效时需要将它们从索引中移除
+	var expiredRecords []*data.LogRecord
 	// 遍历处理每个数据文件
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
 		for {
+			// 数据库正在关闭，则中止本次 merge，未完成的 merge 目录会在下次启动时被清理掉
+			if atomic.LoadInt32(&db.closing) == 1 {
+				return ErrorDatabaseClosing
+			}
 			record, recordSize, err := dataFile.ReadLogRecord(offset)
 			if err != nil {
 				if err == io.EOF {
@@ -98,17 +165,43 @@ func (db *DB) Merge() error {
 				}
 				return err
 			}
-			recordPos := db.index.Get(record.Key)
+			limiter.Wait(recordSize)
+			// 已经被删除的列族中的记录都是无效数据
+			var recordPos *data.LogRecordPos
+			if idx, ok := indexes[record.Family]; ok {
+				recordPos = idx.Get(record.Key)
+			}
 			// 将 record 的位置与 index 中存储的 recordPos 进行比较，如果有效（两者相等）则重写入 mergeDb 中
 			if recordPos != nil && recordPos.Fid == dataFile.FileId && recordPos.Offset == offset {
-				record.Type = data.LogRecordNormal
+				// 已经过期的数据不需要再重写
+				if record.IsExpired() {
+					expiredRecords = append(expiredRecords, record)
+					offset += recordSize
+					continue
+				}
+				// 合并操作数与链上的旧值折叠成一条普通记录
+				if record.Type == data.LogRecordMergeOperand {
+					db.mu.RLock()
+					record.Value, err = db.readValue(recordPos)
+					db.mu.RUnlock()
+					if err != nil {
+						return err
+					}
+					record.Type = data.LogRecordNormal
+				}
+				record.Seq = record.Sequence()
 				record.Btsn = data.NoTxnBTSN
 				pos, err := mergeDb.appendLogRecord(record)
 				if err != nil {
 					return err
 				}
-				// 将当前位置索引写到 Hint 文件中
-				if err = hintFile.WriteHintRecord(record.Key, pos); err != nil {
+				// 将当前位置索引写到 Hint 文件中，文件 ID 为 merge 结果生效之后的 ID
+				pos.Fid += mergeBaseFid
+				if pos.Fid >= nonMergedFid {
+					db.mergeFidShift++
+					return ErrorMergeFileIdExhausted
+				}
+				if err = hintFile.WriteHintRecord(record.Family, record.Key, pos); err != nil {
 					return err
 				}
 			}
@@ -116,6 +209,13 @@ func (db *DB) Merge() error {
 			offset += recordSize
 		}
 	}
+	// 增量 merge 时，没有参与 merge 的旧文件在启动时不会被重放，因此它们的索引也需要写入 Hint 文件中
+	var collapsed map[string]*data.LogRecordPos
+	if !fullMerge {
+		if collapsed, err = db.writeUnmergedHintRecords(hintFile, mergeDb, indexes, mergedFids, mergeBaseFid, nonMergedFid); err != nil {
+			return err
+		}
+	}
 	// sync Hint 文件
 	if err := hintFile.Sync(); err != nil {
 		return err
@@ -123,30 +223,288 @@ func (db *DB) Merge() error {
 	if err := mergeDb.Sync(); err != nil {
 		return err
 	}
-	// 写标识 merge 结束的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergeDir)
-	if err != nil {
+	mergeDbClosed = true
+	if err := mergeDb.Close(); err != nil {
 		return err
 	}
-	mergeFinRecordValue := make([]byte, 4)
-	binary.BigEndian.PutUint32(mergeFinRecordValue, nonMergedFid)
-	mergeFinRecord := data.LogRecord{ // 用于记录本次 merge 的结束位置
-		Key:   []byte(mergeFinRecordKey),
-		Value: mergeFinRecordValue,
-		Type:  data.LogRecordNormal,
-		Btsn:  data.NoTxnBTSN,
+	// 写标识 merge 结束的文件
+	info := &mergeFinishedInfo{
+		nonMergeFid:  nonMergedFid,
+		mergeBaseFid: mergeBaseFid,
+		maxSeq:       maxSeq,
 	}
-	encodedMergeFinRecord, _ := data.EncodeLogRecord(&mergeFinRecord)
-	if err := mergeFinishedFile.Write(encodedMergeFinRecord); err != nil {
+	for _, dataFile := range mergeFiles {
+		info.mergedFids = append(info.mergedFids, dataFile.FileId)
+	}
+	if err := writeMergeFinishedFile(mergeDir, info); err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+
+	// 在线让 merge 的结果生效
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.installMergeFiles(info, expiredRecords, collapsed); err != nil {
 		return err
 	}
+	atomic.AddUint64(&db.mergeCount, 1)
+	atomic.StoreInt64(&db.lastMergeTime, time.Now().UnixNano())
+	return nil
+}
+
+// 选出需要 merge 的文件（包括当前的活跃文件），按照文件 ID 升序排列
+// 全量 merge 选出所有文件；增量 merge 按照无效数据比例从高到低选择，直到达到字节数上限
+// 访问这个方法前必须加锁
+func (db *DB) pickMergeFiles(options MergeOptions) ([]*data.DataFile, error) {
+	files := make([]*data.DataFile, 0, len(db.olderFiles)+1)
+	for _, dataFile := range db.olderFiles {
+		files = append(files, dataFile)
+	}
+	files = append(files, db.activeFile)
+
+	if options.Incremental {
+		stats := make(map[uint32]FileStat, len(files))
+		var candidates []*data.DataFile
+		for _, dataFile := range files {
+			size, err := dataFile.IoManger.Size()
+			if err != nil {
+				return nil, err
+			}
+			stat := db.fileStat(dataFile.FileId, size)
+			if stat.GarbageRatio > 0 && stat.GarbageRatio >= options.MinGarbageRatio {
+				stats[dataFile.FileId] = stat
+				candidates = append(candidates, dataFile)
+			}
+		}
+		// 无效数据比例越高，merge 的收益越大
+		sort.Slice(candidates, func(i, j int) bool {
+			return stats[candidates[i].FileId].GarbageRatio > stats[candidates[j].FileId].GarbageRatio
+		})
+		files = files[:0]
+		var totalSize uint64
+		for _, dataFile := range candidates {
+			size := uint64(stats[dataFile.FileId].Size)
+			if options.MaxMergeBytes > 0 && totalSize+size > options.MaxMergeBytes {
+				continue
+			}
+			totalSize += size
+			files = append(files, dataFile)
+		}
+	}
+
+	// 待 merge 的文件从小到大进行排序，依次 merge
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	return files, nil
+}
+
+// 计算需要为 merge 生成的文件预留的文件 ID 数量
+// 重写之后的记录可能比原来的更大（合并操作数折叠成完整的值），每个文件的末尾也可能留有放不下下一条记录的空间，
+// 因此按照参与 merge 的数据量预留两倍的余量；预留的 ID 仍然不够时本次 merge 失败，之后的 merge 会将余量翻倍
+func (db *DB) mergeFileIdReserve(mergeFiles []*data.DataFile) (uint32, error) {
+	var totalSize int64
+	for _, dataFile := range mergeFiles {
+		size, err := dataFile.IoManger.Size()
+		if err != nil {
+			return 0, err
+		}
+		totalSize += size
+	}
+	reserved := uint64(totalSize/db.options.MaxFileSize) + uint64(len(mergeFiles))
+	reserved = reserved*2<<min(db.mergeFidShift, maxMergeFidShift) + 1
+	return uint32(min(reserved, math.MaxUint32/2)), nil
+}
 
+// 将没有参与 merge 的旧文件中的有效索引写入 Hint 文件
+// 操作数链指向参与 merge 的文件时，链上的记录会随着旧文件一起被删除，因此需要将它折叠之后写入 mergeDb，
+// 返回这些 key 以及折叠之前的位置
+func (db *DB) writeUnmergedHintRecords(hintFile *data.DataFile, mergeDb *DB, indexes map[uint32]index.Indexer,
+	mergedFids map[uint32]struct{}, mergeBaseFid, nonMergedFid uint32) (map[string]*data.LogRecordPos, error) {
+	collapsed := make(map[string]*data.LogRecordPos)
+	for family, idx := range indexes {
+		if err := db.writeUnmergedFamilyHintRecords(hintFile, mergeDb, family, idx, mergedFids, mergeBaseFid, nonMergedFid, collapsed); err != nil {
+			return nil, err
+		}
+	}
+	return collapsed, nil
+}
+
+func (db *DB) writeUnmergedFamilyHintRecords(hintFile *data.DataFile, mergeDb *DB, family uint32, idx index.Indexer,
+	mergedFids map[uint32]struct{}, mergeBaseFid, nonMergedFid uint32, collapsed map[string]*data.LogRecordPos) error {
+	iter := idx.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		pos := iter.Value()
+		if pos.Fid >= nonMergedFid || pos.IsExpired() {
+			continue
+		}
+		if _, ok := mergedFids[pos.Fid]; ok {
+			continue
+		}
+		// 只有默认列族支持合并操作数
+		if pos.Chain > 0 && family == defaultFamilyId {
+			db.mu.RLock()
+			touches, err := db.chainTouches(pos, mergedFids)
+			var value []byte
+			var head *data.LogRecord
+			if err == nil && touches {
+				value, err = db.readValue(pos)
+			}
+			if err == nil && touches {
+				head, err = db.readLogRecord(pos)
+			}
+			db.mu.RUnlock()
+			if err != nil {
+				return err
+			}
+			if touches {
+				// 折叠之后的记录沿用链头操作数的序列号，保证 ChangesSince 和 WatchFrom 依然能读到它
+				record := &data.LogRecord{Key: iter.Key(), Value: value, Type: data.LogRecordNormal, Btsn: data.NoTxnBTSN, Seq: head.Sequence(), Expire: pos.Expire}
+				newPos, err := mergeDb.appendLogRecord(record)
+				if err != nil {
+					return err
+				}
+				newPos.Fid += mergeBaseFid
+				if newPos.Fid >= nonMergedFid {
+					db.mergeFidShift++
+					return ErrorMergeFileIdExhausted
+				}
+				collapsed[string(iter.Key())] = pos
+				pos = newPos
+			}
+		}
+		if err := hintFile.WriteHintRecord(family, iter.Key(), pos); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// 将 merge 目录中的文件移动到数据目录中，并让索引指向 merge 之后的位置，然后淘汰掉参与 merge 的旧文件
+// 访问这个方法前必须加锁
+func (db *DB) installMergeFiles(info *mergeFinishedInfo, expiredRecords []*data.LogRecord, collapsed map[string]*data.LogRecordPos) error {
+	mergedFids := make(map[uint32]struct{}, len(info.mergedFids))
+	for _, fid := range info.mergedFids {
+		mergedFids[fid] = struct{}{}
+	}
+	// 在旧文件被删除之前折叠 merge 期间追加的操作数链
+	if err := db.collapseMergeOperands(mergedFids); err != nil {
+		return err
+	}
+	mergePath := db.getMergeDir()
+	newFids, err := db.moveMergeFiles(mergePath, info.mergeBaseFid)
+	if err != nil {
+		return err
+	}
+	// 打开 merge 生成的数据文件
+	newFiles := make([]*data.DataFile, 0, len(newFids))
+	for _, fid := range newFids {
+		dataFile, err := data.OpenDataFile(db.options.DataDir, fid, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		dataFile.Cipher = db.cipher
+		db.olderFiles[fid] = dataFile
+		db.trackFileSeq(fid, info.maxSeq)
+		newFiles = append(newFiles, dataFile)
+	}
+	// 根据 Hint 文件更新索引，只有索引仍然指向参与 merge 的旧文件时才需要更新，否则说明 merge 期间这个 key 被重新写入或删除了
+	if err := db.foreachHintRecord(func(family uint32, key []byte, pos *data.LogRecordPos) {
+		idx := db.familyIndex(family)
+		if idx == nil {
+			return // merge 期间列族被删除了
+		}
+		curPos := idx.Get(key)
+		if curPos == nil {
+			return
+		}
+		_, ok := mergedFids[curPos.Fid]
+		// 被折叠的操作数链只有在 merge 期间没有被修改过时才需要更新
+		if headPos, collapsedOk := collapsed[string(key)]; collapsedOk && family == defaultFamilyId {
+			ok = headPos.Fid == curPos.Fid && headPos.Offset == curPos.Offset
+		}
+		if ok {
+			idx.Put(key, pos)
+			db.markLive(pos)
+		}
+	}); err != nil {
+		return err
+	}
+	for _, record := range expiredRecords {
+		idx := db.familyIndex(record.Family)
+		if idx == nil {
+			continue
+		}
+		curPos := idx.Get(record.Key)
+		if curPos == nil {
+			continue
+		}
+		if _, ok := mergedFids[curPos.Fid]; ok {
+			idx.Delete(record.Key)
+		}
+	}
+	// 淘汰参与 merge 的旧文件，并更新可回收的数据量：减去旧文件中的无效数据，加上 merge 期间新文件中产生的无效数据
+	reclaimSize := atomic.LoadUint64(&db.reclaimSize)
+	var obsoleteFiles []*data.DataFile
+	for fid := range mergedFids {
+		dataFile, ok := db.olderFiles[fid]
+		if !ok {
+			continue
+		}
+		if size, err := dataFile.IoManger.Size(); err == nil && uint64(size) > db.fileLiveSizes[fid] {
+			reclaimSize -= min(reclaimSize, uint64(size)-db.fileLiveSizes[fid])
+		}
+		obsoleteFiles = append(obsoleteFiles, dataFile)
+		delete(db.olderFiles, fid)
+		delete(db.fileLiveSizes, fid)
+		delete(db.fileMaxSeqs, fid)
+	}
+	for _, dataFile := range newFiles {
+		if size, err := dataFile.IoManger.Size(); err == nil && uint64(size) > db.fileLiveSizes[dataFile.FileId] {
+			reclaimSize += uint64(size) - db.fileLiveSizes[dataFile.FileId]
+		}
+	}
+	atomic.StoreUint64(&db.reclaimSize, reclaimSize)
+	db.retireDataFiles(obsoleteFiles)
+	return os.RemoveAll(mergePath)
+}
+
+// 淘汰不再使用的数据文件
+// 如果还有活跃的快照、事务或迭代器，它们可能还在引用这些文件，因此需要等它们全部释放之后才能删除
+// 访问这个方法前必须加锁
+func (db *DB) retireDataFiles(files []*data.DataFile) {
+	if len(files) == 0 {
+		return
+	}
+	for _, dataFile := range files {
+		db.retiredFiles[dataFile.FileId] = dataFile
+		db.cache.removeFile(dataFile.FileId)
+	}
+	deferred := db.versions.deferUntilReleased(func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.removeRetiredFiles(files)
+	})
+	if !deferred {
+		db.removeRetiredFiles(files)
+	}
+}
+
+// 关闭并删除已经淘汰的数据文件
+// 访问这个方法前必须加锁
+func (db *DB) removeRetiredFiles(files []*data.DataFile) {
+	for _, dataFile := range files {
+		if _, ok := db.retiredFiles[dataFile.FileId]; !ok {
+			continue // 已经在 Close 时被处理过了
+		}
+		delete(db.retiredFiles, dataFile.FileId)
+		db.cache.removeFile(dataFile.FileId)
+		_ = dataFile.Close()
+		_ = os.Remove(data.GetFileHintPath(db.options.DataDir, dataFile.FileId))
+		_ = os.Remove(data.GetDataFilePath(db.options.DataDir, dataFile.FileId))
+	}
+}
+
 // 获取用于存放 merge 文件的目录
 // example:
 //   - DatDir: /user/home/fairy-kvdb
@@ -157,75 +515,175 @@ func (db *DB) getMergeDir() string {
 
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergeDir()
-	// 检查 merge 目录是否存在，不存在的话直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	// 检查 merge 目录是否存在，存在并且 merge 已经处理完成的话，需要将 merge 的结果移动到数据目录中
+	if _, err := os.Stat(mergePath); err == nil {
+		if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err == nil {
+			info, err := readMergeFinishedFile(mergePath)
+			if err != nil {
+				return err
+			}
+			if _, err := db.moveMergeFiles(mergePath, info.mergeBaseFid); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(mergePath); err != nil {
+			return err
+		}
+	}
+	// 删除旧的数据文件（也就是已经 merge 过的数据文件）
+	return db.removeMergedDataFiles()
+}
+
+// 删除数据目录中已经参与过 merge 的旧数据文件
+func (db *DB) removeMergedDataFiles() error {
+	if _, err := os.Stat(filepath.Join(db.options.DataDir, data.MergeFinishedFileName)); os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
-	dirEntries, err := os.ReadDir(mergePath)
+	info, err := readMergeFinishedFile(db.options.DataDir)
 	if err != nil {
 		return err
 	}
-	// 查找用于标识 merge 结束的文件，判断 merge 是否已经处理完成了
-	mergeFinished := false
-	var mergeFileNames []string
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
-		}
-		if entry.Name() == data.BtsnFileName {
-			continue // BTSN 文件不需要在 merge 时进行移动，它只在 Close 时保存才有意义
-		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
+	mergedFids := make(map[uint32]struct{}, len(info.mergedFids))
+	for _, fid := range info.mergedFids {
+		mergedFids[fid] = struct{}{}
 	}
-	// 没有 merge 完成则直接返回
-	if !mergeFinished {
-		return nil
-	}
-	// 获取最近没有参与 merge 的文件 ID
-	nonMergeFileId, err := db.getNonMergeFileId(mergePath)
+	dirEntries, err := os.ReadDir(db.options.DataDir)
 	if err != nil {
 		return err
 	}
-	// 删除旧的数据文件（也就是已经 merge 过的数据文件）
-	for fileId := uint32(0); fileId < nonMergeFileId; fileId++ {
-		filePath := data.GetDataFilePath(mergePath, fileId)
-		if _, err := os.Stat(filePath); err == nil {
-			if err := os.Remove(filePath); err != nil {
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.NameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+		if err != nil {
+			return ErrorDataFileCorrupt
+		}
+		_, merged := mergedFids[uint32(fileId)]
+		if len(info.mergedFids) == 0 { // 旧版本的 merge 总是处理所有旧文件
+			merged = uint32(fileId) < info.mergeBaseFid
+		}
+		if merged {
+			if err := os.Remove(data.GetFileHintPath(db.options.DataDir, uint32(fileId))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Remove(filepath.Join(db.options.DataDir, entry.Name())); err != nil {
 				return err
 			}
 		}
 	}
-	// 将新的数据文件移动到数据目录中（也就是将 merge 目录下的数据文件重命名到数据目录下）
-	for _, filename := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, filename)          // merge 目录下的数据文件
-		dstPath := filepath.Join(db.options.DataDir, filename) // 数据目录下的数据文件
+	return nil
+}
+
+// 将 merge 目录下的文件重命名到数据目录下，数据文件的 ID 需要加上 mergeBaseFid，返回移动后的数据文件 ID
+// merge 结束标志文件最后移动，保证中途崩溃时下次启动依然能够识别出未完成移动的 merge 目录
+func (db *DB) moveMergeFiles(mergePath string, mergeBaseFid uint32) ([]uint32, error) {
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []uint32
+	for _, entry := range dirEntries {
+		filename := entry.Name()
+		if filename == data.BtsnFileName || filename == fileLockName || filename == data.MergeFinishedFileName || filename == data.IndexSnapshotFileName {
+			continue // BTSN 文件不需要在 merge 时进行移动，它只在 Close 时保存才有意义
+		}
+		srcPath := filepath.Join(mergePath, filename)          // merge 目录下的文件
+		dstPath := filepath.Join(db.options.DataDir, filename) // 数据目录下的文件
+		if strings.HasSuffix(filename, data.NameSuffix) {
+			fileId, err := strconv.Atoi(strings.Split(filename, ".")[0])
+			if err != nil {
+				return nil, ErrorDataFileCorrupt
+			}
+			fid := uint32(fileId) + mergeBaseFid
+			dstPath = data.GetDataFilePath(db.options.DataDir, fid)
+			fileIds = append(fileIds, fid)
+		}
 		if err := os.Rename(srcPath, dstPath); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	srcPath := filepath.Join(mergePath, data.MergeFinishedFileName)
+	dstPath := filepath.Join(db.options.DataDir, data.MergeFinishedFileName)
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return nil, err
+	}
+	return fileIds, nil
 }
 
-// 获取 merge 完成文件中记录的最近没有参与 merge 的文件 ID
-func (db *DB) getNonMergeFileId(mergeDir string) (uint32, error) {
-	mergeFinFile, err := data.OpenMergeFinishedFile(mergeDir)
+// 写 merge 完成标志文件
+// value: nonMergeFid (4 bytes) | mergeBaseFid (4 bytes) | mergedFids (4 bytes * n)
+func writeMergeFinishedFile(dirPath string, info *mergeFinishedInfo) error {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer mergeFinishedFile.Close()
+	mergeFinRecordValue := make([]byte, 8+4*len(info.mergedFids))
+	binary.BigEndian.PutUint32(mergeFinRecordValue[:4], info.nonMergeFid)
+	binary.BigEndian.PutUint32(mergeFinRecordValue[4:8], info.mergeBaseFid)
+	for i, fid := range info.mergedFids {
+		binary.BigEndian.PutUint32(mergeFinRecordValue[8+4*i:], fid)
+	}
+	mergeFinRecord := data.LogRecord{ // 用于记录本次 merge 的结束位置
+		Key:   []byte(mergeFinRecordKey),
+		Value: mergeFinRecordValue,
+		Type:  data.LogRecordNormal,
+		Btsn:  data.NoTxnBTSN,
+		Seq:   info.maxSeq,
+	}
+	encodedMergeFinRecord, _ := data.EncodeLogRecord(&mergeFinRecord)
+	if err := mergeFinishedFile.Write(encodedMergeFinRecord); err != nil {
+		return err
+	}
+	return mergeFinishedFile.Sync()
+}
+
+// 读取 merge 完成标志文件
+func readMergeFinishedFile(dirPath string) (*mergeFinishedInfo, error) {
+	mergeFinFile, err := data.OpenMergeFinishedFile(dirPath)
+	if err != nil {
+		return nil, err
 	}
 	defer mergeFinFile.Close()
 	mergeFinRecord, _, err := mergeFinFile.ReadLogRecord(0)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if len(mergeFinRecord.Value) < 4 {
+		return nil, ErrorDataFileCorrupt
+	}
+	info := decodeMergeFinishedInfo(mergeFinRecord.Value)
+	info.maxSeq = mergeFinRecord.Seq
+	return info, nil
+}
+
+func decodeMergeFinishedInfo(value []byte) *mergeFinishedInfo {
+	info := &mergeFinishedInfo{
+		nonMergeFid: binary.BigEndian.Uint32(value[:4]),
 	}
-	nonMergeFid := binary.BigEndian.Uint32(mergeFinRecord.Value)
-	return nonMergeFid, nil
+	if len(value) >= 8 {
+		info.mergeBaseFid = binary.BigEndian.Uint32(value[4:8])
+	}
+	for idx := 8; idx+4 <= len(value); idx += 4 {
+		info.mergedFids = append(info.mergedFids, binary.BigEndian.Uint32(value[idx:idx+4]))
+	}
+	return info
 }
 
 // 从 Hint 文件中加载索引
 func (db *DB) loadIndexFromHintFile() error {
+	return db.foreachHintRecord(func(family uint32, key []byte, pos *data.LogRecordPos) {
+		idx := db.familyIndex(family)
+		if idx != nil && !pos.IsExpired() {
+			idx.Put(key, pos)
+			db.markLive(pos)
+		}
+	})
+}
+
+// 遍历数据目录下 Hint 文件中的所有索引记录
+func (db *DB) foreachHintRecord(fn func(family uint32, key []byte, pos *data.LogRecordPos)) error {
 	// 检查 Hint 索引文件是否存在
 	hintFileName := filepath.Join(db.options.DataDir, data.HintFileName)
 	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
@@ -236,6 +694,8 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
+	hintFile.Cipher = db.cipher
 	// 从 Hint 文件中读取索引
 	var offset int64 = 0
 	for {
@@ -247,8 +707,7 @@ func (db *DB) loadIndexFromHintFile() error {
 			return err
 		}
 		// 解码拿到实际的位置索引
-		pos := data.DecodeLogRecordPos(record.Value)
-		db.index.Put(record.Key, pos)
+		fn(record.Family, record.Key, data.DecodeLogRecordPos(record.Value))
 		offset += recordSize
 	}
 	return nil
@@ -0,0 +1,165 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"sync/atomic"
+)
+
+// MergeOperator 合并操作符，用于将 MergeValue 写入的操作数与已有的值合并
+// 写入操作数时不需要读取旧值，读取或者 merge 时才会将操作数按照写入顺序折叠到旧值上
+type MergeOperator interface {
+	// FullMerge 将操作数按照写入顺序依次合并到 existing 上，key 不存在时 existing 为 nil
+	FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// MergeValue 为 key 追加一个合并操作数，读取时由 Options.MergeOperator 将其与已有的值合并
+// 操作数会继承已有值的过期时间
+func (db *DB) MergeValue(key []byte, operand []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	if db.options.MergeOperator == nil {
+		return ErrorMergeOperatorMissing
+	}
+	return db.write(db.options.SyncEveryWrite, func() error {
+		prev := db.index.Get(key)
+		if prev != nil && prev.IsExpired() {
+			prev = nil
+		}
+		record := &data.LogRecord{
+			Key:   key,
+			Value: data.EncodeMergeOperand(prev, operand),
+			Type:  data.LogRecordMergeOperand,
+			Btsn:  data.NoTxnBTSN,
+		}
+		if prev != nil {
+			record.Expire = prev.Expire
+		}
+		record.Seq = db.FetchNextBTSN()
+		pos, err := db.appendLogRecord(record)
+		if err != nil {
+			return err
+		}
+		db.notifyWatchers(record)
+		pos.Chain = 1
+		if prev != nil {
+			pos.Chain = prev.Chain + 1
+		}
+		db.updateIndex(record, pos, record.Seq)
+		// merge 期间追加的操作数可能指向参与 merge 的旧文件，merge 结果生效时需要将它们折叠
+		if atomic.LoadInt32(&db.isMerging) == 1 {
+			db.mergeOperandKeys[string(key)] = struct{}{}
+		}
+		return nil
+	})
+}
+
+// 读取位置上的数据，如果是合并操作数，则沿着操作数链找到基础值并进行合并
+// 访问这个方法前必须加锁
+func (db *DB) readValue(pos *data.LogRecordPos) ([]byte, error) {
+	record, err := db.readLogRecord(pos)
+	if err != nil {
+		return nil, err
+	}
+	if record.Type == data.LogRecordBlob {
+		return db.readBlob(record)
+	}
+	if record.Type != data.LogRecordMergeOperand {
+		return record.Value, nil
+	}
+	if db.options.MergeOperator == nil {
+		return nil, ErrorMergeOperatorMissing
+	}
+	key := record.Key
+	var existing []byte
+	var operands [][]byte
+	for {
+		prev, operand, ok := data.DecodeMergeOperand(record.Value)
+		if !ok {
+			return nil, ErrorMergeOperandCorrupt
+		}
+		operands = append(operands, operand)
+		if prev == nil {
+			break
+		}
+		if record, err = db.readLogRecord(prev); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(record.Key, key) {
+			return nil, ErrorMergeOperandCorrupt
+		}
+		if record.Type == data.LogRecordBlob {
+			if existing, err = db.readBlob(record); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if record.Type != data.LogRecordMergeOperand {
+			existing = record.Value
+			break
+		}
+	}
+	// 操作数是从新到旧收集的，需要反转成写入顺序
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return db.options.MergeOperator.FullMerge(key, existing, operands)
+}
+
+// 判断操作数链上是否有记录位于指定的文件中
+// 访问这个方法前必须加锁
+func (db *DB) chainTouches(pos *data.LogRecordPos, fids map[uint32]struct{}) (bool, error) {
+	for pos != nil {
+		if _, ok := fids[pos.Fid]; ok {
+			return true, nil
+		}
+		if pos.Chain == 0 {
+			return false, nil
+		}
+		record, err := db.readLogRecord(pos)
+		if err != nil {
+			return false, err
+		}
+		prev, _, ok := data.DecodeMergeOperand(record.Value)
+		if !ok {
+			return false, ErrorMergeOperandCorrupt
+		}
+		pos = prev
+	}
+	return false, nil
+}
+
+// 将 merge 期间追加了操作数、并且操作数链指向参与 merge 的旧文件的 key 折叠成一条普通记录
+// 访问这个方法前必须加锁
+func (db *DB) collapseMergeOperands(mergedFids map[uint32]struct{}) error {
+	collapsed := false
+	for key := range db.mergeOperandKeys {
+		pos := db.index.Get([]byte(key))
+		if pos == nil || pos.Chain == 0 || pos.IsExpired() {
+			continue
+		}
+		touches, err := db.chainTouches(pos, mergedFids)
+		if err != nil {
+			return err
+		}
+		if !touches {
+			continue
+		}
+		value, err := db.readValue(pos)
+		if err != nil {
+			return err
+		}
+		record := &data.LogRecord{Key: []byte(key), Value: value, Type: data.LogRecordNormal, Expire: pos.Expire}
+		if err := db.appendAndIndex(record); err != nil {
+			return err
+		}
+		collapsed = true
+	}
+	db.mergeOperandKeys = make(map[string]struct{})
+	// 旧文件被删除之前，折叠之后的记录必须已经持久化
+	if collapsed {
+		return db.activeFile.Sync()
+	}
+	return nil
+}
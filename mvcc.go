@@ -0,0 +1,220 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"sort"
+	"sync"
+)
+
+// versionTracker 多版本控制
+// 索引中只保存每个 key 最新的位置，当存在活跃的读视图（事务）时，被覆盖的旧位置会保留在 history 中，
+// 读视图根据自己的 readTs 沿着 history 回溯，就能得到某个时间点上的数据
+type versionTracker struct {
+	mu       *sync.Mutex
+	readers  map[uint64]int          // 活跃的读视图：readTs -> 引用计数
+	epochs   map[uint64]int          // 活跃的读视图注册时所在的纪元 -> 引用计数
+	epoch    uint64                  // 当前的纪元，每推迟一个操作就加 1，之后注册的读视图不需要等待这个操作
+	history  map[string][]keyVersion // key -> 被覆盖的旧版本，按 commitTs 递增排列
+	deferred []deferredFunc          // 等到之前注册的读视图都释放之后才能执行的操作，比如删除已经被 merge 的数据文件
+}
+
+// deferredFunc 被推迟执行的操作，纪元不大于 epoch 的读视图全部释放之后才能执行
+type deferredFunc struct {
+	epoch uint64
+	fn    func()
+}
+
+// keyVersion key 的一个旧版本
+type keyVersion struct {
+	commitTs uint64             // 覆盖这个版本的写操作的序列号
+	pos      *data.LogRecordPos // 被覆盖之前的位置，nil 表示之前不存在
+}
+
+// snapshotItem 读视图在遍历时看到的一条数据
+type snapshotItem struct {
+	key   []byte
+	pos   *data.LogRecordPos // 数据在磁盘上的位置
+	value []byte             // 尚未提交的写入直接保存 value，此时 pos 为 nil
+}
+
+func newVersionTracker() *versionTracker {
+	return &versionTracker{
+		mu:      new(sync.Mutex),
+		readers: make(map[uint64]int),
+		epochs:  make(map[uint64]int),
+		history: make(map[string][]keyVersion),
+	}
+}
+
+// 注册一个读视图，返回它所在的纪元，释放时需要一起传入
+func (vt *versionTracker) acquire(readTs uint64) uint64 {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	vt.readers[readTs]++
+	vt.epochs[vt.epoch]++
+	return vt.epoch
+}
+
+// 释放一个读视图，执行不再需要等待的操作，并清理掉不再被任何读视图需要的旧版本
+func (vt *versionTracker) release(readTs, epoch uint64) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	if vt.readers[readTs]--; vt.readers[readTs] <= 0 {
+		delete(vt.readers, readTs)
+	}
+	if vt.epochs[epoch]--; vt.epochs[epoch] <= 0 {
+		delete(vt.epochs, epoch)
+	}
+	if ready := vt.takeReadyLocked(); len(ready) > 0 {
+		// 释放锁之后再执行，避免与 db.mu 产生死锁
+		vt.mu.Unlock()
+		for _, fn := range ready {
+			fn()
+		}
+		vt.mu.Lock()
+	}
+	if len(vt.readers) == 0 {
+		vt.history = make(map[string][]keyVersion)
+		return
+	}
+	// 只有 commitTs 大于最小 readTs 的旧版本还可能被读到
+	minTs := vt.minReadTs()
+	for key, versions := range vt.history {
+		idx := sort.Search(len(versions), func(i int) bool {
+			return versions[i].commitTs > minTs
+		})
+		if idx == len(versions) {
+			delete(vt.history, key)
+		} else if idx > 0 {
+			vt.history[key] = versions[idx:]
+		}
+	}
+}
+
+// 如果当前存在活跃的读视图，则将 fn 推迟到它们全部释放之后执行并返回 true，否则返回 false，由调用方立即执行
+// 之后注册的读视图看不到 fn 要清理的数据，因此不需要等待它们
+func (vt *versionTracker) deferUntilReleased(fn func()) bool {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	if len(vt.readers) == 0 {
+		return false
+	}
+	vt.deferred = append(vt.deferred, deferredFunc{epoch: vt.epoch, fn: fn})
+	vt.epoch++
+	return true
+}
+
+// 取出所有需要等待的读视图都已经释放的操作
+func (vt *versionTracker) takeReadyLocked() []func() {
+	first, minEpoch := true, uint64(0)
+	for epoch := range vt.epochs {
+		if first || epoch < minEpoch {
+			first, minEpoch = false, epoch
+		}
+	}
+	var ready []func()
+	n := 0
+	for _, deferred := range vt.deferred {
+		if first || deferred.epoch < minEpoch {
+			ready = append(ready, deferred.fn)
+		} else {
+			vt.deferred[n] = deferred
+			n++
+		}
+	}
+	vt.deferred = vt.deferred[:n]
+	return ready
+}
+
+// 记录一次覆盖写，只有存在活跃的读视图时才需要保留旧版本
+// 调用方需要持有 db.mu 的写锁
+func (vt *versionTracker) record(key []byte, commitTs uint64, oldPos *data.LogRecordPos) {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	if len(vt.readers) == 0 {
+		return
+	}
+	k := string(key)
+	vt.history[k] = append(vt.history[k], keyVersion{commitTs: commitTs, pos: oldPos})
+}
+
+// 根据 key 的最新位置，找出在 readTs 时刻可见的位置
+func (vt *versionTracker) resolve(key []byte, readTs uint64, latest *data.LogRecordPos) *data.LogRecordPos {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	return vt.resolveLocked(string(key), readTs, latest)
+}
+
+func (vt *versionTracker) resolveLocked(key string, readTs uint64, latest *data.LogRecordPos) *data.LogRecordPos {
+	pos := latest
+	versions := vt.history[key]
+	for i := len(versions) - 1; i >= 0 && versions[i].commitTs > readTs; i-- {
+		pos = versions[i].pos
+	}
+	return pos
+}
+
+// 判断 key 在 readTs 之后是否被修改过
+func (vt *versionTracker) changedSince(key []byte, readTs uint64) bool {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	versions := vt.history[string(key)]
+	return len(versions) > 0 && versions[len(versions)-1].commitTs > readTs
+}
+
+// 返回活跃的读视图的数量
+func (vt *versionTracker) activeReaders() int {
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	count := 0
+	for _, n := range vt.readers {
+		count += n
+	}
+	return count
+}
+
+func (vt *versionTracker) minReadTs() uint64 {
+	first, minTs := true, uint64(0)
+	for ts := range vt.readers {
+		if first || ts < minTs {
+			first, minTs = false, ts
+		}
+	}
+	return minTs
+}
+
+// 获取 readTs 时刻 [lower, upper) 范围内的数据，结果按照 key 升序排列
+// 调用方需要持有 db.mu 的读锁
+func (db *DB) snapshotItems(readTs uint64, lower, upper []byte) []*snapshotItem {
+	var items []*snapshotItem
+	seen := make(map[string]struct{})
+	vt := db.versions
+	vt.mu.Lock()
+	defer vt.mu.Unlock()
+	// 先遍历当前索引中的 key
+	iter := db.index.RangeIterator(lower, upper, false)
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		seen[string(key)] = struct{}{}
+		pos := vt.resolveLocked(string(key), readTs, iter.Value())
+		if pos != nil && !pos.IsExpired() {
+			items = append(items, &snapshotItem{key: key, pos: pos})
+		}
+	}
+	iter.Close()
+	// 再补充在 readTs 之后被删除的 key
+	for key := range vt.history {
+		if _, ok := seen[key]; ok || !inKeyRange([]byte(key), lower, upper) {
+			continue
+		}
+		pos := vt.resolveLocked(key, readTs, nil)
+		if pos != nil && !pos.IsExpired() {
+			items = append(items, &snapshotItem{key: []byte(key), pos: pos})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return bytes.Compare(items[i].key, items[j].key) < 0
+	})
+	return items
+}
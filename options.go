@@ -1,37 +1,86 @@
 package fairy_kvdb
 
 import (
+	"fairy-kvdb/data"
 	"fairy-kvdb/index"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Options struct {
-	DataDir            string                       // 数据库数据目录
-	MaxFileSize        int64                        // 数据文件最大大小
-	SyncEveryWrite     bool                         // 是否每次写入都同步
-	BytesPerSync       uint64                       // 每次累计到多少字节数才同步一次
-	IndexType          int8                         // 索引类型
-	BPlusTreeIndexOpts *index.BPlusTreeIndexOptions // 当 index 选择 B+Tree 时的配置项
-	MMapAtStartup      bool                         // 是否在启动时是否使用 mmap 来加载数据文件
-	MergeRatio         float64                      // 无效数据达到多少比例才进行 merge
+	DataDir             string                       // 数据库数据目录
+	MaxFileSize         int64                        // 数据文件最大大小
+	SyncEveryWrite      bool                         // 是否每次写入都同步
+	BytesPerSync        uint64                       // 每次累计到多少字节数才同步一次
+	IndexType           int8                         // 索引类型
+	BPlusTreeIndexOpts  *index.BPlusTreeIndexOptions // 当 index 选择 B+Tree 时的配置项
+	MMapAtStartup       bool                         // 是否在启动时是否使用 mmap 来加载数据文件
+	MergeRatio          float64                      // 无效数据达到多少比例才进行 merge
+	MergeBytesPerSecond uint64                       // merge 时每秒最多读取的字节数，0 表示不限速
+	StrictRecovery      bool                         // 启动时遇到活跃文件末尾没有写完的记录是否直接报错，默认将其截断丢弃
+	SyncInterval        time.Duration                // 后台定期持久化活跃文件的间隔，0 表示不开启
+	MergeOperator       MergeOperator                // 合并操作符，使用 MergeValue 时必须设置
+
+	Compression          data.CompressionType // value 的压缩算法，修改之后新旧格式的数据文件都可以正常读取
+	CompressionThreshold int                  // value 至少达到多少字节才会被压缩
+
+	// 加密密钥，长度必须是 16、24 或 32 字节，为空表示不加密
+	// 设置之后数据文件、Hint 文件和列族信息文件中的 key 和 value 会使用 AES-GCM 加密，大对象文件使用各自的数据密钥加密，
+	// 之前写入的未加密数据在 merge 之后才会被加密；更换密钥需要使用 Rekey
+	EncryptionKey []byte
+
+	CacheSize int64 // 读缓存的容量（字节），缓存最近读取过的记录，0 表示不开启
+
+	AutoMergeInterval       time.Duration // 后台自动 merge 的检查间隔，0 表示不开启自动 merge
+	AutoMergeMinReclaimSize uint64        // 可回收的数据量至少达到多少字节才会自动 merge
+	AutoMergeWindows        []MergeWindow // 允许自动 merge 的时间窗口，为空表示任意时间都允许
+}
+
+// MergeWindow 允许后台自动 merge 的时间窗口，以当天零点为起点的偏移量表示
+// 当 Start 大于 End 时表示跨越零点的窗口，比如 22:00 ~ 06:00
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains 判断某个时间点是否处于窗口内
+func (w MergeWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
 }
 
 type IteratorOptions struct {
 	// 遍历前缀为指定值的 key，默认为空
 	Prefix []byte
 	// 是否反向遍历，默认为 false
+	// ART 索引不支持逆序遍历，反向遍历时会在创建迭代器时取出范围内的所有 key，时间和内存开销与范围内的 key 的数量成正比，
+	// 数据量较大时应尽量通过 Prefix、LowerBound、UpperBound 缩小范围
 	Reverse bool
+	// 遍历范围的下界（包含），默认为空，表示没有下界
+	LowerBound []byte
+	// 遍历范围的上界（不包含），默认为空，表示没有上界
+	UpperBound []byte
+	// 最多遍历的 key 的数量，默认为 0，表示不限制
+	Limit int
 }
 
 var DefaultOptions = Options{
-	DataDir:            filepath.Join(os.TempDir(), "fairy-kvdb"),
-	MaxFileSize:        256 * 1024 * 1024, // 256 MB
-	SyncEveryWrite:     false,
-	IndexType:          int8(index.BTreeIndexer),
-	BPlusTreeIndexOpts: nil,
-	MMapAtStartup:      false,
-	MergeRatio:         0.4,
+	DataDir:              filepath.Join(os.TempDir(), "fairy-kvdb"),
+	MaxFileSize:          256 * 1024 * 1024, // 256 MB
+	SyncEveryWrite:       false,
+	IndexType:            int8(index.BTreeIndexer),
+	BPlusTreeIndexOpts:   nil,
+	MMapAtStartup:        false,
+	MergeRatio:           0.4,
+	StrictRecovery:       false,
+	AutoMergeInterval:    0,
+	Compression:          data.CompressionNone,
+	CompressionThreshold: 256,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -52,3 +101,37 @@ var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+
+// WriteOptions 单次写入的配置项
+type WriteOptions struct {
+	// 是否在写入之后立即持久化，并发的持久化写入会通过组提交共享同一次 sync
+	Sync bool
+
+	// 只写入数据文件而不更新索引，写入的数据在重新打开数据库、重放数据文件之后才可见
+	// 适用于批量导入等不需要立即读取的场景，重新打开数据库之前不能进行 merge
+	// B+ 树索引在启动时不会重放数据文件，因此不支持这个选项
+	DisableIndexUpdate bool
+}
+
+var DefaultWriteOptions = WriteOptions{
+	Sync:               false,
+	DisableIndexUpdate: false,
+}
+
+// MergeOptions merge 的配置项
+type MergeOptions struct {
+	// 是否进行增量 merge，也就是只对无效数据比例最高的部分文件进行 merge，默认对所有旧文件进行 merge
+	Incremental bool
+
+	// 增量 merge 时一次最多处理多少字节的数据文件，0 表示不限制
+	MaxMergeBytes uint64
+
+	// 增量 merge 时，只有无效数据比例达到该值的文件才会参与 merge
+	MinGarbageRatio float64
+}
+
+var DefaultMergeOptions = MergeOptions{
+	Incremental:     false,
+	MaxMergeBytes:   0,
+	MinGarbageRatio: 0.5,
+}
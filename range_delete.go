@@ -0,0 +1,47 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"fairy-kvdb/index"
+)
+
+// DeleteRange 删除默认列族中 [start, end) 范围内的所有 key，end 为空表示删除 start 之后的所有 key
+// 无论范围内有多少个 key，数据文件中都只会写入一条范围删除记录
+func (db *DB) DeleteRange(start, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrorInvalidRange
+	}
+	record := &data.LogRecord{Key: start, Value: end, Type: data.LogRecordRangeDelete}
+	return db.write(db.options.SyncEveryWrite, func() error {
+		return db.appendAndIndex(record)
+	})
+}
+
+// DeletePrefix 删除默认列族中所有以 prefix 开头的 key，prefix 为空表示删除所有的 key
+func (db *DB) DeletePrefix(prefix []byte) error {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// 将范围删除记录应用到索引中，范围内的旧位置都会计入可回收的空间，并为活跃的事务保留下来
+// 访问这个方法前必须加锁
+func (db *DB) deleteIndexRange(idx index.Indexer, record *data.LogRecord, commitTs uint64) {
+	idx.DeleteRange(record.Key, record.Value, func(key []byte, pos *data.LogRecordPos) {
+		db.markDead(pos)
+		if record.Family == defaultFamilyId {
+			db.versions.record(key, commitTs, pos)
+		}
+	})
+}
+
+// 返回大于所有以 prefix 开头的 key 的最小 key，prefix 为空或者全部由 0xff 组成时返回 nil，表示没有上界
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			end := append([]byte(nil), prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
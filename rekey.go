@@ -0,0 +1,68 @@
+package fairy_kvdb
+
+import (
+	"fairy-kvdb/data"
+	"os"
+	"path/filepath"
+)
+
+// Rekey 使用新的密钥重写数据目录，数据目录不能正在被其他进程使用
+// options.EncryptionKey 为当前的密钥，为空表示当前的数据没有加密；所有数据通过一次全量 merge 使用 newKey 重新加密，
+// 完成之后只能使用 newKey 打开数据库
+// 大对象文件使用各自的数据密钥加密，不会被重写；开启加密之前写入的大对象文件依然保持未加密的状态
+func Rekey(options Options, newKey []byte) error {
+	newOptions := options
+	newOptions.EncryptionKey = newKey
+	if err := checkOptions(&newOptions); err != nil {
+		return err
+	}
+	if len(newKey) == 0 {
+		return data.ErrorInvalidEncryptionKey
+	}
+	options.AutoMergeInterval = 0
+	db, err := Open(options)
+	if err != nil {
+		return err
+	}
+	if err := db.rekey(newKey); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// 切换到新的密钥，然后通过全量 merge 重写所有的数据文件和 Hint 文件
+func (db *DB) rekey(newKey []byte) error {
+	db.mu.Lock()
+	var rotated *data.Cipher
+	var err error
+	if db.cipher != nil {
+		rotated, err = db.cipher.Rotate(newKey)
+	} else {
+		rotated, err = data.NewCipher(newKey)
+	}
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	// 之后的写入都使用新的密钥，旧的记录依然可以通过旧的密钥读取
+	db.cipher = rotated
+	db.options.EncryptionKey = newKey
+	db.options.MergeRatio = 0 // 无论有多少无效数据都需要重写
+	if db.activeFile != nil {
+		db.activeFile.Cipher = rotated
+	}
+	for _, files := range []map[uint32]*data.DataFile{db.olderFiles, db.retiredFiles} {
+		for _, dataFile := range files {
+			dataFile.Cipher = rotated
+		}
+	}
+	if _, err := os.Stat(filepath.Join(db.options.DataDir, data.FamilyFileName)); err == nil {
+		if err := db.saveColumnFamilies(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	db.mu.Unlock()
+	return db.Merge()
+}
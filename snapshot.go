@@ -0,0 +1,83 @@
+package fairy_kvdb
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot 数据库某个时间点的只读快照
+// 快照创建之后的写入对它不可见，使用完毕后需要调用 Release 释放，否则被覆盖的旧版本会一直保留在内存中
+type Snapshot struct {
+	db       *DB
+	readTs   uint64 // 快照创建时的 BTSN
+	epoch    uint64 // 快照作为读视图注册时所在的纪元
+	once     *sync.Once
+	released int32
+}
+
+// Snapshot 创建一个数据库的只读快照
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.RLock()
+	readTs := atomic.LoadUint64(&db.nextBTSN)
+	epoch := db.versions.acquire(readTs)
+	db.mu.RUnlock()
+	return &Snapshot{
+		db:     db,
+		readTs: readTs,
+		epoch:  epoch,
+		once:   new(sync.Once),
+	}
+}
+
+// Get 读取 key 在快照中的数据
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrorKeyEmpty
+	}
+	if atomic.LoadInt32(&snap.released) == 1 {
+		return nil, ErrorSnapshotReleased
+	}
+	return snap.db.getAt(key, snap.readTs)
+}
+
+// Iterator 返回快照的迭代器
+func (snap *Snapshot) Iterator(options IteratorOptions) *SnapshotIterator {
+	if atomic.LoadInt32(&snap.released) == 1 {
+		return newSnapshotIterator(snap.db, nil, options)
+	}
+	snap.db.mu.RLock()
+	lower, upper := options.keyRange()
+	items := snap.db.snapshotItems(snap.readTs, lower, upper)
+	snap.db.mu.RUnlock()
+	return newSnapshotIterator(snap.db, items, options)
+}
+
+// Fold 遍历快照中所有的 key-value 数据，并执行用户指定的操作，函数返回 false 时终止
+func (snap *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	if atomic.LoadInt32(&snap.released) == 1 {
+		return ErrorSnapshotReleased
+	}
+	snap.db.mu.RLock()
+	items := snap.db.snapshotItems(snap.readTs, nil, nil)
+	snap.db.mu.RUnlock()
+	for _, item := range items {
+		snap.db.mu.RLock()
+		value, err := snap.db.readValue(item.pos)
+		snap.db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		if !fn(item.key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，释放之后快照不能再被使用
+func (snap *Snapshot) Release() {
+	snap.once.Do(func() {
+		atomic.StoreInt32(&snap.released, 1)
+		snap.db.versions.release(snap.readTs, snap.epoch)
+	})
+}
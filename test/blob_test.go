@@ -0,0 +1,179 @@
+package test
+
+import (
+	"bytes"
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_PutReader(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	assert.Equal(t, fairydb.ErrorKeyEmpty, db.PutReader(nil, bytes.NewReader(large), int64(len(large))))
+	assert.Equal(t, fairydb.ErrorInvalidBlobSize, db.PutReader([]byte("blob"), bytes.NewReader(large), -1))
+	// 读取器中的数据不足时写入失败，不会留下任何数据
+	err = db.PutReader([]byte("blob"), bytes.NewReader(large[:10]), int64(len(large)))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = db.Get([]byte("blob"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	assert.Nil(t, db.PutReader([]byte("blob"), bytes.NewReader(large), int64(len(large))))
+	assert.Nil(t, db.Put([]byte("small"), []byte("value")))
+
+	blobDir := filepath.Join(options.DataDir, data.BlobDirName)
+	countBlobs := func() int {
+		entries, err := os.ReadDir(blobDir)
+		assert.Nil(t, err)
+		return len(entries)
+	}
+	checkData := func(db *fairydb.DB, expected []byte) {
+		reader, err := db.GetReader([]byte("blob"))
+		assert.Nil(t, err)
+		val, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, reader.Close())
+		assert.True(t, bytes.Equal(expected, val))
+		val, err = db.Get([]byte("blob"))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(expected, val))
+		// 普通的值同样可以通过 GetReader 读取
+		reader, err = db.GetReader([]byte("small"))
+		assert.Nil(t, err)
+		val, err = io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, "value", string(val))
+	}
+	checkData(db, large)
+	assert.Equal(t, 1, countBlobs())
+
+	// 覆盖写入之后，旧的大对象文件在读取器关闭并持久化之后被删除
+	reader, err := db.GetReader([]byte("blob"))
+	assert.Nil(t, err)
+	updated := bytes.Repeat([]byte("x"), 3*1024*1024)
+	assert.Nil(t, db.PutReader([]byte("blob"), bytes.NewReader(updated), int64(len(updated))))
+	assert.Nil(t, db.Sync())
+	assert.Equal(t, 2, countBlobs())
+	val, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(large, val))
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, 1, countBlobs())
+	checkData(db, updated)
+
+	// 重启之后依然可以读取，没有被引用的大对象文件会被清理掉
+	assert.Nil(t, os.WriteFile(data.GetBlobFilePath(options.DataDir, 100), []byte("orphan"), 0644))
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countBlobs())
+	checkData(db, updated)
+
+	// merge 之后大对象依然可以读取
+	assert.Nil(t, db.Merge())
+	checkData(db, updated)
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db, updated)
+
+	// 删除之后大对象文件被删除
+	assert.Nil(t, db.Delete([]byte("blob")))
+	assert.Nil(t, db.Sync())
+	assert.Equal(t, 0, countBlobs())
+	_, err = db.GetReader([]byte("blob"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_GetReader_Corrupt(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("v"), 4096)
+	assert.Nil(t, db.PutReader([]byte("blob"), bytes.NewReader(value), int64(len(value))))
+	corrupted := append([]byte(nil), value...)
+	corrupted[100] = 'x'
+	assert.Nil(t, os.WriteFile(data.GetBlobFilePath(options.DataDir, 1), corrupted, 0644))
+
+	reader, err := db.GetReader([]byte("blob"))
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, fairydb.ErrorBlobCorrupt, err)
+	assert.Nil(t, reader.Close())
+	_, err = db.Get([]byte("blob"))
+	assert.Equal(t, fairydb.ErrorBlobCorrupt, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_PersistBlob(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("v"), 4096)
+	assert.Nil(t, db.PutReader([]byte("blob"), bytes.NewReader(value), int64(len(value))))
+	assert.Nil(t, db.Close())
+
+	// 在数据文件末尾追加一条带有过期时间、指向同一个大对象文件的记录
+	dataFile, err := data.OpenDataFile(options.DataDir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	var offset int64
+	for {
+		record, size, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		offset += size
+		if record.Type == data.LogRecordBlob {
+			record.Expire = time.Now().Add(time.Hour).UnixNano()
+			encoded, _ := data.EncodeLogRecord(record)
+			err = dataFile.Write(encoded)
+			assert.Nil(t, err)
+			break
+		}
+	}
+	assert.Nil(t, dataFile.Close())
+	assert.Nil(t, os.Remove(filepath.Join(options.DataDir, data.IndexSnapshotFileName)))
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	ttl, err := db.TTL([]byte("blob"))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Duration(0))
+	// 移除过期时间之后仍然是大对象，大对象文件也不会被当作无效文件删除
+	assert.Nil(t, db.Persist([]byte("blob")))
+	ttl, err = db.TTL([]byte("blob"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	assert.Nil(t, db.Sync())
+	assert.Nil(t, db.Close())
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	_, err = os.Stat(data.GetBlobFilePath(options.DataDir, 1))
+	assert.Nil(t, err)
+	reader, err := db.GetReader([]byte("blob"))
+	assert.Nil(t, err)
+	content, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, content)
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, db.Close())
+}
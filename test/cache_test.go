@@ -0,0 +1,67 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_ReadCache(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	options.CacheSize = 64 * 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	val, err := db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1", string(val))
+	stat := db.Stat()
+	assert.Equal(t, uint64(0), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 修改返回的 value 不会影响缓存中的内容
+	val[0] = 'x'
+	val, err = db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-1", string(val))
+	assert.Equal(t, uint64(1), db.Stat().CacheHits)
+
+	// 覆盖写入之后读到的是新的值
+	assert.Nil(t, db.Put([]byte("key-1"), []byte("updated")))
+	val, err = db.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", string(val))
+
+	// 缓存的容量有限，读取所有的 key 之后依然能够得到正确的结果
+	for round := 0; round < 2; round++ {
+		for i := 2; i < 1000; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+		}
+	}
+	stat = db.Stat()
+	assert.Less(t, stat.CacheHits, uint64(1000))
+
+	// merge 之后旧文件中的缓存被清理，读取新的位置
+	_, err = db.Get([]byte("key-999"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	hits := db.Stat().CacheHits
+	val, err = db.Get([]byte("key-999"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-999", string(val))
+	assert.Equal(t, hits, db.Stat().CacheHits)
+	val, err = db.Get([]byte("key-999"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-999", string(val))
+	assert.Equal(t, hits+1, db.Stat().CacheHits)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/index"
+	"fairy-kvdb/utils"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ColumnFamily(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	meta, err := db.CreateColumnFamilyWithOptions("meta", fairydb.ColumnFamilyOptions{IndexType: index.ARTIndexer})
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("users")
+	assert.Equal(t, fairydb.ErrorColumnFamilyExists, err)
+	_, err = db.CreateColumnFamily(fairydb.DefaultColumnFamilyName)
+	assert.Equal(t, fairydb.ErrorColumnFamilyExists, err)
+	assert.Equal(t, []string{"meta", "users"}, db.ListColumnFamilies())
+
+	// 不同列族中相同的 key 互不影响
+	assert.Nil(t, db.Put([]byte("key"), []byte("default")))
+	assert.Nil(t, users.Put([]byte("key"), []byte("users")))
+	assert.Nil(t, meta.Put([]byte("key"), []byte("meta")))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, users.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+		assert.Nil(t, meta.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	assert.Nil(t, users.Delete(utils.RandomTestKey(0)))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, users.Delete(utils.RandomTestKey(0)))
+
+	checkData := func(db *fairydb.DB) {
+		val, err := db.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, "default", string(val))
+		users, err := db.ColumnFamily("users")
+		assert.Nil(t, err)
+		val, err = users.Get([]byte("key"))
+		assert.Nil(t, err)
+		assert.Equal(t, "users", string(val))
+		_, err = users.Get(utils.RandomTestKey(0))
+		assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+		_, err = db.Get(utils.RandomTestKey(1))
+		assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+		iter := users.NewIterator(&fairydb.IteratorOptions{Prefix: []byte("key_")})
+		count := 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, 64, len(iter.Value()))
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, 999, count)
+	}
+	checkData(db)
+
+	// 删除列族之后，它的数据在 merge 之后被清理掉，ID 也不会被复用
+	reclaimBefore := db.Stat().ReclaimableSize
+	assert.Nil(t, db.DropColumnFamily("meta"))
+	assert.Greater(t, db.Stat().ReclaimableSize, reclaimBefore)
+	_, err = meta.Get([]byte("key"))
+	assert.Equal(t, fairydb.ErrorColumnFamilyNotFound, err)
+	assert.Equal(t, fairydb.ErrorColumnFamilyNotFound, meta.Put([]byte("key"), []byte("v")))
+	_, err = db.ColumnFamily("meta")
+	assert.Equal(t, fairydb.ErrorColumnFamilyNotFound, err)
+	assert.Equal(t, fairydb.ErrorColumnFamilyNotFound, db.DropColumnFamily("meta"))
+
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+	assert.Equal(t, []string{"users"}, db.ListColumnFamilies())
+	meta, err = db.CreateColumnFamily("meta")
+	assert.Nil(t, err)
+	_, err = meta.Get([]byte("key"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	assert.Nil(t, db.Merge())
+	checkData(db)
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+	meta, err = db.ColumnFamily("meta")
+	assert.Nil(t, err)
+	_, err = meta.Get([]byte("key"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ColumnFamilyUnsupported(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.IndexType = int8(index.BPlusTreeIndexer)
+	options.BPlusTreeIndexOpts = &index.BPlusTreeIndexOptions{DataDir: filepath.Join(options.DataDir, "bptree")}
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("users")
+	assert.Equal(t, fairydb.ErrorColumnFamilyUnsupported, err)
+	assert.Nil(t, db.Close())
+
+	options = fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamilyWithOptions("users", fairydb.ColumnFamilyOptions{IndexType: index.BPlusTreeIndexer})
+	assert.Equal(t, fairydb.ErrorColumnFamilyUnsupported, err)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"bytes"
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fairy-kvdb/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_Compression(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"payload":"%s"}`, i, bytes.Repeat([]byte("json-"), 100)))
+	}
+	writeKeys := func(options fairydb.Options, prefix string) int64 {
+		db, err := fairydb.Open(options)
+		assert.Nil(t, err)
+		sizeBefore, err := utils.DirSize(options.DataDir)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put([]byte(fmt.Sprintf("%s-%d", prefix, i)), value(i)))
+		}
+		assert.Nil(t, db.Close())
+		sizeAfter, err := utils.DirSize(options.DataDir)
+		assert.Nil(t, err)
+		return sizeAfter - sizeBefore
+	}
+	checkKeys := func(db *fairydb.DB) {
+		for _, prefix := range []string{"plain", "lz", "flate"} {
+			for i := 0; i < 100; i++ {
+				val, err := db.Get([]byte(fmt.Sprintf("%s-%d", prefix, i)))
+				assert.Nil(t, err)
+				assert.Equal(t, value(i), val)
+			}
+		}
+	}
+
+	// 同一个数据目录中混合了未压缩和使用不同算法压缩的记录
+	plainSize := writeKeys(options, "plain")
+	options.Compression = data.CompressionLZ
+	lzSize := writeKeys(options, "lz")
+	options.Compression = data.CompressionFlate
+	flateSize := writeKeys(options, "flate")
+	assert.Less(t, lzSize*3, plainSize)
+	assert.Less(t, flateSize*3, plainSize)
+
+	options.Compression = data.CompressionNone
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	checkKeys(db)
+	assert.Nil(t, db.Close())
+
+	// merge 时按照当前的配置重新压缩
+	options.Compression = data.CompressionLZ
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	checkKeys(db)
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkKeys(db)
+	assert.Nil(t, db.Close())
+
+	options.Compression = 100
+	_, err = fairydb.Open(options)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// 租约：只有一个节点能够成为 leader
+	ok, err := db.PutIfAbsent([]byte("leader"), []byte("node-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent([]byte("leader"), []byte("node-2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ok, err = db.CompareAndSwap([]byte("leader"), []byte("node-2"), []byte("node-3"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap([]byte("leader"), []byte("node-1"), []byte("node-3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get([]byte("leader"))
+	assert.Nil(t, err)
+	assert.Equal(t, "node-3", string(val))
+
+	ok, err = db.DeleteIfValue([]byte("leader"), []byte("node-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfValue([]byte("leader"), []byte("node-3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get([]byte("leader"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	_, err = db.CompareAndSwap(nil, nil, []byte("v"))
+	assert.Equal(t, fairydb.ErrorKeyEmpty, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Increment(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// 并发地递增同一个计数器
+	const workers, count = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				_, err := db.Increment([]byte("counter"), 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	n, err := db.Increment([]byte("counter"), -10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(workers*count-10), n)
+
+	err = db.Put([]byte("text"), []byte("abc"))
+	assert.Nil(t, err)
+	_, err = db.Increment([]byte("text"), 1)
+	assert.Equal(t, fairydb.ErrorValueNotInteger, err)
+
+	_, err = db.Increment([]byte("max"), math.MaxInt64)
+	assert.Nil(t, err)
+	_, err = db.Increment([]byte("max"), 1)
+	assert.Equal(t, fairydb.ErrorIntegerOverflow, err)
+
+	// 重启之后计数器的值依然正确
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, "790", string(val))
+	err = db.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"fairy-kvdb/test"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestDataFile_ReadEncryptedLogRecord(t *testing.T) {
+	_, err := data.NewCipher([]byte("short"))
+	assert.Equal(t, data.ErrorInvalidEncryptionKey, err)
+	cipher, err := data.NewCipher(bytes.Repeat([]byte("a"), 32))
+	assert.Nil(t, err)
+	other, err := data.NewCipher(bytes.Repeat([]byte("b"), 16))
+	assert.Nil(t, err)
+	assert.NotEqual(t, cipher.KeyId(), other.KeyId())
+
+	_ = os.Remove(data.GetDataFilePath(test.TempDirPath, 444))
+	df, err := data.OpenDataFile(test.TempDirPath, 444, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer os.Remove(data.GetDataFilePath(test.TempDirPath, 444))
+	defer df.Close()
+
+	record := &data.LogRecord{Key: []byte("secret-key"), Value: bytes.Repeat([]byte("secret-value"), 10), Type: data.LogRecordNormal, Seq: 3}
+	encBytes, size := data.EncodeEncryptedLogRecord(record, data.CompressionLZ, 0, cipher)
+	assert.Equal(t, int64(len(encBytes)), size)
+	assert.False(t, bytes.Contains(encBytes, []byte("secret")))
+	assert.Nil(t, df.Write(encBytes))
+
+	// 没有密钥或者密钥不匹配时无法读取
+	_, recordSize, err := df.ReadLogRecord(0)
+	assert.Equal(t, data.ErrorEncryptionKeyRequired, err)
+	assert.Equal(t, size, recordSize)
+	df.Cipher = other
+	_, _, err = df.ReadLogRecord(0)
+	assert.Equal(t, data.ErrorEncryptionKeyMismatch, err)
+
+	df.Cipher = cipher
+	readRecord, recordSize, err := df.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, recordSize)
+	assert.Equal(t, record, readRecord)
+
+	// 更换密钥之后依然可以读取旧密钥加密的记录
+	rotated, err := cipher.Rotate(bytes.Repeat([]byte("c"), 24))
+	assert.Nil(t, err)
+	df.Cipher = rotated
+	readRecord, _, err = df.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, record, readRecord)
+
+	// 重新计算了 CRC 的篡改无法通过认证
+	encBytes[len(encBytes)-1] ^= 0xff
+	binary.LittleEndian.PutUint32(encBytes, crc32.ChecksumIEEE(encBytes[4:]))
+	assert.Nil(t, df.Write(encBytes))
+	_, _, err = df.ReadLogRecord(size)
+	assert.Equal(t, data.ErrorDecryptFailed, err)
+}
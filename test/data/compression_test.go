@@ -0,0 +1,86 @@
+package data
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"fairy-kvdb/test"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCompressValue(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 200; i++ {
+		buf.WriteString(fmt.Sprintf(`{"id":%d,"name":"user-%d","tags":["a","b","c"],"active":true}`, i, i%7))
+	}
+	value := buf.Bytes()
+	random := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, compression := range []data.CompressionType{data.CompressionFlate, data.CompressionLZ} {
+		compressed, ok := data.CompressValue(compression, value)
+		assert.True(t, ok)
+		assert.Less(t, len(compressed)*3, len(value))
+		decompressed, err := data.DecompressValue(compression, compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decompressed)
+
+		// 重复的字节会引用与自身重叠的数据
+		repeated := bytes.Repeat([]byte("a"), 1000)
+		compressed, ok = data.CompressValue(compression, repeated)
+		assert.True(t, ok)
+		decompressed, err = data.DecompressValue(compression, compressed)
+		assert.Nil(t, err)
+		assert.Equal(t, repeated, decompressed)
+
+		// 无法压缩的数据按原样存储
+		_, ok = data.CompressValue(compression, random)
+		assert.False(t, ok)
+	}
+	_, ok := data.CompressValue(data.CompressionNone, value)
+	assert.False(t, ok)
+	_, err := data.DecompressValue(100, value)
+	assert.Equal(t, data.ErrorUnknownCompression, err)
+	_, err = data.DecompressValue(data.CompressionLZ, []byte{10, 3, 1})
+	assert.Equal(t, data.ErrorCorruptCompression, err)
+}
+
+func TestDataFile_ReadCompressedLogRecord(t *testing.T) {
+	_ = os.Remove(data.GetDataFilePath(test.TempDirPath, 333))
+	df, err := data.OpenDataFile(test.TempDirPath, 333, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer os.Remove(data.GetDataFilePath(test.TempDirPath, 333))
+	defer df.Close()
+
+	value := bytes.Repeat([]byte("compressible-"), 100)
+	records := []*data.LogRecord{
+		{Key: []byte("plain"), Value: value, Type: data.LogRecordNormal},
+		{Key: []byte("lz"), Value: value, Type: data.LogRecordNormal, Seq: 9},
+		{Key: []byte("small"), Value: []byte("v"), Type: data.LogRecordNormal},
+		{Key: []byte("flate"), Value: value, Type: data.LogRecordNormal, Expire: 1 << 62},
+	}
+	encodings := []data.CompressionType{data.CompressionNone, data.CompressionLZ, data.CompressionLZ, data.CompressionFlate}
+	var sizes []int64
+	for i, record := range records {
+		encBytes, size := data.EncodeCompressedLogRecord(record, encodings[i], 64)
+		assert.Nil(t, df.Write(encBytes))
+		sizes = append(sizes, size)
+	}
+	assert.Less(t, sizes[1], int64(len(value)))
+	assert.Less(t, sizes[3], int64(len(value)))
+	// 低于阈值的 value 不会被压缩，与旧格式的编码相同
+	encBytes, _ := data.EncodeLogRecord(records[2])
+	assert.Equal(t, int64(len(encBytes)), sizes[2])
+
+	var offset int64
+	for i, record := range records {
+		readRecord, size, err := df.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, sizes[i], size)
+		assert.Equal(t, record, readRecord)
+		offset += size
+	}
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/binary"
 	"fairy-kvdb/data"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -100,3 +101,145 @@ func TestComputeCRC(t *testing.T) {
 	crc := data.ComputeCRC(rec1, encBytes1[4:headerSize1])
 	assert.Equal(t, uint32(2008391071), crc)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &data.LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("zhangSan"),
+		Type:   data.LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	encBytes, totalSize := data.EncodeLogRecord(rec)
+	assert.NotNil(t, encBytes)
+	headerSize := totalSize - int64(len(rec.Key)) - int64(len(rec.Value))
+	header, decodedLength := data.DecodeLogRecordHeader(encBytes[:headerSize])
+	assert.Equal(t, headerSize, decodedLength)
+	assert.Equal(t, data.LogRecordNormal, header.RecType)
+	assert.Equal(t, data.FlagHasExpire, header.Flags)
+	assert.Equal(t, rec.Expire, header.Expire)
+	assert.Equal(t, uint32(4), header.KeySize)
+	assert.Equal(t, uint32(8), header.ValueSize)
+	crc := data.ComputeCRC(rec, encBytes[4:headerSize])
+	assert.Equal(t, header.Crc, crc)
+}
+
+func TestEncodeLogRecord_OptionalFields(t *testing.T) {
+	rec := &data.LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("zhangSan"),
+		Type:   data.LogRecordNormal,
+		Expire: 1700000000000000000,
+		Family: 300,
+		Seq:    1 << 40,
+	}
+	encBytes, totalSize := data.EncodeLogRecord(rec)
+	headerSize := totalSize - int64(len(rec.Key)) - int64(len(rec.Value))
+	header, decodedLength := data.DecodeLogRecordHeader(encBytes[:headerSize])
+	assert.Equal(t, headerSize, decodedLength)
+	assert.Equal(t, data.FlagHasExpire|data.FlagHasFamily|data.FlagHasSeq, header.Flags)
+	assert.Equal(t, rec.Expire, header.Expire)
+	assert.Equal(t, uint32(300), header.Family)
+	assert.Equal(t, uint64(1<<40), header.Seq)
+	assert.Equal(t, uint32(4), header.KeySize)
+	assert.Equal(t, uint32(8), header.ValueSize)
+}
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos := &data.LogRecordPos{Fid: 3, Offset: 1024, Sz: 36, Expire: 1700000000000000000}
+	decoded := data.DecodeLogRecordPos(data.EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, decoded)
+}
+
+func TestDecodeLegacyLogRecordPos(t *testing.T) {
+	// 旧格式固定为 22 字节，Sz 从第 12 字节开始
+	encodeLegacy := func(pos *data.LogRecordPos) []byte {
+		buf := make([]byte, 12+binary.MaxVarintLen64)
+		binary.BigEndian.PutUint32(buf[:4], pos.Fid)
+		binary.PutVarint(buf[4:], pos.Offset)
+		binary.PutUvarint(buf[12:], pos.Sz)
+		return buf
+	}
+	for _, pos := range []*data.LogRecordPos{
+		{Fid: 3, Offset: 100, Sz: 36},
+		{Fid: 5, Offset: 200 << 20, Sz: 77},
+		{Fid: 0, Offset: 0, Sz: 1 << 20},
+	} {
+		assert.Equal(t, pos, data.DecodeLogRecordPos(encodeLegacy(pos)))
+	}
+	// 新格式与旧格式的长度相同时依然按照新格式解码
+	pos := &data.LogRecordPos{Fid: 7, Offset: 1 << 40, Sz: 1 << 30, Expire: 1 << 40}
+	encoded := data.EncodeLogRecordPos(pos)
+	assert.Equal(t, 12+binary.MaxVarintLen64, len(encoded))
+	assert.Equal(t, pos, data.DecodeLogRecordPos(encoded))
+	assert.Nil(t, data.DecodeLogRecordPos([]byte{1, 2, 3}))
+}
+
+func TestEncodeMergeOperand(t *testing.T) {
+	// 带有 Chain 的位置追加在末尾，不影响普通位置的编码
+	prev := &data.LogRecordPos{Fid: 2, Offset: 512, Sz: 20, Chain: 3}
+	assert.Equal(t, prev, data.DecodeLogRecordPos(data.EncodeLogRecordPos(prev)))
+
+	decodedPrev, operand, ok := data.DecodeMergeOperand(data.EncodeMergeOperand(prev, []byte("operand")))
+	assert.True(t, ok)
+	assert.Equal(t, prev, decodedPrev)
+	assert.Equal(t, "operand", string(operand))
+
+	decodedPrev, operand, ok = data.DecodeMergeOperand(data.EncodeMergeOperand(nil, []byte("first")))
+	assert.True(t, ok)
+	assert.Nil(t, decodedPrev)
+	assert.Equal(t, "first", string(operand))
+
+	_, _, ok = data.DecodeMergeOperand([]byte{10, 1})
+	assert.False(t, ok)
+}
+
+func TestEncodeBlobRef(t *testing.T) {
+	ref := &data.BlobRef{Id: 7, Size: 1 << 33, Crc: 0xdeadbeef}
+	decoded, ok := data.DecodeBlobRef(data.EncodeBlobRef(ref))
+	assert.True(t, ok)
+	assert.Equal(t, ref, decoded)
+	_, ok = data.DecodeBlobRef([]byte{0, 1})
+	assert.False(t, ok)
+	// 加密的大对象文件的数据密钥追加在末尾
+	ref.Key = data.NewBlobKey()
+	decoded, ok = data.DecodeBlobRef(data.EncodeBlobRef(ref))
+	assert.True(t, ok)
+	assert.Equal(t, ref, decoded)
+
+	// 大对象的位置追加在 Chain 之后
+	pos := &data.LogRecordPos{Fid: 1, Offset: 64, Sz: 30, Blob: 7}
+	assert.Equal(t, pos, data.DecodeLogRecordPos(data.EncodeLogRecordPos(pos)))
+	pos.Chain = 2
+	assert.Equal(t, pos, data.DecodeLogRecordPos(data.EncodeLogRecordPos(pos)))
+}
+
+func TestEncodeFileHintRecord(t *testing.T) {
+	pos := &data.LogRecordPos{Fid: 3, Offset: 128, Sz: 40, Expire: 99}
+	// 普通记录的 value 不会写入 hint 记录
+	record := &data.LogRecord{Key: []byte("key"), Value: []byte("value"), Type: data.LogRecordNormal, Expire: 99, Family: 2, Seq: 17}
+	hint := data.EncodeFileHintRecord(record, pos)
+	decoded, decodedPos, ok := data.DecodeFileHintRecord(hint)
+	assert.True(t, ok)
+	assert.Equal(t, pos, decodedPos)
+	assert.Equal(t, &data.LogRecord{Key: []byte("key"), Type: data.LogRecordNormal, Expire: 99, Family: 2, Seq: 17}, decoded)
+
+	// 合并操作数只保留前一条记录的位置
+	prev := &data.LogRecordPos{Fid: 1, Offset: 8, Sz: 20}
+	record = &data.LogRecord{Key: []byte("key"), Value: data.EncodeMergeOperand(prev, []byte("operand")), Type: data.LogRecordMergeOperand, Btsn: 5}
+	decoded, _, ok = data.DecodeFileHintRecord(data.EncodeFileHintRecord(record, pos))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), decoded.Btsn)
+	decodedPrev, operand, ok := data.DecodeMergeOperand(decoded.Value)
+	assert.True(t, ok)
+	assert.Equal(t, prev, decodedPrev)
+	assert.Equal(t, 0, len(operand))
+
+	// 范围删除保留范围的终点
+	record = &data.LogRecord{Key: []byte("a"), Value: []byte("z"), Type: data.LogRecordRangeDelete}
+	decoded, _, ok = data.DecodeFileHintRecord(data.EncodeFileHintRecord(record, pos))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("z"), decoded.Value)
+
+	_, _, ok = data.DecodeFileHintRecord(&data.LogRecord{Key: []byte("key"), Value: []byte{5, 1}})
+	assert.False(t, ok)
+}
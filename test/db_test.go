@@ -2,11 +2,13 @@ package test
 
 import (
 	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
 	"fairy-kvdb/index"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -93,6 +95,23 @@ func TestDB_Close(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestDB_CloseTwice(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("name"), []byte("zhangSan"))
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
 func TestDB_Sync(t *testing.T) {
 	options := fairydb.DefaultOptions
 	ClearDatabaseDir(options.DataDir)
@@ -276,3 +295,406 @@ func TestDB_Backup(t *testing.T) {
 	time.Sleep(time.Second * 2)
 	ClearDatabaseDir(backupDir)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL([]byte("session"), []byte("token"), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.Put([]byte("name"), []byte("zhangSan"))
+	assert.Nil(t, err)
+	err = db.PutWithTTL([]byte("age"), []byte("18"), -time.Second)
+	assert.Equal(t, fairydb.ErrorInvalidTTL, err)
+
+	// 过期之前可以正常读取
+	val, err := db.Get([]byte("session"))
+	assert.Nil(t, err)
+	assert.Equal(t, "token", string(val))
+	ttl, err := db.TTL([]byte("session"))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Duration(0))
+	ttl, err = db.TTL([]byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	// 过期之后对 Get、ListKeys、Fold、Iterator 都不可见
+	time.Sleep(time.Millisecond * 150)
+	val, err = db.Get([]byte("session"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Nil(t, val)
+	_, err = db.TTL([]byte("session"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	keys := db.ListKeys()
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, "name", string(keys[0]))
+	cnt := 0
+	err = db.Fold(func(key []byte, value []byte) bool {
+		cnt++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cnt)
+	iterOptions := fairydb.DefaultIteratorOptions
+	iterOptions.Reverse = true
+	iter := db.NewIterator(&iterOptions)
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "name", string(iter.Key()))
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Close()
+
+	// 重启之后过期的 key 依然不可见，未过期的 key 依然保留过期时间
+	err = db.PutWithTTL([]byte("lease"), []byte("leader"), time.Hour)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("session"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	ttl, err = db.TTL([]byte("lease"))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Minute*59)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Persist(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL([]byte("session"), []byte("token"), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.Persist([]byte("session"))
+	assert.Nil(t, err)
+	err = db.Persist([]byte("unknown"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	time.Sleep(time.Millisecond * 150)
+	val, err := db.Get([]byte("session"))
+	assert.Nil(t, err)
+	assert.Equal(t, "token", string(val))
+	ttl, err := db.TTL([]byte("session"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_RecoverTornTail(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	for _, indexType := range []index.TypeEnum{index.BTreeIndexer, index.BPlusTreeIndexer} {
+		ClearDatabaseDir(options.DataDir)
+		options.IndexType = int8(indexType)
+		options.BPlusTreeIndexOpts = &index.BPlusTreeIndexOptions{
+			DataDir: filepath.Join(options.DataDir, "bptree"),
+		}
+		options.StrictRecovery = false
+		db, err := fairydb.Open(options)
+		assert.Nil(t, err)
+		for i := 0; i < 10; i++ {
+			err = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+			assert.Nil(t, err)
+		}
+		err = db.Close()
+		assert.Nil(t, err)
+
+		// 模拟写入到一半时进程崩溃，在活跃文件末尾留下一条不完整的记录
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: []byte("torn-value")})
+		dataFile, err := os.OpenFile(data.GetDataFilePath(options.DataDir, 0), os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = dataFile.Write(encRecord[:len(encRecord)/2])
+		assert.Nil(t, err)
+		err = dataFile.Close()
+		assert.Nil(t, err)
+
+		// 严格模式下无法打开
+		options.StrictRecovery = true
+		_, err = fairydb.Open(options)
+		assert.Equal(t, data.ErrorIncompleteRecord, err)
+
+		// 宽松模式下截断不完整的记录，之后的写入在重启后依然可以读取
+		options.StrictRecovery = false
+		db, err = fairydb.Open(options)
+		assert.Nil(t, err)
+		_, err = db.Get([]byte("torn"))
+		assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+		err = db.Put([]byte("after-recover"), []byte("ok"))
+		assert.Nil(t, err)
+		err = db.Close()
+		assert.Nil(t, err)
+
+		db, err = fairydb.Open(options)
+		assert.Nil(t, err)
+		for i := 0; i < 10; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(val))
+		}
+		val, err := db.Get([]byte("after-recover"))
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", string(val))
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_DefaultSync(t *testing.T) {
+	// 默认配置下每次写入都会持久化
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	assert.Equal(t, uint64(10), db.Stat().WriteSyncs)
+	assert.Nil(t, db.Close())
+
+	// 设置了 BytesPerSync 之后，累计写入的数据量超过它才持久化
+	options.BytesPerSync = 1024 * 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	assert.Equal(t, uint64(0), db.Stat().WriteSyncs)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.SyncEveryWrite = true
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// 并发的同步写入、删除和批量写入
+	const writers, count = 16, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+				assert.Nil(t, db.Put(key, []byte("value")))
+				if i%5 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+			}
+			wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+			assert.Nil(t, wb.Put([]byte(fmt.Sprintf("batch-%d", w)), []byte("value")))
+			assert.Nil(t, wb.Commit())
+		}(w)
+	}
+	wg.Wait()
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	for w := 0; w < writers; w++ {
+		for i := 0; i < count; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%d-%d", w, i)))
+			if i%5 == 0 {
+				assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, "value", string(val))
+			}
+		}
+		_, err := db.Get([]byte(fmt.Sprintf("batch-%d", w)))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_WriteOptions(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.SyncInterval = time.Millisecond * 10
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	_, err = db.PutOpt([]byte("meta"), []byte("critical"), fairydb.WriteOptions{Sync: true})
+	assert.Nil(t, err)
+	_, err = db.PutOpt([]byte("cache"), []byte("bulk"), fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("meta"))
+	assert.Nil(t, err)
+	assert.Equal(t, "critical", string(val))
+
+	// 不更新索引的写入在重新打开之前不可见
+	_, err = db.PutOpt([]byte("import"), []byte("later"), fairydb.WriteOptions{DisableIndexUpdate: true})
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("import"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	_, err = db.DeleteOpt([]byte("cache"), fairydb.WriteOptions{Sync: true})
+	assert.Nil(t, err)
+	_, err = db.DeleteOpt([]byte("cache"), fairydb.WriteOptions{Sync: true})
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+	_, err = wb.CommitOpt(fairydb.WriteOptions{Sync: false})
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("batch"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(val))
+
+	// 等待后台定期持久化
+	time.Sleep(time.Millisecond * 30)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("import"))
+	assert.Nil(t, err)
+	assert.Equal(t, "later", string(val))
+	_, err = db.Get([]byte("cache"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ReopenManyDataFiles(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 4 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+
+	// 写入大量数据，产生很多个数据文件，其中的覆盖写入、删除和 batch 会跨越多个文件
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			err = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d-%d", round, i)))
+			assert.Nil(t, err)
+		}
+		wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, wb.Put([]byte(fmt.Sprintf("batch-%d", i)), []byte(fmt.Sprintf("batch-%d-%d", round, i))))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	for i := 0; i < 500; i += 5 {
+		err = db.Delete([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+	// 没有提交的 batch 不会出现在数据文件中
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("uncommitted"), []byte("value")))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Greater(t, db.Stat().DataFileNum, uint(10))
+	for i := 0; i < 500; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if i%5 == 0 {
+			assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-2-%d", i), string(val))
+	}
+	for i := 0; i < 100; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("batch-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("batch-2-%d", i), string(val))
+	}
+	_, err = db.Get([]byte("uncommitted"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	// 重启之后继续写入，序列号不会回退
+	err = db.Put([]byte("key-0"), []byte("again"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "again", string(val))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_DisableIndexUpdateMerge(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	err = db.Put([]byte("indexed"), []byte("value"))
+	assert.Nil(t, err)
+	_, err = db.PutOpt([]byte("import"), []byte("later"), fairydb.WriteOptions{DisableIndexUpdate: true})
+	assert.Nil(t, err)
+
+	// merge 会把没有进入索引的写入当作无效数据，因此在重新打开之前拒绝 merge
+	err = db.Merge()
+	assert.Equal(t, fairydb.ErrorMergeUnindexedWrites, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("import"))
+	assert.Nil(t, err)
+	assert.Equal(t, "later", string(val))
+	val, err = db.Get([]byte("indexed"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(val))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// B+ 树索引在启动时不会重放数据文件，不支持跳过索引更新
+	ClearDatabaseDir(options.DataDir)
+	options.IndexType = int8(index.BPlusTreeIndexer)
+	options.BPlusTreeIndexOpts = &index.BPlusTreeIndexOptions{
+		DataDir: filepath.Join(options.DataDir, "bptree"),
+	}
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	_, err = db.PutOpt([]byte("import"), []byte("later"), fairydb.WriteOptions{DisableIndexUpdate: true})
+	assert.Equal(t, fairydb.ErrorIndexUpdateRequired, err)
+	_, err = db.DeleteOpt([]byte("import"), fairydb.WriteOptions{DisableIndexUpdate: true})
+	assert.Equal(t, fairydb.ErrorIndexUpdateRequired, err)
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("import"), []byte("later")))
+	_, err = wb.CommitOpt(fairydb.WriteOptions{DisableIndexUpdate: true})
+	assert.Equal(t, fairydb.ErrorIndexUpdateRequired, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
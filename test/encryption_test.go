@@ -0,0 +1,155 @@
+package test
+
+import (
+	"bytes"
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 检查目录下的所有文件中都不包含明文
+func assertNoPlaintext(t *testing.T, dir string, plaintext []byte) {
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		assert.False(t, bytes.Contains(content, plaintext), path)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	options.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	backupDir := filepath.Join(os.TempDir(), "fairy-kvdb-encryption-backup")
+	ClearDatabaseDir(options.DataDir)
+	ClearDatabaseDir(backupDir)
+	defer ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(backupDir)
+
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("secret-key-%d", i)), []byte(fmt.Sprintf("secret-value-%d", i))))
+	}
+	assert.Nil(t, db.Put([]byte("secret-key-0"), []byte("secret-value-updated")))
+	cf, err := db.CreateColumnFamily("secret-family")
+	assert.Nil(t, err)
+	assert.Nil(t, cf.Put([]byte("secret-key-cf"), []byte("secret-value-cf")))
+	blob := bytes.Repeat([]byte("secret-blob-"), 1024)
+	assert.Nil(t, db.PutReader([]byte("secret-key-blob"), bytes.NewReader(blob), int64(len(blob))))
+	// merge 生成加密的 Hint 文件
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put([]byte("secret-key-after-merge"), []byte("secret-value-after-merge")))
+	assert.Nil(t, db.CopyBackup(backupDir))
+	assert.Nil(t, db.Close())
+
+	assertNoPlaintext(t, options.DataDir, []byte("secret"))
+	assertNoPlaintext(t, backupDir, []byte("secret"))
+
+	checkData := func(db *fairydb.DB) {
+		val, err := db.Get([]byte("secret-key-0"))
+		assert.Nil(t, err)
+		assert.Equal(t, "secret-value-updated", string(val))
+		for i := 1; i < 50; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("secret-key-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("secret-value-%d", i), string(val))
+		}
+		val, err = db.Get([]byte("secret-key-after-merge"))
+		assert.Nil(t, err)
+		assert.Equal(t, "secret-value-after-merge", string(val))
+		val, err = db.Get([]byte("secret-key-blob"))
+		assert.Nil(t, err)
+		assert.Equal(t, blob, val)
+		cf, err := db.ColumnFamily("secret-family")
+		assert.Nil(t, err)
+		val, err = cf.Get([]byte("secret-key-cf"))
+		assert.Nil(t, err)
+		assert.Equal(t, "secret-value-cf", string(val))
+	}
+
+	// 没有密钥或者使用错误的密钥都无法打开备份
+	backupOptions := options
+	backupOptions.DataDir = backupDir
+	backupOptions.EncryptionKey = nil
+	_, err = fairydb.Open(backupOptions)
+	assert.Equal(t, data.ErrorEncryptionKeyRequired, err)
+	backupOptions.EncryptionKey = bytes.Repeat([]byte("w"), 32)
+	_, err = fairydb.Open(backupOptions)
+	assert.Equal(t, data.ErrorEncryptionKeyMismatch, err)
+	backupOptions.EncryptionKey = options.EncryptionKey
+	db, err = fairydb.Open(backupOptions)
+	assert.Nil(t, err)
+	checkData(db)
+	assert.Nil(t, db.Close())
+
+	// 更换密钥之后只能使用新的密钥打开
+	newKey := bytes.Repeat([]byte("n"), 16)
+	assert.Nil(t, fairydb.Rekey(options, newKey))
+	_, err = fairydb.Open(options)
+	assert.Equal(t, data.ErrorEncryptionKeyMismatch, err)
+	options.EncryptionKey = newKey
+	report, err := fairydb.VerifyDir(options)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+	assert.Nil(t, db.Close())
+	assertNoPlaintext(t, options.DataDir, []byte("secret"))
+
+	options.EncryptionKey = []byte("short")
+	_, err = fairydb.Open(options)
+	assert.Equal(t, data.ErrorInvalidEncryptionKey, err)
+}
+
+func TestDB_Rekey_Plaintext(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("plain-key"), []byte("plain-value")))
+	assert.Nil(t, db.Close())
+
+	// 开启加密之后，之前写入的未加密数据依然可以读取
+	options.EncryptionKey = bytes.Repeat([]byte("k"), 24)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("encrypted-key"), []byte("encrypted-value")))
+	val, err := db.Get([]byte("plain-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "plain-value", string(val))
+	assert.Nil(t, db.Close())
+
+	// 对未加密的数据执行 rekey 之后，所有数据都被加密
+	options.EncryptionKey = nil
+	assert.Equal(t, data.ErrorInvalidEncryptionKey, fairydb.Rekey(options, nil))
+	_, err = fairydb.Open(options)
+	assert.Equal(t, data.ErrorEncryptionKeyRequired, err)
+	options.EncryptionKey = bytes.Repeat([]byte("k"), 24)
+	assert.Nil(t, fairydb.Rekey(options, options.EncryptionKey))
+	assertNoPlaintext(t, options.DataDir, []byte("plain"))
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("plain-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "plain-value", string(val))
+	val, err = db.Get([]byte("encrypted-key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "encrypted-value", string(val))
+	assert.Nil(t, db.Close())
+}
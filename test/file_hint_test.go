@@ -0,0 +1,105 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_FileHint(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 2 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+
+	for i := 0; i < 300; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+	// batch 中的记录跨越多个数据文件
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("batch-%d", i))))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 200; i < 300; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+	stats := db.FileStats()
+	assert.Less(t, 3, len(stats))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 除了活跃文件之外，每个数据文件都有对应的 hint 文件
+	activeFid := stats[len(stats)-1].FileId
+	for _, stat := range stats {
+		_, err := os.Stat(data.GetFileHintPath(options.DataDir, stat.FileId))
+		if stat.FileId == activeFid {
+			assert.True(t, os.IsNotExist(err))
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	check := func(db *fairydb.DB) {
+		for i := 0; i < 300; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			switch {
+			case i < 100:
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("batch-%d", i), string(val))
+			case i < 200:
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+			default:
+				assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			}
+		}
+	}
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 损坏或者缺失的 hint 文件会被忽略，启动时扫描数据文件并重新生成 hint 文件
+	// 删除索引快照，让启动时重放所有的数据文件
+	err = os.Remove(filepath.Join(options.DataDir, data.IndexSnapshotFileName))
+	assert.Nil(t, err)
+	hintPath := data.GetFileHintPath(options.DataDir, stats[0].FileId)
+	content, err := os.ReadFile(hintPath)
+	assert.Nil(t, err)
+	err = os.WriteFile(hintPath, content[:len(content)/2], 0644)
+	assert.Nil(t, err)
+	err = os.Remove(data.GetFileHintPath(options.DataDir, stats[1].FileId))
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db)
+	rebuilt, err := os.ReadFile(hintPath)
+	assert.Nil(t, err)
+	assert.Equal(t, content, rebuilt)
+	_, err = os.Stat(data.GetFileHintPath(options.DataDir, stats[1].FileId))
+	assert.Nil(t, err)
+
+	// merge 删除数据文件时一起删除它的 hint 文件
+	err = db.Merge()
+	assert.Nil(t, err)
+	_, err = os.Stat(hintPath)
+	assert.True(t, os.IsNotExist(err))
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+}
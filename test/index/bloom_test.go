@@ -0,0 +1,103 @@
+package index
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fairy-kvdb/index"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := index.NewBloomFilter(10000, 10)
+	for i := 0; i < 10000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.MayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	// 每个 key 10 位时误判率约为 1%
+	assert.Less(t, falsePositives, 300)
+
+	decoded, ok := index.DecodeBloomFilter(index.EncodeBloomFilter(bf))
+	assert.True(t, ok)
+	assert.Equal(t, bf, decoded)
+	buf := index.EncodeBloomFilter(bf)
+	buf[10] ^= 0xff
+	_, ok = index.DecodeBloomFilter(buf)
+	assert.False(t, ok)
+}
+
+func TestBPlusTreeIndex_BloomFilter(t *testing.T) {
+	dirPath := filepath.Join(fairydb.DefaultOptions.DataDir, "bptree-bloom")
+	_ = os.RemoveAll(dirPath)
+	defer func() {
+		_ = os.RemoveAll(dirPath)
+	}()
+	options := &index.BPlusTreeIndexOptions{
+		BboltOptions:          bbolt.DefaultOptions,
+		DataDir:               dirPath,
+		BloomFilterBitsPerKey: 10,
+	}
+	bloomPath := filepath.Join(dirPath, "bloom-filter")
+
+	// 写入的 key 超过初始容量之后扩容
+	bpt := index.NewBPlusTreeIndex(options)
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, bpt.Put([]byte(fmt.Sprintf("key-%d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)}))
+	}
+	checkKeys := func(bpt *index.BPlusTreeIndex) {
+		for i := 0; i < 3000; i++ {
+			pos := bpt.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.NotNil(t, pos)
+			assert.Equal(t, int64(i), pos.Offset)
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, bpt.Get([]byte(fmt.Sprintf("missing-%d", i))))
+		}
+	}
+	checkKeys(bpt)
+	_, ok := bpt.Delete([]byte("key-0"))
+	assert.True(t, ok)
+	assert.Nil(t, bpt.Get([]byte("key-0")))
+	assert.Nil(t, bpt.Put([]byte("key-0"), &data.LogRecordPos{Fid: 1, Offset: 0}))
+
+	// 关闭时持久化，启动时加载之后删除
+	assert.Nil(t, bpt.Close())
+	_, err := os.Stat(bloomPath)
+	assert.Nil(t, err)
+	bpt = index.NewBPlusTreeIndex(options)
+	_, err = os.Stat(bloomPath)
+	assert.True(t, os.IsNotExist(err))
+	checkKeys(bpt)
+	assert.Nil(t, bpt.Close())
+
+	// 文件损坏时重新构建
+	assert.Nil(t, os.WriteFile(bloomPath, []byte("corrupt"), 0644))
+	bpt = index.NewBPlusTreeIndex(options)
+	checkKeys(bpt)
+	assert.Nil(t, bpt.Close())
+
+	// 在没有布隆过滤器的情况下写入的 key，重新开启之后依然能够读取
+	options.BloomFilterBitsPerKey = 0
+	bpt = index.NewBPlusTreeIndex(options)
+	_, err = os.Stat(bloomPath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, bpt.Put([]byte("key-without-bloom"), &data.LogRecordPos{Fid: 1}))
+	assert.Nil(t, bpt.Close())
+	options.BloomFilterBitsPerKey = 10
+	bpt = index.NewBPlusTreeIndex(options)
+	assert.NotNil(t, bpt.Get([]byte("key-without-bloom")))
+	checkKeys(bpt)
+	assert.Nil(t, bpt.Close())
+}
@@ -0,0 +1,228 @@
+package index
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fairy-kvdb/index"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDeleteRange(t *testing.T, idx index.Indexer) {
+	for i := 0; i < 20; i++ {
+		idx.Put([]byte(fmt.Sprintf("key%02d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	idx.Put([]byte("other"), &data.LogRecordPos{Fid: 1, Offset: 100})
+
+	// [key05, key10)
+	var deleted []string
+	idx.DeleteRange([]byte("key05"), []byte("key10"), func(key []byte, pos *data.LogRecordPos) {
+		assert.Equal(t, fmt.Sprintf("key%02d", pos.Offset), string(key))
+		deleted = append(deleted, string(key))
+	})
+	assert.Equal(t, []string{"key05", "key06", "key07", "key08", "key09"}, deleted)
+	assert.Nil(t, idx.Get([]byte("key05")))
+	assert.NotNil(t, idx.Get([]byte("key04")))
+	assert.NotNil(t, idx.Get([]byte("key10")))
+	assert.Equal(t, 16, idx.Size())
+
+	// 没有上界
+	deleted = nil
+	idx.DeleteRange([]byte("key15"), nil, func(key []byte, pos *data.LogRecordPos) {
+		deleted = append(deleted, string(key))
+	})
+	assert.Equal(t, 6, len(deleted))
+	assert.Nil(t, idx.Get([]byte("other")))
+	assert.Equal(t, 10, idx.Size())
+
+	// 空范围
+	idx.DeleteRange([]byte("a"), []byte("b"), func(key []byte, pos *data.LogRecordPos) {
+		t.Fatalf("unexpected key %s", key)
+	})
+	assert.Equal(t, 10, idx.Size())
+}
+
+func TestIndexer_DeleteRange(t *testing.T) {
+	t.Run("btree", func(t *testing.T) {
+		testDeleteRange(t, index.NewBTree())
+	})
+	t.Run("art", func(t *testing.T) {
+		testDeleteRange(t, index.NewAdaptiveRadixTreeIndex())
+	})
+	t.Run("bptree", func(t *testing.T) {
+		dirPath := filepath.Join(fairydb.DefaultOptions.DataDir, "bptree-range")
+		_ = os.RemoveAll(dirPath)
+		defer func() {
+			_ = os.RemoveAll(dirPath)
+		}()
+		bpt := index.NewBPlusTreeIndex(&index.BPlusTreeIndexOptions{BboltOptions: bbolt.DefaultOptions, DataDir: dirPath})
+		defer bpt.Close()
+		testDeleteRange(t, bpt)
+	})
+}
+
+func iterKeys(iter index.Iterator) []string {
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+func testRangeIterator(t *testing.T, idx index.Indexer) {
+	const count = 200
+	for i := 0; i < count; i++ {
+		idx.Put([]byte(fmt.Sprintf("key%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 超过一个批次的数据
+	iter := idx.RangeIterator(nil, nil, false)
+	keys := iterKeys(iter)
+	iter.Close()
+	assert.Equal(t, count, len(keys))
+	assert.Equal(t, "key000", keys[0])
+	assert.Equal(t, "key199", keys[count-1])
+
+	// [key050, key120)
+	iter = idx.RangeIterator([]byte("key050"), []byte("key120"), false)
+	keys = iterKeys(iter)
+	assert.Equal(t, 70, len(keys))
+	assert.Equal(t, "key050", keys[0])
+	assert.Equal(t, "key119", keys[69])
+	iter.Seek([]byte("a"))
+	assert.Equal(t, "key050", string(iter.Key()))
+	iter.Seek([]byte("key100"))
+	assert.Equal(t, "key100", string(iter.Key()))
+	iter.Seek([]byte("key120"))
+	assert.False(t, iter.Valid())
+	iter.Close()
+
+	// 逆序 [key050, key120)
+	iter = idx.RangeIterator([]byte("key050"), []byte("key120"), true)
+	keys = iterKeys(iter)
+	assert.Equal(t, 70, len(keys))
+	assert.Equal(t, "key119", keys[0])
+	assert.Equal(t, "key050", keys[69])
+	iter.Seek([]byte("z"))
+	assert.Equal(t, "key119", string(iter.Key()))
+	iter.Seek([]byte("key0995"))
+	assert.Equal(t, "key099", string(iter.Key()))
+	iter.Seek([]byte("key049"))
+	assert.False(t, iter.Valid())
+	iter.Rewind()
+	assert.Equal(t, "key119", string(iter.Key()))
+	iter.Close()
+
+	// 只有一个边界
+	iter = idx.RangeIterator([]byte("key190"), nil, false)
+	assert.Equal(t, 10, len(iterKeys(iter)))
+	iter.Close()
+	iter = idx.RangeIterator(nil, []byte("key010"), true)
+	keys = iterKeys(iter)
+	iter.Close()
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "key009", keys[0])
+}
+
+func TestIndexer_RangeIterator(t *testing.T) {
+	t.Run("btree", func(t *testing.T) {
+		testRangeIterator(t, index.NewBTree())
+	})
+	t.Run("art", func(t *testing.T) {
+		testRangeIterator(t, index.NewAdaptiveRadixTreeIndex())
+	})
+	t.Run("bptree", func(t *testing.T) {
+		dirPath := filepath.Join(fairydb.DefaultOptions.DataDir, "bptree-range-iter")
+		_ = os.RemoveAll(dirPath)
+		defer func() {
+			_ = os.RemoveAll(dirPath)
+		}()
+		bpt := index.NewBPlusTreeIndex(&index.BPlusTreeIndexOptions{BboltOptions: bbolt.DefaultOptions, DataDir: dirPath})
+		defer bpt.Close()
+		testRangeIterator(t, bpt)
+	})
+}
+
+func TestBTreeIterator_Isolation(t *testing.T) {
+	bt := index.NewBTree()
+	for i := 0; i < 200; i++ {
+		bt.Put([]byte(fmt.Sprintf("key%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := bt.Iterator(false)
+	defer iter.Close()
+	// 创建迭代器之后的写入不影响遍历结果
+	bt.Put([]byte("key0005"), &data.LogRecordPos{Fid: 2})
+	bt.Delete([]byte("key150"))
+	keys := iterKeys(iter)
+	assert.Equal(t, 200, len(keys))
+	assert.Equal(t, "key150", keys[150])
+	assert.Equal(t, 200, bt.Size())
+}
+
+func TestArtIterator_RandomRanges(t *testing.T) {
+	// 以 BTree 的遍历结果为准，key 中包含 0x00、0xff 以及互为前缀的情况
+	rnd := rand.New(rand.NewSource(1))
+	randomKey := func() []byte {
+		key := make([]byte, rnd.Intn(6))
+		for i := range key {
+			key[i] = []byte{0x00, 'a', 'b', 'c', 0xff}[rnd.Intn(5)]
+		}
+		return key
+	}
+	art, bt := index.NewAdaptiveRadixTreeIndex(), index.NewBTree()
+	for i := 0; i < 1000; i++ {
+		key := randomKey()
+		if len(key) == 0 {
+			continue
+		}
+		art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		bt.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	for i := 0; i < 500; i++ {
+		lower, upper, seek := randomKey(), randomKey(), randomKey()
+		if rnd.Intn(4) == 0 {
+			lower = nil
+		}
+		if rnd.Intn(4) == 0 {
+			upper = nil
+		}
+		reverse := rnd.Intn(2) == 0
+		expected, actual := bt.RangeIterator(lower, upper, reverse), art.RangeIterator(lower, upper, reverse)
+		assert.Equal(t, iterKeys(expected), iterKeys(actual))
+		expected.Seek(seek)
+		actual.Seek(seek)
+		assert.Equal(t, iterKeys(expected), iterKeys(actual))
+		expected.Close()
+		actual.Close()
+	}
+}
+
+func TestArtIterator_ModifyWhileIterating(t *testing.T) {
+	// 遍历过程中树的结构发生变化，之后的批次改为按照前缀重新定位，结果仍然有序且不重复
+	art := index.NewAdaptiveRadixTreeIndex()
+	for i := 0; i < 1000; i++ {
+		art.Put([]byte(fmt.Sprintf("key%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := art.Iterator(false)
+	defer iter.Close()
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		if len(keys) == 10 {
+			art.Put([]byte("key0500!"), &data.LogRecordPos{Fid: 1})
+			art.Delete([]byte("key0600"))
+			art.Put([]byte("key0005!"), &data.LogRecordPos{Fid: 1})
+		}
+	}
+	assert.Equal(t, 1000, len(keys))
+	for i := 1; i < len(keys); i++ {
+		assert.Less(t, keys[i-1], keys[i])
+	}
+	assert.Contains(t, keys, "key0500!")
+	assert.NotContains(t, keys, "key0600")
+}
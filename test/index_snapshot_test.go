@@ -0,0 +1,107 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 4 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	snapshotPath := filepath.Join(options.DataDir, data.IndexSnapshotFileName)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+
+	cf, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+		err = cf.Put([]byte(fmt.Sprintf("user-%d", i)), []byte(fmt.Sprintf("name-%d", i)))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err = db.Delete([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+	}
+	stat, fileStats := db.Stat(), db.FileStats()
+	err = db.Close()
+	assert.Nil(t, err)
+	snapshot, err := os.ReadFile(snapshotPath)
+	assert.Nil(t, err)
+
+	check := func(db *fairydb.DB, extra int) {
+		cf, err := db.ColumnFamily("users")
+		assert.Nil(t, err)
+		for i := 0; i < 300+extra; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%d", i)))
+			if i < 100 {
+				assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+			}
+		}
+		for i := 0; i < 300; i++ {
+			val, err := cf.Get([]byte(fmt.Sprintf("user-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("name-%d", i), string(val))
+		}
+	}
+
+	// 从快照中恢复的索引与统计信息和关闭之前一致
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db, 0)
+	assert.Equal(t, stat.KeyNum, db.Stat().KeyNum)
+	assert.Equal(t, stat.ReclaimableSize, db.Stat().ReclaimableSize)
+	assert.Equal(t, fileStats, db.FileStats())
+	// 继续写入，之后换回旧的快照，模拟没有正常关闭的情况，快照之后写入的记录会被重放
+	for i := 300; i < 400; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		assert.Nil(t, err)
+	}
+	stat = db.Stat()
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.WriteFile(snapshotPath, snapshot, 0644)
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db, 100)
+	assert.Equal(t, stat.KeyNum, db.Stat().KeyNum)
+	assert.Equal(t, stat.ReclaimableSize, db.Stat().ReclaimableSize)
+
+	// merge 之后旧的快照已经失效，启动时完整地重放数据文件
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	err = os.WriteFile(snapshotPath, snapshot, 0644)
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db, 100)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 损坏的快照同样会被忽略
+	snapshot, err = os.ReadFile(snapshotPath)
+	assert.Nil(t, err)
+	snapshot[len(snapshot)/2] ^= 0xff
+	err = os.WriteFile(snapshotPath, snapshot, 0644)
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	check(db, 100)
+	err = db.Close()
+	assert.Nil(t, err)
+}
@@ -2,6 +2,7 @@ package test
 
 import (
 	fairydb "fairy-kvdb"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -17,6 +18,10 @@ func TestDB_NewIterator(t *testing.T) {
 	iter := db.NewIterator(&fairydb.DefaultIteratorOptions)
 	assert.NotNil(t, iter)
 	assert.Equal(t, false, iter.Valid())
+	// 迭代器在 Close 之前一直作为读视图存在
+	assert.Equal(t, 1, db.Stat().ActiveReaders)
+	iter.Close()
+	assert.Equal(t, 0, db.Stat().ActiveReaders)
 	err = db.Close()
 	assert.Nil(t, err)
 }
@@ -119,3 +124,67 @@ func TestDB_Iterator_MultiRecords(t *testing.T) {
 	err = db.Close()
 	assert.Nil(t, err)
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user:%03d", i)), []byte(fmt.Sprintf("%d", i))))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("order:%03d", i)), []byte(fmt.Sprintf("%d", i))))
+	}
+	collect := func(iterOptions fairydb.IteratorOptions) []string {
+		iter := db.NewIterator(&iterOptions)
+		defer iter.Close()
+		var keys []string
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+
+	// 上下界
+	keys := collect(fairydb.IteratorOptions{LowerBound: []byte("user:010"), UpperBound: []byte("user:020")})
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "user:010", keys[0])
+	assert.Equal(t, "user:019", keys[9])
+	keys = collect(fairydb.IteratorOptions{LowerBound: []byte("user:010"), UpperBound: []byte("user:020"), Reverse: true})
+	assert.Equal(t, 10, len(keys))
+	assert.Equal(t, "user:019", keys[0])
+
+	// 前缀与上下界同时生效
+	keys = collect(fairydb.IteratorOptions{Prefix: []byte("user:"), LowerBound: []byte("order:050")})
+	assert.Equal(t, 100, len(keys))
+	keys = collect(fairydb.IteratorOptions{Prefix: []byte("order:"), LowerBound: []byte("order:095")})
+	assert.Equal(t, []string{"order:095", "order:096", "order:097", "order:098", "order:099"}, keys)
+
+	// 数量限制
+	keys = collect(fairydb.IteratorOptions{Prefix: []byte("user:"), Limit: 3, Reverse: true})
+	assert.Equal(t, []string{"user:099", "user:098", "user:097"}, keys)
+	iter := db.NewIterator(&fairydb.IteratorOptions{Prefix: []byte("order:"), Limit: 2})
+	iter.Seek([]byte("order:050"))
+	assert.Equal(t, "order:050", string(iter.Key()))
+	iter.Next()
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Rewind()
+	assert.Equal(t, "order:000", string(iter.Key()))
+	iter.Close()
+
+	// 快照迭代器同样支持上下界和数量限制
+	snap := db.Snapshot()
+	assert.Nil(t, db.Delete([]byte("user:015")))
+	snapIter := snap.Iterator(fairydb.IteratorOptions{LowerBound: []byte("user:014"), UpperBound: []byte("user:020"), Limit: 3})
+	keys = nil
+	for ; snapIter.Valid(); snapIter.Next() {
+		keys = append(keys, string(snapIter.Key()))
+	}
+	snapIter.Close()
+	snap.Release()
+	assert.Equal(t, []string{"user:014", "user:015", "user:016"}, keys)
+
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,239 @@
+package test
+
+import (
+	"bytes"
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// 将操作数以逗号追加到已有值之后
+type appendOperator struct{}
+
+func (appendOperator) FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	values := operands
+	if existing != nil {
+		values = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(values, []byte(",")), nil
+}
+
+func TestDB_MergeValue(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	err = db.MergeValue([]byte("list"), []byte("a"))
+	assert.Equal(t, fairydb.ErrorMergeOperatorMissing, err)
+	assert.Nil(t, db.Close())
+
+	options.MergeOperator = appendOperator{}
+	db, err = fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("list"), []byte("a")))
+	assert.Nil(t, db.MergeValue([]byte("list"), []byte("b")))
+	snap := db.Snapshot()
+	assert.Nil(t, db.MergeValue([]byte("list"), []byte("c")))
+	// 没有基础值时只合并操作数
+	assert.Nil(t, db.MergeValue([]byte("new"), []byte("x")))
+	assert.Nil(t, db.MergeValue([]byte("new"), []byte("y")))
+
+	val, err := db.Get([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b,c", string(val))
+	val, err = snap.Get([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b", string(val))
+	snap.Release()
+
+	iter := db.NewIterator(&fairydb.DefaultIteratorOptions)
+	values := make(map[string]string)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		values[string(iter.Key())] = string(iter.Value())
+	}
+	iter.Close()
+	assert.Equal(t, map[string]string{"list": "a,b,c", "new": "x,y"}, values)
+
+	// 删除之后重新开始合并
+	assert.Nil(t, db.Delete([]byte("new")))
+	assert.Nil(t, db.MergeValue([]byte("new"), []byte("z")))
+
+	// 重启之后重放操作数
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b,c", string(val))
+	val, err = db.Get([]byte("new"))
+	assert.Nil(t, err)
+	assert.Equal(t, "z", string(val))
+	assert.Nil(t, db.MergeValue([]byte("list"), []byte("d")))
+	val, err = db.Get([]byte("list"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b,c,d", string(val))
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_MergeValueCompaction(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		t.Run(fmt.Sprintf("incremental=%v", incremental), func(t *testing.T) {
+			options := fairydb.DefaultOptions
+			options.MaxFileSize = 32 * 1024
+			options.MergeRatio = 0
+			options.MergeOperator = appendOperator{}
+			ClearDatabaseDir(options.DataDir)
+			db, err := fairydb.Open(options)
+			defer ClearDatabaseDir(options.DataDir)
+			assert.Nil(t, err)
+
+			const lists, count = 10, 2000
+			listKey := func(i int) []byte { return []byte(fmt.Sprintf("list-%d", i)) }
+			for i := 0; i < lists; i++ {
+				assert.Nil(t, db.Put(listKey(i), []byte("base")))
+			}
+			for i := 0; i < count; i++ {
+				assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+			}
+			// 覆盖写最早写入的一部分 key，让前面的文件产生大量无效数据
+			for i := 0; i < count/4; i++ {
+				assert.Nil(t, db.Put(utils.RandomTestKey(i), []byte("new-value")))
+			}
+			// 操作数链从最早的文件一直延伸到活跃文件
+			for i := 0; i < lists; i++ {
+				assert.Nil(t, db.MergeValue(listKey(i), []byte("x")))
+				assert.Nil(t, db.MergeValue(listKey(i), []byte("y")))
+			}
+
+			if incremental {
+				err = db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.5})
+			} else {
+				err = db.Merge()
+			}
+			assert.Nil(t, err)
+
+			checkData := func(db *fairydb.DB, expected string) {
+				for i := 0; i < lists; i++ {
+					val, err := db.Get(listKey(i))
+					assert.Nil(t, err)
+					assert.Equal(t, expected, string(val))
+				}
+				for i := 0; i < count; i++ {
+					val, err := db.Get(utils.RandomTestKey(i))
+					assert.Nil(t, err)
+					if i < count/4 {
+						assert.Equal(t, "new-value", string(val))
+					} else {
+						assert.Equal(t, 64, len(val))
+					}
+				}
+			}
+			checkData(db, "base,x,y")
+			for i := 0; i < lists; i++ {
+				assert.Nil(t, db.MergeValue(listKey(i), []byte("z")))
+			}
+			checkData(db, "base,x,y,z")
+
+			assert.Nil(t, db.Close())
+			db, err = fairydb.Open(options)
+			assert.Nil(t, err)
+			checkData(db, "base,x,y,z")
+			assert.Nil(t, db.Close())
+		})
+	}
+}
+
+func TestDB_MergeValueChangesSince(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0
+	options.MergeOperator = appendOperator{}
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	const count = 2000
+	assert.Nil(t, db.Put([]byte("list"), []byte("base")))
+	for i := 0; i < count; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	for i := 0; i < count/4; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), []byte("new-value")))
+	}
+	assert.Nil(t, db.MergeValue([]byte("list"), []byte("x")))
+	assert.Nil(t, db.MergeValue([]byte("list"), []byte("y")))
+	seq := db.LatestSequence()
+	// 让链头所在的文件不再是活跃文件，并且不参与增量 merge
+	for i := count; i < count+count/2; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	assert.Nil(t, db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.5}))
+
+	// 折叠之后的记录沿用链头的序列号
+	changes, err := db.ChangesSince(seq - 1)
+	assert.Nil(t, err)
+	var values []string
+	for _, event := range changes {
+		if string(event.Key) == "list" {
+			assert.Equal(t, seq, event.Btsn)
+			if event.Type == fairydb.EventPut {
+				values = append(values, string(event.Value))
+			}
+		}
+	}
+	assert.Equal(t, []string{"base,x,y"}, values)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_MergeValueCollapseFileIds(t *testing.T) {
+	// 增量 merge 只重写了一个文件，但折叠之后的操作数链比文件本身大得多，需要更多的文件 ID
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 4 * 1024
+	options.MergeRatio = 0
+	options.MergeOperator = appendOperator{}
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	const lists = 8
+	for i := 0; i < lists; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("list-%d", i)), []byte("base")))
+	}
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	for i := 0; i < 30; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), []byte("new-value")))
+	}
+	operand := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < lists; i++ {
+		for j := 0; j < 5; j++ {
+			assert.Nil(t, db.MergeValue([]byte(fmt.Sprintf("list-%d", i)), operand))
+		}
+	}
+	expected := "base" + strings.Repeat(","+string(operand), 5)
+
+	// 预留的文件 ID 不够时 merge 失败，之后的 merge 会预留更多的文件 ID
+	err = db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.5})
+	for i := 0; err == fairydb.ErrorMergeFileIdExhausted && i < 4; i++ {
+		err = db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.5})
+	}
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	for i := 0; i < lists; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("list-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(val))
+	}
+	assert.Nil(t, db.Close())
+}
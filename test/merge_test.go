@@ -0,0 +1,263 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDB_Merge(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	const count = 1000
+	for i := 0; i < count; i++ {
+		err = db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64))
+		assert.Nil(t, err)
+	}
+	// 覆盖写一半，删除一部分
+	for i := 0; i < count/2; i++ {
+		err = db.Put(utils.RandomTestKey(i), []byte("new-value"))
+		assert.Nil(t, err)
+	}
+	for i := count / 2; i < count*3/4; i++ {
+		err = db.Delete(utils.RandomTestKey(i))
+		assert.Nil(t, err)
+	}
+	statBefore := db.Stat()
+	assert.Less(t, uint64(0), statBefore.ReclaimableSize)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// merge 的结果在线生效，不需要重启
+	statAfter := db.Stat()
+	assert.Equal(t, uint64(0), statAfter.ReclaimableSize)
+	assert.Less(t, statAfter.DataFileNum, statBefore.DataFileNum)
+	assert.Less(t, statAfter.DiskSize, statBefore.DiskSize)
+	assert.Equal(t, uint(count*3/4), statAfter.KeyNum)
+	checkMergedData := func(db *fairydb.DB) {
+		for i := 0; i < count; i++ {
+			val, err := db.Get(utils.RandomTestKey(i))
+			if i < count/2 {
+				assert.Nil(t, err)
+				assert.Equal(t, "new-value", string(val))
+			} else if i < count*3/4 {
+				assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, 64, len(val))
+			}
+		}
+	}
+	checkMergedData(db)
+
+	// merge 之后继续写入，重启之后数据依然正确
+	err = db.Put([]byte("after-merge"), []byte("ok"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkMergedData(db)
+	val, err := db.Get([]byte("after-merge"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(val))
+
+	// 再次 merge
+	err = db.Merge()
+	assert.Nil(t, err)
+	checkMergedData(db)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_MergeIncremental(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	const count = 2000
+	for i := 0; i < count; i++ {
+		err = db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64))
+		assert.Nil(t, err)
+	}
+	// 只覆盖写最早写入的一部分 key，让前面的文件产生大量无效数据
+	for i := 0; i < count/4; i++ {
+		err = db.Put(utils.RandomTestKey(i), []byte("new-value"))
+		assert.Nil(t, err)
+	}
+	dirtyFids := make(map[uint32]bool)
+	cleanFids := make(map[uint32]bool)
+	for _, stat := range db.FileStats() {
+		if stat.GarbageRatio >= 0.5 {
+			dirtyFids[stat.FileId] = true
+		} else if stat.Size > 0 {
+			cleanFids[stat.FileId] = true
+		}
+	}
+	assert.NotEmpty(t, dirtyFids)
+	assert.NotEmpty(t, cleanFids)
+	reclaimBefore := db.Stat().ReclaimableSize
+
+	err = db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+
+	// 只有无效数据较多的文件被重写，其他文件保持不变
+	fids := make(map[uint32]bool)
+	for _, stat := range db.FileStats() {
+		fids[stat.FileId] = true
+		assert.Less(t, stat.GarbageRatio, 0.5)
+	}
+	for fid := range dirtyFids {
+		assert.False(t, fids[fid])
+	}
+	for fid := range cleanFids {
+		assert.True(t, fids[fid])
+	}
+	assert.Less(t, db.Stat().ReclaimableSize, reclaimBefore)
+
+	checkData := func(db *fairydb.DB) {
+		for i := 0; i < count; i++ {
+			val, err := db.Get(utils.RandomTestKey(i))
+			assert.Nil(t, err)
+			if i < count/4 {
+				assert.Equal(t, "new-value", string(val))
+			} else {
+				assert.Equal(t, 64, len(val))
+			}
+		}
+	}
+	checkData(db)
+
+	// 没有满足条件的文件时不需要 merge
+	err = db.MergeWithOptions(fairydb.MergeOptions{Incremental: true, MinGarbageRatio: 0.99})
+	assert.Equal(t, fairydb.ErrorMergeRatioUnreached, err)
+
+	// 重启之后，未参与 merge 的文件的索引通过 Hint 文件加载
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+	for _, stat := range db.FileStats() {
+		assert.Less(t, stat.GarbageRatio, 0.5)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_MergeWithSnapshot(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	const count = 500
+	for i := 0; i < count; i++ {
+		err = db.Put(utils.RandomTestKey(i), []byte("old-value"))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+	for i := 0; i < count; i++ {
+		err = db.Put(utils.RandomTestKey(i), []byte("new-value"))
+		assert.Nil(t, err)
+	}
+	statBefore := db.Stat()
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 快照引用的旧文件在快照释放之前依然可以读取
+	for i := 0; i < count; i++ {
+		val, err := snap.Get(utils.RandomTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, "old-value", string(val))
+		val, err = db.Get(utils.RandomTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, "new-value", string(val))
+	}
+	assert.Less(t, statBefore.DiskSize, db.Stat().DiskSize)
+
+	// merge 之后创建的快照不会引用旧文件，不需要等待它释放
+	newSnap := db.Snapshot()
+	// 快照释放之后旧文件被删除
+	snap.Release()
+	assert.Greater(t, statBefore.DiskSize, db.Stat().DiskSize)
+	for i := 0; i < count; i++ {
+		val, err := newSnap.Get(utils.RandomTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, "new-value", string(val))
+	}
+	newSnap.Release()
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0.3
+	options.AutoMergeInterval = time.Millisecond * 20
+	options.AutoMergeMinReclaimSize = 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	const count = 500
+	for round := 0; round < 3; round++ {
+		for i := 0; i < count; i++ {
+			err = db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64))
+			assert.Nil(t, err)
+		}
+	}
+	// 等待后台 merge 执行
+	deadline := time.Now().Add(time.Second * 5)
+	for db.Stat().AutoMergeCount == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	stat := db.Stat()
+	assert.Less(t, uint64(0), stat.AutoMergeCount)
+	assert.Equal(t, stat.AutoMergeCount, stat.MergeCount)
+	assert.Less(t, int64(0), stat.LastMergeTime)
+	assert.Equal(t, "", stat.LastAutoMergeError)
+	for i := 0; i < count; i++ {
+		val, err := db.Get(utils.RandomTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, 64, len(val))
+	}
+
+	// Close 会停止后台 merge
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestMergeWindow_Contains(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	window := fairydb.MergeWindow{Start: time.Hour * 2, End: time.Hour * 4}
+	assert.True(t, window.Contains(day.Add(time.Hour*3)))
+	assert.False(t, window.Contains(day.Add(time.Hour*5)))
+	// 跨越零点的窗口
+	nightWindow := fairydb.MergeWindow{Start: time.Hour * 22, End: time.Hour * 6}
+	assert.True(t, nightWindow.Contains(day.Add(time.Hour*23)))
+	assert.True(t, nightWindow.Contains(day.Add(time.Hour*1)))
+	assert.False(t, nightWindow.Contains(day.Add(time.Hour*12)))
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"context"
+	fairydb "fairy-kvdb"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_DeleteRange(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("tenant-a:%d", i)), []byte("a")))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("tenant-b:%d", i)), []byte("b")))
+	}
+	assert.Equal(t, fairydb.ErrorInvalidRange, db.DeleteRange([]byte("b"), []byte("a")))
+	assert.Equal(t, fairydb.ErrorInvalidRange, db.DeleteRange([]byte("a"), []byte("a")))
+
+	snap := db.Snapshot()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := db.Watch(ctx, []byte("tenant-a:"))
+
+	reclaimBefore := db.Stat().ReclaimableSize
+	assert.Nil(t, db.DeleteRange([]byte("key-010"), []byte("key-050")))
+	assert.Nil(t, db.DeletePrefix([]byte("tenant-a:")))
+	// 范围删除之后重新写入的 key 不受影响
+	assert.Nil(t, db.Put([]byte("key-020"), []byte("again")))
+	assert.Less(t, reclaimBefore, db.Stat().ReclaimableSize)
+
+	event := receiveEvents(t, ch, 1)[0]
+	assert.Equal(t, fairydb.EventDeleteRange, event.Type)
+	assert.Equal(t, "tenant-a:", string(event.Key))
+	assert.Equal(t, "tenant-a;", string(event.Value))
+
+	// 快照依然能看到范围删除之前的数据
+	val, err := snap.Get([]byte("key-030"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-30", string(val))
+	val, err = snap.Get([]byte("tenant-a:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(val))
+	snap.Release()
+
+	checkData := func(db *fairydb.DB) {
+		for i := 0; i < 100; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+			if i == 20 {
+				assert.Nil(t, err)
+				assert.Equal(t, "again", string(val))
+			} else if i >= 10 && i < 50 {
+				assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprintf("value-%d", i), string(val))
+			}
+		}
+		for i := 0; i < 10; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("tenant-a:%d", i)))
+			assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+			val, err := db.Get([]byte(fmt.Sprintf("tenant-b:%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "b", string(val))
+		}
+		assert.Equal(t, uint(71), db.Stat().KeyNum)
+	}
+	checkData(db)
+
+	// 重启之后通过重放范围删除记录恢复索引
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+
+	// merge 之后范围删除记录被清理掉，重启之后数据依然正确
+	assert.Nil(t, db.Merge())
+	checkData(db)
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	checkData(db)
+
+	// 删除所有的 key
+	assert.Nil(t, db.DeletePrefix(nil))
+	assert.Equal(t, uint(0), db.Stat().KeyNum)
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(0), db.Stat().KeyNum)
+	assert.Nil(t, db.Close())
+}
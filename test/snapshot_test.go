@@ -0,0 +1,77 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("name"), []byte("zhangSan"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("age"), []byte("18"))
+	assert.Nil(t, err)
+
+	snap := db.Snapshot()
+	// 快照创建之后的写入
+	err = db.Put([]byte("name"), []byte("liSi"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("age"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("sex"), []byte("1"))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("city"), []byte("beijing")))
+	assert.Nil(t, wb.Commit())
+
+	// case: Get
+	val, err := snap.Get([]byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "zhangSan", string(val))
+	val, err = snap.Get([]byte("age"))
+	assert.Nil(t, err)
+	assert.Equal(t, "18", string(val))
+	_, err = snap.Get([]byte("sex"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	_, err = snap.Get([]byte("city"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	// case: Iterator
+	iter := snap.Iterator(fairydb.DefaultIteratorOptions)
+	var keys, values []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(iter.Value()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"age", "name"}, keys)
+	assert.Equal(t, []string{"18", "zhangSan"}, values)
+
+	// case: Fold
+	cnt := 0
+	err = snap.Fold(func(key []byte, value []byte) bool {
+		cnt++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+
+	// 数据库本身看到的是最新的数据
+	val, err = db.Get([]byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "liSi", string(val))
+
+	snap.Release()
+	_, err = snap.Get([]byte("name"))
+	assert.Equal(t, fairydb.ErrorSnapshotReleased, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
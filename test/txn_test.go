@@ -0,0 +1,205 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTxn_SnapshotRead(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("name"), []byte("zhangSan"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("age"), []byte("18"))
+	assert.Nil(t, err)
+
+	txn := db.Begin(true)
+	// 事务开始之后的写入对事务不可见
+	err = db.Put([]byte("name"), []byte("liSi"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("age"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("sex"), []byte("1"))
+	assert.Nil(t, err)
+
+	val, err := txn.Get([]byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "zhangSan", string(val))
+	val, err = txn.Get([]byte("age"))
+	assert.Nil(t, err)
+	assert.Equal(t, "18", string(val))
+	_, err = txn.Get([]byte("sex"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Equal(t, fairydb.ErrorTxnReadOnly, txn.Put([]byte("name"), []byte("wangWu")))
+
+	iter := txn.Iterator(fairydb.DefaultIteratorOptions)
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "age", string(iter.Key()))
+	assert.Equal(t, "18", string(iter.Value()))
+	iter.Next()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "name", string(iter.Key()))
+	assert.Equal(t, "zhangSan", string(iter.Value()))
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Close()
+
+	assert.Nil(t, txn.Commit())
+	_, err = txn.Get([]byte("name"))
+	assert.Equal(t, fairydb.ErrorTxnFinished, err)
+
+	// 新的事务可以看到最新的数据
+	txn2 := db.Begin(true)
+	val, err = txn2.Get([]byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "liSi", string(val))
+	txn2.Rollback()
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestTxn_ReadYourWrites(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("a"), []byte("1"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("b"), []byte("2"))
+	assert.Nil(t, err)
+
+	txn := db.Begin(false)
+	assert.Nil(t, txn.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, txn.Delete([]byte("a")))
+	val, err := txn.Get([]byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(val))
+	_, err = txn.Get([]byte("a"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	iterOptions := fairydb.DefaultIteratorOptions
+	iterOptions.Reverse = true
+	iter := txn.Iterator(iterOptions)
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"c", "b"}, keys)
+
+	// 提交之前对数据库不可见
+	_, err = db.Get([]byte("c"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Nil(t, txn.Commit())
+	val, err = db.Get([]byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(val))
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	// 回滚的事务不会产生任何写入
+	txn2 := db.Begin(false)
+	assert.Nil(t, txn2.Put([]byte("d"), []byte("4")))
+	txn2.Rollback()
+	_, err = db.Get([]byte("d"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	// 重启后提交的事务依然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("c"))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(val))
+	_, err = db.Get([]byte("a"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestTxn_Conflict(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put([]byte("balance"), []byte("100"))
+	assert.Nil(t, err)
+
+	// 两个事务同时对同一个 key 做 read-modify-write，后提交的事务会冲突
+	txn1 := db.Begin(false)
+	txn2 := db.Begin(false)
+	_, err = txn1.Get([]byte("balance"))
+	assert.Nil(t, err)
+	_, err = txn2.Get([]byte("balance"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn1.Put([]byte("balance"), []byte("90")))
+	assert.Nil(t, txn2.Put([]byte("balance"), []byte("80")))
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, fairydb.ErrorTxnConflict, txn2.Commit())
+	val, err := db.Get([]byte("balance"))
+	assert.Nil(t, err)
+	assert.Equal(t, "90", string(val))
+
+	// 非事务的写入同样会导致冲突
+	txn3 := db.Begin(false)
+	_, err = txn3.Get([]byte("balance"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn3.Put([]byte("balance"), []byte("70")))
+	err = db.Put([]byte("balance"), []byte("60"))
+	assert.Nil(t, err)
+	assert.Equal(t, fairydb.ErrorTxnConflict, txn3.Commit())
+
+	// 互不相交的事务都可以提交成功
+	txn4 := db.Begin(false)
+	txn5 := db.Begin(false)
+	assert.Nil(t, txn4.Put([]byte("x"), []byte("1")))
+	assert.Nil(t, txn5.Put([]byte("y"), []byte("2")))
+	assert.Nil(t, txn4.Commit())
+	assert.Nil(t, txn5.Commit())
+
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestTxn_CommitSync(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.BytesPerSync = 1024 * 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// Commit 沿用数据库默认的写入配置，不会单独持久化
+	txn := db.Begin(false)
+	assert.Nil(t, txn.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, txn.Put([]byte("b"), []byte("2")))
+	assert.Nil(t, txn.Commit())
+	assert.Equal(t, uint64(0), db.Stat().WriteSyncs)
+
+	// 通过 CommitOpt 强制持久化
+	txn = db.Begin(false)
+	assert.Nil(t, txn.Put([]byte("c"), []byte("3")))
+	_, err = txn.CommitOpt(fairydb.WriteOptions{Sync: true})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), db.Stat().WriteSyncs)
+
+	val, err := db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(val))
+	assert.Nil(t, db.Close())
+}
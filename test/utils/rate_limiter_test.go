@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fairy-kvdb/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	// 不限速
+	noLimit := utils.NewRateLimiter(0)
+	assert.Nil(t, noLimit)
+	noLimit.Wait(1024)
+
+	// 每秒 10KB，写 3 次 5KB 至少需要 1 秒
+	limiter := utils.NewRateLimiter(10 * 1024)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Wait(5 * 1024)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*900)
+}
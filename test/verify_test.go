@@ -0,0 +1,169 @@
+package test
+
+import (
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_Verify(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte("value"))
+		assert.Nil(t, err)
+	}
+	report, err := db.Verify()
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 100, report.RecordsChecked)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestRepair(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 4 * 1024
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	const count = 600
+	for i := 0; i < count; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		assert.Nil(t, err)
+	}
+	stats := db.FileStats()
+	assert.Less(t, 2, len(stats))
+	activeFid := stats[len(stats)-1].FileId
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 破坏第一个数据文件中间的一条记录
+	firstPath := data.GetDataFilePath(options.DataDir, 0)
+	content, err := os.ReadFile(firstPath)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	err = os.WriteFile(firstPath, content, 0644)
+	assert.Nil(t, err)
+	// hint 文件和索引快照不会校验数据文件的内容，删除之后启动时才会扫描到损坏的记录
+	err = os.Remove(data.GetFileHintPath(options.DataDir, 0))
+	assert.Nil(t, err)
+	err = os.Remove(filepath.Join(options.DataDir, data.IndexSnapshotFileName))
+	assert.Nil(t, err)
+	// 在活跃文件末尾写入一个没有结束标记的 batch 和一条不完整的记录
+	activeFile, err := os.OpenFile(data.GetDataFilePath(options.DataDir, activeFid), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	batchRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("batch-key"), Value: []byte("v"), Btsn: 10000})
+	_, err = activeFile.Write(batchRecord)
+	assert.Nil(t, err)
+	tornRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn-key"), Value: []byte("torn-value")})
+	_, err = activeFile.Write(tornRecord[:len(tornRecord)-3])
+	assert.Nil(t, err)
+	err = activeFile.Close()
+	assert.Nil(t, err)
+
+	report, err := fairydb.VerifyDir(options)
+	assert.Nil(t, err)
+	var types []fairydb.VerifyIssueType
+	for _, issue := range report.Issues {
+		types = append(types, issue.Type)
+	}
+	assert.Equal(t, []fairydb.VerifyIssueType{fairydb.IssueCorruptRecord, fairydb.IssueCorruptRecord, fairydb.IssueUnterminatedBatch}, types)
+
+	// 中间损坏的数据文件无法打开
+	_, err = fairydb.Open(options)
+	assert.Equal(t, data.ErrorInvalidCRC, err)
+
+	report, err = fairydb.Repair(options)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	quarantined, err := os.ReadDir(filepath.Join(options.DataDir, "-quarantine"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(quarantined))
+
+	report, err = fairydb.VerifyDir(options)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	// 修复之后可以正常打开，只有被损坏的那条记录丢失了
+	options.StrictRecovery = true
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	lost := 0
+	for i := 0; i < count; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+		if err == fairydb.ErrorKeyNotFound {
+			lost++
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%03d", i), string(val))
+	}
+	assert.Equal(t, 1, lost)
+	_, err = db.Get([]byte("batch-key"))
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestRepair_RemoveIndexSnapshot(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	defer ClearDatabaseDir(options.DataDir)
+	snapshotPath := filepath.Join(options.DataDir, data.IndexSnapshotFileName)
+	db, err := fairydb.Open(options)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err = db.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%03d", i)))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	_, err = os.Stat(snapshotPath)
+	assert.Nil(t, err)
+
+	// 破坏快照覆盖范围内的一条记录，并在末尾追加记录，修复之后活跃文件仍然不小于快照中记录的大小
+	activePath := data.GetDataFilePath(options.DataDir, 0)
+	content, err := os.ReadFile(activePath)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	for i := 100; i < 110; i++ {
+		record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(fmt.Sprintf("key-%03d", i)), Value: []byte(fmt.Sprintf("value-%03d", i))})
+		content = append(content, record...)
+	}
+	err = os.WriteFile(activePath, content, 0644)
+	assert.Nil(t, err)
+
+	report, err := fairydb.Repair(options)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	// 快照中的位置已经失效，修复时需要删除
+	_, err = os.Stat(snapshotPath)
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	lost := 0
+	for i := 0; i < 110; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key-%03d", i)))
+		if err == fairydb.ErrorKeyNotFound {
+			lost++
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%03d", i), string(val))
+	}
+	assert.Equal(t, 1, lost)
+	err = db.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,277 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	fairydb "fairy-kvdb"
+	"fairy-kvdb/data"
+	"fairy-kvdb/utils"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 从 channel 中读取指定数量的事件
+func receiveEvents(t *testing.T, ch <-chan fairydb.Event, n int) []fairydb.Event {
+	events := make([]fairydb.Event, 0, n)
+	for len(events) < n {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d events", len(events))
+			}
+			events = append(events, event)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout after %d events", len(events))
+		}
+	}
+	return events
+}
+
+func TestDB_Watch(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := db.Watch(ctx, []byte("user:"))
+
+	assert.Nil(t, db.Put([]byte("user:1"), []byte("alice")))
+	assert.Nil(t, db.Put([]byte("order:1"), []byte("ignored")))
+	assert.Nil(t, db.Delete([]byte("user:1")))
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, wb.Put([]byte(fmt.Sprintf("user:%d", i+2)), []byte("batch")))
+	}
+	assert.Nil(t, wb.Put([]byte("order:2"), []byte("ignored")))
+	assert.Nil(t, wb.Commit())
+
+	events := receiveEvents(t, ch, 5)
+	assert.Equal(t, fairydb.EventPut, events[0].Type)
+	assert.Equal(t, "user:1", string(events[0].Key))
+	assert.Equal(t, "alice", string(events[0].Value))
+	assert.Equal(t, fairydb.EventDelete, events[1].Type)
+	assert.Equal(t, "user:1", string(events[1].Key))
+	assert.Less(t, events[0].Btsn, events[1].Btsn)
+	// batch 中的事件连续到达，并且序列号相同
+	for _, event := range events[2:] {
+		assert.Equal(t, fairydb.EventPut, event.Type)
+		assert.Equal(t, "batch", string(event.Value))
+		assert.Equal(t, events[2].Btsn, event.Btsn)
+	}
+	assert.Less(t, events[1].Btsn, events[2].Btsn)
+
+	cancel()
+	for range ch {
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_WatchFrom(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	ch := db.Watch(context.Background(), nil)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	events := receiveEvents(t, ch, 10)
+	cursor := events[4].Btsn
+	assert.Nil(t, db.Close())
+	// 数据库关闭时 channel 会被关闭
+	for range ch {
+	}
+
+	// 重启之后从游标处继续，先重放数据文件中的事件，再收到新的事件
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	ch, err = db.WatchFrom(context.Background(), []byte("key-"), cursor)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key-10"), []byte("value-10")))
+	replayed := receiveEvents(t, ch, 6)
+	for i, event := range replayed {
+		assert.Equal(t, fmt.Sprintf("key-%d", i+5), string(event.Key))
+		assert.Equal(t, fmt.Sprintf("value-%d", i+5), string(event.Value))
+		assert.Greater(t, event.Btsn, cursor)
+		if i > 0 {
+			assert.Greater(t, event.Btsn, replayed[i-1].Btsn)
+		}
+	}
+
+	// merge 之后重启，序列号依然单调递增
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	ch = db.Watch(context.Background(), nil)
+	assert.Nil(t, db.Put([]byte("key-11"), []byte("value-11")))
+	event := receiveEvents(t, ch, 1)[0]
+	assert.Greater(t, event.Btsn, replayed[len(replayed)-1].Btsn)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ChangesSince(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), db.LatestSequence())
+
+	seq1, err := db.PutOpt([]byte("a"), []byte("1"), fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	seq2, err := db.DeleteOpt([]byte("a"), fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	assert.Greater(t, seq2, seq1)
+	// 删除失败时不会产生序列号
+	seq, err := db.DeleteOpt([]byte("a"), fairydb.DefaultWriteOptions)
+	assert.Equal(t, fairydb.ErrorKeyNotFound, err)
+	assert.Equal(t, uint64(0), seq)
+
+	wb := db.NewWriteBatch(fairydb.DefaultWriteBatchOptions)
+	assert.Nil(t, wb.Put([]byte("b"), []byte("2")))
+	assert.Nil(t, wb.Put([]byte("c"), []byte("3")))
+	seq3, err := wb.CommitOpt(fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	assert.Greater(t, seq3, seq2)
+	txn := db.Begin(false)
+	assert.Nil(t, txn.Put([]byte("d"), []byte("4")))
+	seq4, err := txn.CommitOpt(fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	assert.Greater(t, seq4, seq3)
+	assert.Equal(t, seq4, db.LatestSequence())
+
+	changes, err := db.ChangesSince(seq1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(changes))
+	assert.Equal(t, fairydb.EventDelete, changes[0].Type)
+	assert.Equal(t, seq2, changes[0].Btsn)
+	assert.Equal(t, seq3, changes[1].Btsn)
+	assert.Equal(t, seq3, changes[2].Btsn)
+	assert.Equal(t, "d", string(changes[3].Key))
+	assert.Equal(t, seq4, changes[3].Btsn)
+
+	// 重启之后序列号依然可用
+	assert.Nil(t, db.Close())
+	db, err = fairydb.Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, seq4, db.LatestSequence())
+	changes, err = db.ChangesSince(seq3)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, "4", string(changes[0].Value))
+	seq5, err := db.PutOpt([]byte("e"), []byte("5"), fairydb.DefaultWriteOptions)
+	assert.Nil(t, err)
+	assert.Greater(t, seq5, seq4)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_WatchSyncWrites(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.SyncEveryWrite = true
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// 组提交中的事件在 sync 成功之后才发送，并且依然按照提交顺序到达
+	ch := db.Watch(context.Background(), nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte("value")))
+			}
+		}(i)
+	}
+	wg.Wait()
+	events := receiveEvents(t, ch, 100)
+	for i := 1; i < len(events); i++ {
+		assert.Greater(t, events[i].Btsn, events[i-1].Btsn)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_WatchOverflow(t *testing.T) {
+	options := fairydb.DefaultOptions
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	// 一直不消费的订阅者在队列溢出之后会收到 EventOverflow 事件，然后 channel 被关闭
+	// 除了 channel 的缓冲区和订阅者协程已经取出的一批事件之外，队列中最多暂存 1<<16 个事件
+	ch := db.Watch(context.Background(), nil)
+	n := 3 << 16
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("value")))
+	}
+	var received []fairydb.Event
+	for event := range ch {
+		received = append(received, event)
+	}
+	assert.Less(t, len(received), n)
+	overflow := received[len(received)-1]
+	assert.Equal(t, fairydb.EventOverflow, overflow.Type)
+	assert.Equal(t, received[len(received)-2].Btsn, overflow.Btsn)
+
+	// 从溢出事件的序列号处可以继续订阅，不会遗漏任何事件
+	ch, err = db.WatchFrom(context.Background(), nil, overflow.Btsn)
+	assert.Nil(t, err)
+	rest := receiveEvents(t, ch, n-len(received)+1)
+	assert.Equal(t, "key-"+fmt.Sprint(len(received)-1), string(rest[0].Key))
+	assert.Equal(t, fmt.Sprintf("key-%d", n-1), string(rest[len(rest)-1].Key))
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ChangesSinceSkipFiles(t *testing.T) {
+	options := fairydb.DefaultOptions
+	options.MaxFileSize = 32 * 1024
+	options.MergeRatio = 0
+	ClearDatabaseDir(options.DataDir)
+	db, err := fairydb.Open(options)
+	defer ClearDatabaseDir(options.DataDir)
+	assert.Nil(t, err)
+
+	const count = 2000
+	for i := 0; i < count; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	seq := db.LatestSequence()
+	for i := count; i < count+10; i++ {
+		assert.Nil(t, db.Put(utils.RandomTestKey(i), utils.RandomTestValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 破坏第一个数据文件，序列号都不大于 seq 的文件不会被读取
+	path := data.GetDataFilePath(options.DataDir, 0)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, bytes.Repeat([]byte{0xff}, len(content)), 0644))
+	for _, removeSnapshot := range []bool{false, true} {
+		if removeSnapshot {
+			assert.Nil(t, os.Remove(filepath.Join(options.DataDir, data.IndexSnapshotFileName)))
+		}
+		db, err = fairydb.Open(options)
+		assert.Nil(t, err)
+		changes, err := db.ChangesSince(seq)
+		assert.Nil(t, err)
+		assert.Equal(t, 10, len(changes))
+		assert.Equal(t, utils.RandomTestKey(count), changes[0].Key)
+		_, err = db.ChangesSince(0)
+		assert.NotNil(t, err)
+		assert.Nil(t, db.Close())
+	}
+}
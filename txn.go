@@ -0,0 +1,232 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"fairy-kvdb/data"
+	"fairy-kvdb/index"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Txn 乐观并发控制的 MVCC 事务，提供快照隔离
+// 事务中的读操作都基于事务开始时的一致性快照，写操作暂存在内存中，提交时以 batch transaction 的方式写入，
+// 如果事务读过或写过的 key 在事务开始之后被其他写操作修改过，则提交失败
+type Txn struct {
+	db            *DB
+	mu            *sync.Mutex
+	readOnly      bool
+	readTs        uint64                     // 事务开始时的 BTSN，事务只能看到序列号不大于它的写入
+	epoch         uint64                     // 事务作为读视图注册时所在的纪元
+	pendingWrites map[string]*data.LogRecord // 暂存事务中的写入
+	readKeys      map[string]struct{}        // 事务读过的 key，用于提交时的冲突检测
+	finished      bool
+}
+
+// Begin 开启一个新的事务
+func (db *DB) Begin(readOnly bool) *Txn {
+	if !readOnly && db.options.IndexType == int8(index.BPlusTreeIndexer) && !db.btsnFileExists && !db.isPureBoot {
+		panic("Cannot use `Txn`. B+Tree index requires btsn file.")
+	}
+	// 加读锁，保证获取到的 readTs 之前的写入都已经应用到了索引中
+	db.mu.RLock()
+	readTs := atomic.LoadUint64(&db.nextBTSN)
+	epoch := db.versions.acquire(readTs)
+	db.mu.RUnlock()
+	return &Txn{
+		db:            db,
+		mu:            new(sync.Mutex),
+		readOnly:      readOnly,
+		readTs:        readTs,
+		epoch:         epoch,
+		pendingWrites: make(map[string]*data.LogRecord),
+		readKeys:      make(map[string]struct{}),
+	}
+}
+
+// Get 读取 key 对应的数据，优先读取事务自身尚未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrorKeyEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrorTxnFinished
+	}
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDelete {
+			return nil, ErrorKeyNotFound
+		}
+		return record.Value, nil
+	}
+	txn.readKeys[string(key)] = struct{}{}
+	return txn.db.getAt(key, txn.readTs)
+}
+
+// Put 在事务中写入数据
+func (txn *Txn) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrorTxnFinished
+	}
+	if txn.readOnly {
+		return ErrorTxnReadOnly
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:   key,
+		Value: value,
+		Type:  data.LogRecordNormal,
+	}
+	return nil
+}
+
+// Delete 在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrorKeyEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrorTxnFinished
+	}
+	if txn.readOnly {
+		return ErrorTxnReadOnly
+	}
+	keyString := string(key)
+	// 如果快照中不存在这个 key，则只需要撤销事务中对它的写入
+	if _, err := txn.db.getAt(key, txn.readTs); err == ErrorKeyNotFound {
+		delete(txn.pendingWrites, keyString)
+		return nil
+	}
+	txn.pendingWrites[keyString] = &data.LogRecord{
+		Key:  key,
+		Type: data.LogRecordDelete,
+	}
+	return nil
+}
+
+// Iterator 返回事务的迭代器，它能看到事务开始时的快照以及事务自身的写入
+func (txn *Txn) Iterator(options IteratorOptions) *SnapshotIterator {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	txn.db.mu.RLock()
+	lower, upper := options.keyRange()
+	items := txn.db.snapshotItems(txn.readTs, lower, upper)
+	txn.db.mu.RUnlock()
+	// 事务遍历过的 key 都视为读过
+	for _, item := range items {
+		txn.readKeys[string(item.key)] = struct{}{}
+	}
+	return newSnapshotIterator(txn.db, mergePendingWrites(items, txn.pendingWrites, lower, upper), options)
+}
+
+// Commit 按照数据库默认的写入配置提交事务，如果发生了冲突则返回 ErrorTxnConflict，此时事务中的写入全部被丢弃
+// 需要保证提交之后立即持久化时使用 CommitOpt 并设置 Sync
+func (txn *Txn) Commit() error {
+	_, err := txn.CommitOpt(txn.db.defaultWriteOptions())
+	return err
+}
+
+// CommitOpt 按照指定的写入配置提交事务，返回事务的序列号，只读或者没有任何写入的事务返回 0
+func (txn *Txn) CommitOpt(opts WriteOptions) (uint64, error) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return 0, ErrorTxnFinished
+	}
+	defer txn.finish()
+	if txn.readOnly || len(txn.pendingWrites) == 0 {
+		return 0, nil
+	}
+	db := txn.db
+	if err := db.checkWriteOptions(opts); err != nil {
+		return 0, err
+	}
+	records := make([]*data.LogRecord, 0, len(txn.pendingWrites))
+	for _, record := range txn.pendingWrites {
+		records = append(records, record)
+	}
+	var btsn uint64
+	err := db.write(opts.Sync, func() error {
+		// 冲突检测：事务读过或写过的 key 在事务开始之后不能被修改过
+		for key := range txn.readKeys {
+			if db.versions.changedSince([]byte(key), txn.readTs) {
+				return ErrorTxnConflict
+			}
+		}
+		for key := range txn.pendingWrites {
+			if db.versions.changedSince([]byte(key), txn.readTs) {
+				return ErrorTxnConflict
+			}
+		}
+		var err error
+		btsn, err = db.commitBatch(records, !opts.DisableIndexUpdate)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return btsn, nil
+}
+
+// Rollback 回滚事务，丢弃事务中所有的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if !txn.finished {
+		txn.finish()
+	}
+}
+
+func (txn *Txn) finish() {
+	txn.finished = true
+	txn.pendingWrites = nil
+	txn.readKeys = nil
+	txn.db.versions.release(txn.readTs, txn.epoch)
+}
+
+// 读取 key 在 readTs 时刻的数据
+func (db *DB) getAt(key []byte, readTs uint64) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	pos := db.versions.resolve(key, readTs, db.index.Get(key))
+	if pos == nil || pos.IsExpired() {
+		return nil, ErrorKeyNotFound
+	}
+	return db.readValue(pos)
+}
+
+// 将事务中尚未提交的写入合并到快照数据中
+func mergePendingWrites(items []*snapshotItem, pendingWrites map[string]*data.LogRecord, lower, upper []byte) []*snapshotItem {
+	if len(pendingWrites) == 0 {
+		return items
+	}
+	merged := make(map[string]*snapshotItem, len(items)+len(pendingWrites))
+	for _, item := range items {
+		merged[string(item.key)] = item
+	}
+	for key, record := range pendingWrites {
+		if !inKeyRange(record.Key, lower, upper) {
+			continue
+		}
+		if record.Type == data.LogRecordDelete {
+			delete(merged, key)
+		} else {
+			merged[key] = &snapshotItem{key: record.Key, value: record.Value}
+		}
+	}
+	result := make([]*snapshotItem, 0, len(merged))
+	for _, item := range merged {
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].key, result[j].key) < 0
+	})
+	return result
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter 简单的字节速率限制器，用于限制后台任务（比如 merge）的 IO 速度
+type RateLimiter struct {
+	bytesPerSecond uint64
+	mu             *sync.Mutex
+	next           time.Time // 下一次允许继续读写的时间点
+}
+
+// NewRateLimiter 创建一个速率限制器，bytesPerSecond 为 0 时表示不限速，返回 nil
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytesPerSecond: bytesPerSecond,
+		mu:             new(sync.Mutex),
+	}
+}
+
+// Wait 申请 n 个字节的额度，如果超出了速率限制则阻塞等待
+func (rl *RateLimiter) Wait(n int64) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	wait := rl.next.Sub(now)
+	rl.next = rl.next.Add(time.Duration(float64(n) / float64(rl.bytesPerSecond) * float64(time.Second)))
+	rl.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,613 @@
+package fairy_kvdb
+
+import (
+	"fairy-kvdb/data"
+	"fairy-kvdb/fio"
+	"fairy-kvdb/index"
+	"fmt"
+	"github.com/gofrs/flock"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	quarantineDirName = "-quarantine"
+	bboltIndexName    = "bptree-index"
+)
+
+// VerifyIssueType 校验时发现的问题类型
+type VerifyIssueType int8
+
+const (
+	IssueCorruptRecord     VerifyIssueType = iota // 记录损坏，CRC 校验失败或者没有完整写入
+	IssueUnterminatedBatch                        // batch 中的记录没有对应的结束标记
+	IssueMissingDataFile                          // 索引指向了不存在的数据文件
+)
+
+func (t VerifyIssueType) String() string {
+	switch t {
+	case IssueCorruptRecord:
+		return "corrupt record"
+	case IssueUnterminatedBatch:
+		return "unterminated batch"
+	case IssueMissingDataFile:
+		return "missing data file"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyIssue 校验时发现的一个问题
+type VerifyIssue struct {
+	Type   VerifyIssueType
+	File   string // 问题所在的文件名
+	Offset int64  // 问题在文件中的起始位置
+	Size   int64  // 损坏区域的长度
+	Btsn   uint64 // 没有结束标记的 batch 的序列号
+	Key    []byte // 指向不存在的数据文件的 key
+	Detail string
+}
+
+func (issue VerifyIssue) String() string {
+	switch issue.Type {
+	case IssueCorruptRecord:
+		return fmt.Sprintf("%s: %s at offset %d, %d bytes: %s", issue.File, issue.Type, issue.Offset, issue.Size, issue.Detail)
+	case IssueUnterminatedBatch:
+		return fmt.Sprintf("%s: %s %d starts at offset %d", issue.File, issue.Type, issue.Btsn, issue.Offset)
+	default:
+		return fmt.Sprintf("%s: %s, key %q: %s", issue.File, issue.Type, issue.Key, issue.Detail)
+	}
+}
+
+// VerifyReport 校验结果
+type VerifyReport struct {
+	FilesChecked   int           // 校验过的文件数量
+	RecordsChecked int           // 校验过的完整记录数量
+	Issues         []VerifyIssue // 发现的所有问题
+}
+
+// OK 是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// 文件中需要隔离的区域，包括损坏的记录和没有结束标记的 batch
+type corruptRegion struct {
+	offset int64
+	size   int64
+}
+
+// 还没有遇到结束标记的 batch，以及它的每一条记录所在的区域
+type pendingBatch struct {
+	issue   VerifyIssue
+	files   []string
+	regions []corruptRegion
+}
+
+// Hint 文件中的索引记录由列族和 key 唯一确定
+type hintKey struct {
+	family uint32
+	key    string
+}
+
+// 校验过程的上下文
+type verifier struct {
+	dirPath   string
+	report    *VerifyReport
+	corrupt   map[string][]corruptRegion     // 文件名 -> 需要隔离的区域，按照位置升序排列
+	hint      map[hintKey]*data.LogRecordPos // Hint 文件中完整的索引记录
+	batches   map[uint64]*pendingBatch       // 还没有遇到结束标记的 batch
+	mergeInfo *mergeFinishedInfo             // merge 完成标志文件中的信息，nil 表示没有发生过 merge 或者已经损坏
+	fileIds   map[uint32]struct{}            // 存在的数据文件
+	cipher    *data.Cipher                   // 解密记录的 Cipher，没有设置加密密钥时为空
+}
+
+func newVerifier(dirPath string, cipher *data.Cipher) *verifier {
+	return &verifier{
+		dirPath: dirPath,
+		cipher:  cipher,
+		report:  &VerifyReport{},
+		corrupt: make(map[string][]corruptRegion),
+		hint:    make(map[hintKey]*data.LogRecordPos),
+		batches: make(map[uint64]*pendingBatch),
+		fileIds: make(map[uint32]struct{}),
+	}
+}
+
+// Verify 校验数据库中所有的数据文件、Hint 文件和 merge 完成标志文件
+// 检查每条记录的 CRC，以及没有结束标记的 batch 和指向不存在的数据文件的索引
+func (db *DB) Verify() (*VerifyReport, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	files := make([]*data.DataFile, 0, len(db.olderFiles)+1)
+	for _, dataFile := range db.olderFiles {
+		files = append(files, dataFile)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	v := newVerifier(db.options.DataDir, db.cipher)
+	if err := v.verifyFiles(files); err != nil {
+		return nil, err
+	}
+	v.checkIndex("index", db.index)
+	for _, cf := range db.families {
+		v.checkIndex("column family "+cf.name, cf.index)
+	}
+	return v.report, nil
+}
+
+// VerifyDir 在不打开数据库的情况下校验数据目录，数据目录不能正在被其他进程使用
+// 如果配置的是 B+ 树索引，还会检查持久化的索引
+func VerifyDir(options Options) (*VerifyReport, error) {
+	fileLock, err := lockDataDir(options.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+
+	cipher, err := newRecordCipher(options)
+	if err != nil {
+		return nil, err
+	}
+	v, files, err := verifyDir(options.DataDir, cipher)
+	closeDataFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	if idx := openPersistentIndex(options); idx != nil {
+		v.checkIndex(bboltIndexName, idx)
+		_ = idx.Close()
+	}
+	return v.report, nil
+}
+
+// Repair 修复数据目录，返回修复之前的校验结果
+// 损坏的区域会被移动到隔离目录中，数据文件中只保留完整的记录，之后根据新的位置重建 Hint 文件和持久化的索引，并删除已经失效的索引快照，
+// 保证修复之后的数据库可以正常打开
+// 合并操作数记录中保存的前一条记录的位置不会被修正，同一文件中位于损坏区域之后的操作数链在修复之后读取会返回 ErrorMergeOperandCorrupt
+func Repair(options Options) (*VerifyReport, error) {
+	fileLock, err := lockDataDir(options.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer fileLock.Unlock()
+
+	// 先让已经完成的 merge 生效，再进行修复
+	cipher, err := newRecordCipher(options)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{options: options, cipher: cipher}
+	if err := db.loadMergeFiles(); err != nil {
+		return nil, err
+	}
+	v, files, err := verifyDir(options.DataDir, cipher)
+	closeDataFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	// 隔离数据文件中损坏的区域
+	for _, dataFile := range files {
+		name := filepath.Base(data.GetDataFilePath(options.DataDir, dataFile.FileId))
+		if err := v.quarantine(name); err != nil {
+			return nil, err
+		}
+	}
+	// 重建 Hint 文件和 merge 完成标志文件
+	if err := v.rebuildMergeFiles(); err != nil {
+		return nil, err
+	}
+	// 修正持久化索引中的位置
+	if idx := openPersistentIndex(options); idx != nil {
+		v.repairIndex(idx)
+		if err := idx.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return v.report, nil
+}
+
+// 获取数据目录的文件锁，保证校验和修复时没有其他进程在使用数据库
+func lockDataDir(dirPath string) (*flock.Flock, error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	fileLock := flock.New(filepath.Join(dirPath, fileLockName))
+	holdFileLock, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !holdFileLock {
+		return nil, ErrorDatabaseIsUsing
+	}
+	return fileLock, nil
+}
+
+// 打开持久化的索引，只有 B+ 树索引会持久化
+func openPersistentIndex(options Options) index.Indexer {
+	if options.IndexType != int8(index.BPlusTreeIndexer) || options.BPlusTreeIndexOpts == nil {
+		return nil
+	}
+	return index.NewIndexer(index.BPlusTreeIndexer, options.BPlusTreeIndexOpts)
+}
+
+// 打开数据目录下的所有数据文件并进行校验
+func verifyDir(dirPath string, cipher *data.Cipher) (*verifier, []*data.DataFile, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []*data.DataFile
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.NameSuffix) {
+			continue
+		}
+		fileId, err := strconv.Atoi(strings.Split(entry.Name(), ".")[0])
+		if err != nil {
+			return nil, files, ErrorDataFileCorrupt
+		}
+		dataFile, err := data.OpenDataFile(dirPath, uint32(fileId), fio.StandardFIO)
+		if err != nil {
+			return nil, files, err
+		}
+		dataFile.Cipher = cipher
+		files = append(files, dataFile)
+	}
+	v := newVerifier(dirPath, cipher)
+	if err := v.verifyFiles(files); err != nil {
+		return nil, files, err
+	}
+	return v, files, nil
+}
+
+func closeDataFiles(files []*data.DataFile) {
+	for _, dataFile := range files {
+		_ = dataFile.Close()
+	}
+}
+
+// 依次校验 merge 完成标志文件、Hint 文件和所有的数据文件
+func (v *verifier) verifyFiles(files []*data.DataFile) error {
+	if err := v.verifyMergeFiles(); err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	for _, dataFile := range files {
+		v.fileIds[dataFile.FileId] = struct{}{}
+		name := filepath.Base(data.GetDataFilePath(v.dirPath, dataFile.FileId))
+		// 已经通过 Hint 文件加载索引的数据文件在启动时不会被重放，它们当中的 batch 不会影响启动
+		replayed := v.mergeInfo == nil || dataFile.FileId >= v.mergeInfo.nonMergeFid
+		err := v.scanFile(name, dataFile, func(record *data.LogRecord, offset int64, size int64) {
+			if !replayed || record.Btsn == data.NoTxnBTSN {
+				return
+			}
+			if record.Type == data.LogRecordBatchEnd {
+				delete(v.batches, record.Btsn)
+				return
+			}
+			batch, ok := v.batches[record.Btsn]
+			if !ok {
+				batch = &pendingBatch{
+					issue: VerifyIssue{Type: IssueUnterminatedBatch, File: name, Offset: offset, Btsn: record.Btsn},
+				}
+				v.batches[record.Btsn] = batch
+			}
+			batch.files = append(batch.files, name)
+			batch.regions = append(batch.regions, corruptRegion{offset: offset, size: size})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// 剩下的都是没有结束标记的 batch，它们的记录在启动时会被忽略，修复时可以一起隔离掉
+	btsns := make([]uint64, 0, len(v.batches))
+	for btsn := range v.batches {
+		btsns = append(btsns, btsn)
+	}
+	sort.Slice(btsns, func(i, j int) bool {
+		return btsns[i] < btsns[j]
+	})
+	for _, btsn := range btsns {
+		batch := v.batches[btsn]
+		v.report.Issues = append(v.report.Issues, batch.issue)
+		for i, name := range batch.files {
+			v.corrupt[name] = append(v.corrupt[name], batch.regions[i])
+		}
+	}
+	for name := range v.corrupt {
+		regions := v.corrupt[name]
+		sort.Slice(regions, func(i, j int) bool {
+			return regions[i].offset < regions[j].offset
+		})
+	}
+	// Hint 文件中的索引也不能指向不存在的数据文件
+	for _, key := range v.sortedHintKeys() {
+		v.checkIndexEntry(data.HintFileName, []byte(key.key), v.hint[key])
+	}
+	return nil
+}
+
+// 校验 merge 完成标志文件和 Hint 文件
+func (v *verifier) verifyMergeFiles() error {
+	if _, err := os.Stat(filepath.Join(v.dirPath, data.MergeFinishedFileName)); err == nil {
+		mergeFinFile, err := data.OpenMergeFinishedFile(v.dirPath)
+		if err != nil {
+			return err
+		}
+		err = v.scanFile(data.MergeFinishedFileName, mergeFinFile, func(record *data.LogRecord, _ int64, _ int64) {
+			if v.mergeInfo == nil && len(record.Value) >= 4 {
+				v.mergeInfo = decodeMergeFinishedInfo(record.Value)
+			}
+		})
+		_ = mergeFinFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(v.dirPath, data.HintFileName)); err == nil {
+		hintFile, err := data.OpenHintFile(v.dirPath)
+		if err != nil {
+			return err
+		}
+		hintFile.Cipher = v.cipher
+		err = v.scanFile(data.HintFileName, hintFile, func(record *data.LogRecord, _ int64, _ int64) {
+			if pos := data.DecodeLogRecordPos(record.Value); pos != nil {
+				v.hint[hintKey{family: record.Family, key: string(record.Key)}] = pos
+			}
+		})
+		_ = hintFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 顺序校验文件中的每一条记录，遇到损坏的区域时记录下来，并从下一条完整的记录处继续校验
+func (v *verifier) scanFile(name string, dataFile *data.DataFile, fn func(record *data.LogRecord, offset int64, size int64)) error {
+	v.report.FilesChecked++
+	fileSize, err := dataFile.IoManger.Size()
+	if err != nil {
+		return err
+	}
+	var offset int64 = 0
+	for offset < fileSize {
+		record, size, err := dataFile.ReadLogRecord(offset)
+		if err == nil {
+			v.report.RecordsChecked++
+			fn(record, offset, size)
+			offset += size
+			continue
+		}
+		if !isCorruptionError(err) {
+			return err
+		}
+		// 文件中间出现全 0 的区域时会被当作文件末尾，这也是一种损坏
+		if err == io.EOF {
+			err = data.ErrorInvalidCRC
+		}
+		next, findErr := findNextRecord(dataFile, offset+1)
+		if findErr != nil {
+			return findErr
+		}
+		v.corrupt[name] = append(v.corrupt[name], corruptRegion{offset: offset, size: next - offset})
+		v.report.Issues = append(v.report.Issues, VerifyIssue{
+			Type:   IssueCorruptRecord,
+			File:   name,
+			Offset: offset,
+			Size:   next - offset,
+			Detail: err.Error(),
+		})
+		offset = next
+	}
+	return nil
+}
+
+// 检查索引中的所有位置是否指向存在的数据文件
+func (v *verifier) checkIndex(name string, idx index.Indexer) {
+	iter := idx.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		v.checkIndexEntry(name, iter.Key(), iter.Value())
+	}
+}
+
+func (v *verifier) checkIndexEntry(name string, key []byte, pos *data.LogRecordPos) {
+	if _, ok := v.fileIds[pos.Fid]; ok {
+		return
+	}
+	v.report.Issues = append(v.report.Issues, VerifyIssue{
+		Type:   IssueMissingDataFile,
+		File:   name,
+		Key:    key,
+		Detail: fmt.Sprintf("data file %d does not exist", pos.Fid),
+	})
+}
+
+// 将文件中损坏的区域移动到隔离目录中，文件中只保留完整的记录
+func (v *verifier) quarantine(name string) error {
+	regions := v.corrupt[name]
+	if len(regions) == 0 {
+		return nil
+	}
+	path := filepath.Join(v.dirPath, name)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	quarantineDir := filepath.Join(v.dirPath, quarantineDirName)
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		return err
+	}
+	var kept []byte
+	var start int64 = 0
+	for _, region := range regions {
+		kept = append(kept, content[start:region.offset]...)
+		corruptPath := filepath.Join(quarantineDir, fmt.Sprintf("%s.%d", name, region.offset))
+		if err := os.WriteFile(corruptPath, content[region.offset:region.offset+region.size], fio.DataFIlePerm); err != nil {
+			return err
+		}
+		start = region.offset + region.size
+	}
+	kept = append(kept, content[start:]...)
+	// 数据文件中的记录发生了变化，它的 hint 文件和索引快照中的位置都已经失效
+	if strings.HasSuffix(name, data.NameSuffix) {
+		if err := os.Remove(strings.TrimSuffix(path, data.NameSuffix) + data.HintSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(v.dirPath, data.IndexSnapshotFileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// 先写临时文件再重命名，避免修复过程中崩溃导致数据文件不完整
+	tmpPath := path + ".repair"
+	if err := writeFileSync(tmpPath, kept); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// 重建 Hint 文件和 merge 完成标志文件，丢弃指向不存在的文件或者损坏区域的索引
+func (v *verifier) rebuildMergeFiles() error {
+	for _, name := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		if err := v.quarantine(name); err != nil {
+			return err
+		}
+	}
+	hintPath := filepath.Join(v.dirPath, data.HintFileName)
+	if _, err := os.Stat(hintPath); os.IsNotExist(err) {
+		return nil
+	}
+	var buf []byte
+	var maxFid uint32
+	for _, key := range v.sortedHintKeys() {
+		pos, ok := v.remap(v.hint[key])
+		if !ok {
+			continue
+		}
+		record := &data.LogRecord{Key: []byte(key.key), Value: data.EncodeLogRecordPos(pos), Family: key.family}
+		encRecord, _ := data.EncodeEncryptedLogRecord(record, data.CompressionNone, 0, v.cipher)
+		buf = append(buf, encRecord...)
+		if pos.Fid > maxFid {
+			maxFid = pos.Fid
+		}
+	}
+	if err := writeFileSync(hintPath+".repair", buf); err != nil {
+		return err
+	}
+	if err := os.Rename(hintPath+".repair", hintPath); err != nil {
+		return err
+	}
+	// merge 完成标志文件损坏时，根据 Hint 文件推算出最近没有参与 merge 的文件 ID
+	// merge 生成的文件与新的活跃文件之间的文件 ID 都是预留的，不会存在对应的数据文件
+	mergeFinPath := filepath.Join(v.dirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinPath); err == nil && v.mergeInfo == nil {
+		if err := os.Remove(mergeFinPath); err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			return writeMergeFinishedFile(v.dirPath, &mergeFinishedInfo{nonMergeFid: maxFid + 1})
+		}
+	}
+	return nil
+}
+
+// 按照列族和 key 排序的 Hint 索引记录，保证校验结果和重建的 Hint 文件是确定的
+func (v *verifier) sortedHintKeys() []hintKey {
+	keys := make([]hintKey, 0, len(v.hint))
+	for key := range v.hint {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].family != keys[j].family {
+			return keys[i].family < keys[j].family
+		}
+		return keys[i].key < keys[j].key
+	})
+	return keys
+}
+
+// 修正持久化索引中的位置
+func (v *verifier) repairIndex(idx index.Indexer) {
+	type indexEntry struct {
+		key []byte
+		pos *data.LogRecordPos
+	}
+	var entries []indexEntry
+	iter := idx.Iterator(false)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		entries = append(entries, indexEntry{key: iter.Key(), pos: iter.Value()})
+	}
+	iter.Close()
+	for _, entry := range entries {
+		pos, ok := v.remap(entry.pos)
+		if !ok {
+			idx.Delete(entry.key)
+		} else if pos.Offset != entry.pos.Offset {
+			idx.Put(entry.key, pos)
+		}
+	}
+}
+
+// 计算隔离损坏区域之后记录的新位置，如果记录所在的文件不存在或者记录本身已经被隔离，则返回 false
+func (v *verifier) remap(pos *data.LogRecordPos) (*data.LogRecordPos, bool) {
+	if _, ok := v.fileIds[pos.Fid]; !ok {
+		return nil, false
+	}
+	newPos := *pos
+	name := filepath.Base(data.GetDataFilePath(v.dirPath, pos.Fid))
+	for _, region := range v.corrupt[name] {
+		if pos.Offset >= region.offset+region.size {
+			newPos.Offset -= region.size
+		} else if pos.Offset >= region.offset {
+			return nil, false
+		}
+	}
+	return &newPos, true
+}
+
+// 判断读取记录时遇到的错误是否是由数据损坏导致的，CRC 正确但是无法解密的记录说明内容被篡改过
+func isCorruptionError(err error) bool {
+	return err == io.EOF || err == data.ErrorInvalidCRC || err == data.ErrorIncompleteRecord || err == data.ErrorDecryptFailed
+}
+
+// 从 offset 开始逐字节查找下一条完整的记录，找不到时返回文件大小
+func findNextRecord(dataFile *data.DataFile, offset int64) (int64, error) {
+	fileSize, err := dataFile.IoManger.Size()
+	if err != nil {
+		return 0, err
+	}
+	for ; offset < fileSize; offset++ {
+		_, _, err := dataFile.ReadLogRecord(offset)
+		if err == nil {
+			return offset, nil
+		}
+		if !isCorruptionError(err) {
+			return 0, err
+		}
+	}
+	return fileSize, nil
+}
+
+func writeFileSync(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFIlePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
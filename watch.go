@@ -0,0 +1,337 @@
+package fairy_kvdb
+
+import (
+	"bytes"
+	"context"
+	"fairy-kvdb/data"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 订阅者的 channel 缓冲区大小，超出的事件会暂存在订阅者的队列中
+const watchChannelSize = 64
+
+// 订阅者队列中最多暂存的事件数量，超出之后订阅者会收到 EventOverflow 事件并被关闭
+const watchQueueLimit = 1 << 16
+
+// EventType 变更事件的类型
+type EventType byte
+
+const (
+	EventPut         EventType = iota // 写入数据
+	EventDelete                       // 删除数据
+	EventMerge                        // 追加合并操作数，Value 为操作数本身
+	EventDeleteRange                  // 范围删除，Key 为范围的起点，Value 为范围的终点（不包含），终点为空表示没有上界
+	EventOverflow                     // 订阅者消费得太慢，之后的事件被丢弃，channel 随后会被关闭，可以通过 WatchFrom(Btsn) 继续订阅
+)
+
+// Event 一次已经提交的写入所产生的变更事件
+type Event struct {
+	Type   EventType
+	Key    []byte
+	Value  []byte
+	Expire int64  // 过期时间（UnixNano），0 表示永不过期
+	Btsn   uint64 // 提交时的序列号，同一个 batch 中的所有事件序列号相同
+}
+
+// 变更事件的订阅者
+// 写入时事件先追加到订阅者的队列中，再由单独的协程按顺序发送，因此消费得慢的订阅者不会阻塞写入
+type watcher struct {
+	prefix []byte
+	ch     chan Event
+	mu     sync.Mutex
+	queue  []Event
+	notify chan struct{}
+
+	overflowed   bool   // 队列已满，之后的事件都会被丢弃
+	overflowBtsn uint64 // 被丢弃的第一个事件之前的序列号
+}
+
+// Watch 订阅默认列族中 key 以 prefix 开头的变更事件，事件按照提交顺序发送，同一个 batch 中的事件会连续发送
+// ctx 结束或者数据库关闭时 channel 会被关闭
+func (db *DB) Watch(ctx context.Context, prefix []byte) <-chan Event {
+	w := db.addWatcher(prefix)
+	go db.runWatcher(ctx, w)
+	return w.ch
+}
+
+// WatchFrom 与 Watch 相同，但会先从数据文件中重放序列号大于 seq 的变更事件，之后再发送新的变更事件
+// 重放的事件来自数据文件中现存的记录，已经被 merge 清理掉的历史变更（比如被覆盖的值和删除操作）不会被重放
+func (db *DB) WatchFrom(ctx context.Context, prefix []byte, seq uint64) (<-chan Event, error) {
+	var w *watcher
+	// 在读锁的保护下注册订阅者并确定重放的范围，保证重放的事件和之后收到的事件既不重复也不遗漏
+	events, err := db.changesSince(seq, prefix, func() {
+		w = db.addWatcher(prefix)
+	})
+	if err != nil {
+		db.removeWatcher(w)
+		return nil, err
+	}
+	w.mu.Lock()
+	w.queue = append(events, w.queue...)
+	w.mu.Unlock()
+	go db.runWatcher(ctx, w)
+	return w.ch, nil
+}
+
+// LatestSequence 返回最近一次提交的写入的序列号，没有任何写入时返回 0
+func (db *DB) LatestSequence() uint64 {
+	return atomic.LoadUint64(&db.nextBTSN)
+}
+
+// ChangesSince 返回默认列族中序列号大于 seq 的所有变更事件，按照序列号排序
+// 与 WatchFrom 一样，已经被 merge 清理掉的历史变更不会被返回
+func (db *DB) ChangesSince(seq uint64) ([]Event, error) {
+	return db.changesSince(seq, nil, nil)
+}
+
+// 从数据文件中读取序列号大于 seq 并且 key 以 prefix 开头的变更事件
+// locked 不为 nil 时会在确定读取范围的同时在读锁的保护下调用
+func (db *DB) changesSince(seq uint64, prefix []byte, locked func()) ([]Event, error) {
+	db.mu.RLock()
+	if locked != nil {
+		locked()
+	}
+	lastSeq := atomic.LoadUint64(&db.nextBTSN)
+	epoch := db.versions.acquire(lastSeq) // 保证读取期间数据文件不会被 merge 删除
+	// 文件中所有记录的序列号都不大于 seq 时，不需要读取这个文件
+	skip := func(fid uint32) bool {
+		maxSeq, ok := db.fileMaxSeqs[fid]
+		return ok && maxSeq <= seq
+	}
+	files := make([]*data.DataFile, 0, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		if !skip(fid) {
+			files = append(files, dataFile)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	var activeOffset int64 = -1
+	if db.activeFile != nil && !skip(db.activeFile.FileId) {
+		files = append(files, db.activeFile)
+		activeOffset = db.activeFile.WriteOffset
+	}
+	db.mu.RUnlock()
+
+	events, err := replayEvents(files, activeOffset, prefix, seq, lastSeq)
+	db.versions.release(lastSeq, epoch)
+	return events, err
+}
+
+func (db *DB) addWatcher(prefix []byte) *watcher {
+	w := &watcher{
+		prefix: prefix,
+		ch:     make(chan Event, watchChannelSize),
+		notify: make(chan struct{}, 1),
+	}
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+	return w
+}
+
+func (db *DB) removeWatcher(w *watcher) {
+	db.watchMu.Lock()
+	delete(db.watchers, w)
+	db.watchMu.Unlock()
+}
+
+// 将队列中的事件依次发送给订阅者，队列溢出时发送完已有的事件之后再发送 EventOverflow 事件并退出
+func (db *DB) runWatcher(ctx context.Context, w *watcher) {
+	defer close(w.ch)
+	defer db.removeWatcher(w)
+	for {
+		w.mu.Lock()
+		events := w.queue
+		w.queue = nil
+		overflowed := w.overflowed && len(events) == 0
+		if overflowed {
+			events = []Event{{Type: EventOverflow, Btsn: w.overflowBtsn}}
+		}
+		w.mu.Unlock()
+		for _, event := range events {
+			select {
+			case w.ch <- event:
+			case <-ctx.Done():
+				return
+			case <-db.watchCloseCh:
+				return
+			}
+		}
+		if overflowed {
+			return
+		}
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return
+		case <-db.watchCloseCh:
+			return
+		}
+	}
+}
+
+// 将已经写入数据文件的记录通知给所有的订阅者，一次调用中的记录会作为一个整体加入订阅者的队列
+// 组提交期间产生的事件会先暂存起来，等到 sync 成功之后再发送
+// 访问这个方法前必须加锁
+func (db *DB) notifyWatchers(records ...*data.LogRecord) {
+	db.watchMu.Lock()
+	watching := len(db.watchers) > 0
+	db.watchMu.Unlock()
+	if !watching {
+		return
+	}
+	events := make([]Event, 0, len(records))
+	for _, record := range records {
+		if event, ok := newEvent(record, record.Sequence()); ok {
+			events = append(events, event)
+		}
+	}
+	if db.heldEvents != nil {
+		*db.heldEvents = append(*db.heldEvents, events)
+		return
+	}
+	db.publishEvents(events)
+}
+
+// 将一组变更事件加入所有订阅者的队列
+func (db *DB) publishEvents(events []Event) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for w := range db.watchers {
+		w.push(events)
+	}
+}
+
+// 将一组事件中与前缀相关的部分加入订阅者的队列，一组事件要么全部加入，要么在队列溢出时全部丢弃
+func (w *watcher) push(events []Event) {
+	var matched []Event
+	for _, event := range events {
+		if event.matches(w.prefix) {
+			matched = append(matched, event)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+	w.mu.Lock()
+	// 已经溢出的订阅者不再接收任何事件
+	pushed := !w.overflowed
+	if pushed {
+		if len(w.queue)+len(matched) > watchQueueLimit {
+			w.overflowed = true
+			w.overflowBtsn = matched[0].Btsn - 1
+		} else {
+			w.queue = append(w.queue, matched...)
+		}
+	}
+	w.mu.Unlock()
+	if pushed {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 根据记录构造变更事件，只有默认列族中的数据记录才会产生事件
+func newEvent(record *data.LogRecord, seq uint64) (Event, bool) {
+	if record.Family != defaultFamilyId {
+		return Event{}, false
+	}
+	event := Event{
+		Key:    append([]byte(nil), record.Key...),
+		Expire: record.Expire,
+		Btsn:   seq,
+	}
+	switch record.Type {
+	case data.LogRecordNormal:
+		event.Type = EventPut
+		event.Value = append([]byte(nil), record.Value...)
+	case data.LogRecordBlob:
+		event.Type = EventPut // 大对象的内容不会放在事件中，需要通过 GetReader 读取
+	case data.LogRecordDelete:
+		event.Type = EventDelete
+	case data.LogRecordMergeOperand:
+		_, operand, ok := data.DecodeMergeOperand(record.Value)
+		if !ok {
+			return Event{}, false
+		}
+		event.Type = EventMerge
+		event.Value = append([]byte(nil), operand...)
+	case data.LogRecordRangeDelete:
+		event.Type = EventDeleteRange
+		event.Value = append([]byte(nil), record.Value...)
+	default:
+		return Event{}, false
+	}
+	return event, true
+}
+
+// 判断事件是否与订阅的前缀相关，范围删除事件只要范围与前缀覆盖的 key 有交集就需要发送
+func (event *Event) matches(prefix []byte) bool {
+	if event.Type != EventDeleteRange {
+		return bytes.HasPrefix(event.Key, prefix)
+	}
+	if len(event.Value) > 0 && bytes.Compare(event.Value, prefix) <= 0 {
+		return false
+	}
+	end := prefixEnd(prefix)
+	return end == nil || bytes.Compare(event.Key, end) < 0
+}
+
+// 从数据文件中读取序列号在 (fromSeq, toSeq] 之间的变更事件，按照序列号排序
+// 文件需要按照 ID 升序排列，activeOffset 不小于 0 时最后一个是活跃文件，它只读取到 activeOffset 为止，之后的写入会通过订阅者的队列收到
+func replayEvents(files []*data.DataFile, activeOffset int64, prefix []byte, fromSeq, toSeq uint64) ([]Event, error) {
+	var events []Event
+	batches := make(map[uint64][]*data.LogRecord)
+	for i, dataFile := range files {
+		limit := int64(-1)
+		if i == len(files)-1 {
+			limit = activeOffset
+		}
+		var offset int64 = 0
+		for limit < 0 || offset < limit {
+			record, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			offset += size
+			seq := record.Sequence()
+			if seq <= fromSeq || seq > toSeq {
+				continue
+			}
+			// batch 中的记录只有遇到结束标记之后才是已经提交的
+			if record.Btsn != data.NoTxnBTSN {
+				if record.Type == data.LogRecordBatchEnd {
+					for _, batchRecord := range batches[seq] {
+						if event, ok := newEvent(batchRecord, seq); ok && event.matches(prefix) {
+							events = append(events, event)
+						}
+					}
+					delete(batches, seq)
+				} else {
+					batches[seq] = append(batches[seq], record)
+				}
+				continue
+			}
+			if event, ok := newEvent(record, seq); ok && event.matches(prefix) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Btsn < events[j].Btsn
+	})
+	return events, nil
+}